@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/shopspring/decimal"
+)
+
+// the number of decimal places each asset is accounted in, from the assets
+// table. unknown assets use 2. stellar itself can't go beyond 7.
+type Precisions struct {
+	sync.RWMutex
+	byCode map[string]int32
+}
+
+const defaultPrecision = 2
+
+func (app *App) assetPrecision(code string) int32 {
+	app.precisions.RLock()
+	byCode := app.precisions.byCode
+	app.precisions.RUnlock()
+
+	if byCode == nil {
+		var rows []struct {
+			Code      string `db:"code"`
+			Precision int32  `db:"precision"`
+		}
+		err := app.pg.Select(&rows, `SELECT code, precision FROM assets`)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to load asset precisions")
+			return defaultPrecision
+		}
+
+		byCode = make(map[string]int32, len(rows))
+		for _, row := range rows {
+			byCode[row.Code] = row.Precision
+		}
+
+		app.precisions.Lock()
+		app.precisions.byCode = byCode
+		app.precisions.Unlock()
+	}
+
+	if p, ok := byCode[code]; ok {
+		return p
+	}
+	return defaultPrecision
+}
+
+// formatAmount renders `value` with exactly the decimal places of `asset`.
+func (app *App) formatAmount(value decimal.Decimal, asset string) string {
+	return value.StringFixed(app.assetPrecision(asset))
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/accountd"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/lucsky/cuid"
+	"github.com/stellar/go/build"
+)
+
+// people log in through one of the providers listed on AUTH_PROVIDERS,
+// which tell us who they are and which accounts elsewhere (like
+// fulano@twitter) they own. logging in with an account claims the parties
+// that were declared with it before, see login.
+//
+// each provider starts its login on /auth/<provider> and finishes it on
+// /auth/<provider>/callback. /auth/callback is kept for accountd.
+
+// Identity is who a provider says has logged in. providers that check
+// ownership of a stellar account set only the Address, see login.
+type Identity struct {
+	Id       string
+	Accounts []string
+	Address  string
+}
+
+type Authenticator interface {
+	// Start begins a login, usually by redirecting to the provider.
+	Start(w http.ResponseWriter, r *http.Request)
+
+	// Finish is called when the provider sends the user back.
+	Finish(w http.ResponseWriter, r *http.Request) (Identity, error)
+}
+
+func newAuthenticators(
+	s Settings,
+	store *sessions.CookieStore,
+	h Horizon,
+	n build.Network,
+) (map[string]Authenticator, error) {
+	authenticators := make(map[string]Authenticator)
+	for _, name := range s.AuthProviders {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "accountd":
+			accountd.HOST = s.AccountdHost
+			authenticators[name] = accountdAuth{s.AccountdHost, s.ServiceURL}
+		case "oauth2":
+			if s.OAuth2AuthURL == "" || s.OAuth2TokenURL == "" || s.OAuth2UserInfoURL == "" {
+				return nil, errors.New("oauth2 login needs OAUTH2_AUTH_URL, OAUTH2_TOKEN_URL and OAUTH2_USERINFO_URL")
+			}
+			authenticators[name] = oauth2Auth{s, store}
+		case "email":
+			authenticators[name] = emailAuth{s}
+		case "sep10":
+			authenticators[name] = sep10Auth{s, h, n}
+		case "mock":
+			log.Warn().Msg("mock login enabled, anyone can log in as anyone.")
+			authenticators[name] = mockAuth{}
+		default:
+			return nil, errors.New("unknown login provider: " + name)
+		}
+	}
+	return authenticators, nil
+}
+
+func (app *App) startLogin(w http.ResponseWriter, r *http.Request) {
+	auth, ok := app.authenticators[mux.Vars(r)["provider"]]
+	if !ok {
+		http.Error(w, "unknown login provider", 404)
+		return
+	}
+	auth.Start(w, r)
+}
+
+func (app *App) finishLogin(w http.ResponseWriter, r *http.Request) {
+	provider, ok := mux.Vars(r)["provider"]
+	if !ok {
+		provider = "accountd"
+	}
+	auth, ok := app.authenticators[provider]
+	if !ok {
+		http.Error(w, "unknown login provider", 404)
+		return
+	}
+
+	identity, err := auth.Finish(w, r)
+	if err != nil {
+		log.Error().Err(err).Str("provider", provider).Msg("invalid authorization")
+		http.Error(w, "invalid authorization", 401)
+		return
+	}
+
+	userId, err := app.login(w, r, identity)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// logins made from scripts, like sep10 ones, get the user instead
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"user": userId})
+		return
+	}
+	http.Redirect(w, r, "/app/", 302)
+}
+
+// login sets up the session for `identity` and returns the id of the user.
+// users who log in on one of the other domains served here (see
+// federation.go) get the prefix of that domain on their ids.
+//
+// identities with a stellar address log in as the user that has it. if
+// nobody has it yet a new user named after the address is created, which is
+// non-custodial. addresses are never bound to existing users here, that is
+// done by the setAddress mutation.
+func (app *App) login(w http.ResponseWriter, r *http.Request, identity Identity) (string, error) {
+	session, err := app.sessionStore.Get(r, "auth-session")
+	if err != nil {
+		return "", err
+	}
+
+	domain, prefix := app.loginDomain(r.Host)
+	if identity.Id != "" {
+		identity.Id = prefix + identity.Id
+	}
+
+	if identity.Address != "" && identity.Id == "" {
+		app.pg.Get(&identity.Id, "SELECT id FROM users WHERE address = $1", identity.Address)
+		if identity.Id == "" {
+			identity.Id = prefix + strings.ToLower(identity.Address)
+		}
+	}
+
+	existing, err := app.getExistingUser(identity.Id)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	// otherwise they would be taken for users of that other domain
+	if _, d := app.federationAddress(identity.Id); existing.Id == "" && !strings.EqualFold(d, domain) {
+		return "", errors.New("user id reserved for " + d)
+	}
+
+	if identity.Address != "" && existing.Id != "" && existing.Address != identity.Address {
+		// someone else is named after this address
+		return "", errors.New("address-already-registered")
+	}
+
+	user, err := app.ensureUser(identity.Id)
+	if err != nil {
+		return "", err
+	}
+
+	if identity.Address != "" && user.Address != identity.Address {
+		_, err = app.setExternalAddress(user.Id, identity.Address)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// we now check if this user owns one of the accounts
+	// we have registered here (like if some debtmoney user
+	// has declared a debt with fulano@twitter we want to
+	// know if this new logged user owns fulano@twitter and
+	// redirect these debts to him).
+	params := make([]interface{}, len(identity.Accounts)+1)
+	params[0] = identity.Id
+	accvars := make([]string, len(identity.Accounts)+1)
+	accvars[0] = "$1"
+	for i, account := range identity.Accounts {
+		accvars[i+1] = "$" + strconv.Itoa(i+2)
+		params[i+1] = account
+	}
+	vars := strings.Join(accvars, ",")
+
+	_, err = app.pg.Exec(`
+UPDATE parties SET user_id = $1
+WHERE account_name IN (`+vars+`)
+    `, params...)
+	if err != nil {
+		log.Error().Err(err).Str("user", identity.Id).
+			Msg("failed to update parties records to user")
+	}
+
+	// finally we set up the session
+	session.Values["userId"] = identity.Id
+	return identity.Id, session.Save(r, w)
+}
+
+// accountd verifies accounts on twitter, github and email for us.
+type accountdAuth struct {
+	host       string
+	serviceURL string
+}
+
+func (a accountdAuth) Start(w http.ResponseWriter, r *http.Request) {
+	qs := url.Values{}
+	qs.Set("user", r.FormValue("user"))
+	qs.Set("account", r.FormValue("account"))
+	qs.Set("redirect_uri", a.serviceURL+"/auth/callback")
+	http.Redirect(w, r, a.host+"/login?"+qs.Encode(), 302)
+}
+
+func (a accountdAuth) Finish(w http.ResponseWriter, r *http.Request) (identity Identity, err error) {
+	accountduser, err := accountd.VerifyAuth(r.URL.Query().Get("code"))
+	if err != nil {
+		return
+	}
+
+	identity.Id = accountduser.Id
+	for _, account := range accountduser.Accounts {
+		identity.Accounts = append(identity.Accounts, account.Account)
+	}
+	return
+}
+
+// oauth2Auth logs in with any OAuth2 provider that has a userinfo endpoint,
+// which includes all OpenID Connect ones. the user id is taken from the
+// OAuth2IdClaim of the userinfo, plus OAuth2Suffix.
+type oauth2Auth struct {
+	s     Settings
+	store *sessions.CookieStore
+}
+
+func (a oauth2Auth) Start(w http.ResponseWriter, r *http.Request) {
+	session, err := a.store.Get(r, "auth-session")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	state := cuid.New()
+	session.Values["oauth2-state"] = state
+	session.Save(r, w)
+
+	qs := url.Values{}
+	qs.Set("response_type", "code")
+	qs.Set("client_id", a.s.OAuth2ClientID)
+	qs.Set("redirect_uri", a.s.ServiceURL+"/auth/oauth2/callback")
+	qs.Set("scope", a.s.OAuth2Scopes)
+	qs.Set("state", state)
+
+	sep := "?"
+	if strings.Contains(a.s.OAuth2AuthURL, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, a.s.OAuth2AuthURL+sep+qs.Encode(), 302)
+}
+
+func (a oauth2Auth) Finish(w http.ResponseWriter, r *http.Request) (identity Identity, err error) {
+	session, err := a.store.Get(r, "auth-session")
+	if err != nil {
+		return
+	}
+	state, _ := session.Values["oauth2-state"].(string)
+	delete(session.Values, "oauth2-state")
+	if state == "" || state != r.URL.Query().Get("state") {
+		return identity, errors.New("invalid oauth2 state")
+	}
+
+	resp, err := http.PostForm(a.s.OAuth2TokenURL, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {r.URL.Query().Get("code")},
+		"redirect_uri":  {a.s.ServiceURL + "/auth/oauth2/callback"},
+		"client_id":     {a.s.OAuth2ClientID},
+		"client_secret": {a.s.OAuth2ClientSecret},
+	})
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return
+	}
+	if token.AccessToken == "" {
+		return identity, errors.New("no access token: " + token.Error)
+	}
+
+	req, err := http.NewRequest("GET", a.s.OAuth2UserInfoURL, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	req.Header.Set("Accept", "application/json")
+	infoResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer infoResp.Body.Close()
+
+	var info map[string]interface{}
+	err = json.NewDecoder(infoResp.Body).Decode(&info)
+	if err != nil {
+		return
+	}
+
+	var id string
+	switch v := info[a.s.OAuth2IdClaim].(type) {
+	case string:
+		id = v
+	case float64:
+		id = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	if id == "" {
+		return identity, errors.New("userinfo has no '" + a.s.OAuth2IdClaim + "'")
+	}
+
+	// anyone could claim the parties declared with an address they typed
+	if a.s.OAuth2IdClaim == "email" {
+		if verified, _ := info["email_verified"].(bool); !verified {
+			return identity, errors.New("email '" + id + "' is not verified")
+		}
+	}
+
+	id = strings.ToLower(id + a.s.OAuth2Suffix)
+	return Identity{Id: id, Accounts: []string{id}}, nil
+}
+
+// emailAuth sends a link that logs in whoever opens it as the email
+// address it was sent to. links are signed with SecretKey and expire in
+// `magicLinkTTL`, nothing is stored.
+type emailAuth struct {
+	s Settings
+}
+
+const magicLinkTTL = 15 * time.Minute
+
+func (a emailAuth) Start(w http.ResponseWriter, r *http.Request) {
+	email := strings.ToLower(strings.TrimSpace(r.FormValue("email")))
+	if !strings.Contains(email, "@") || strings.ContainsAny(email, " \r\n") {
+		http.Error(w, "invalid email", 400)
+		return
+	}
+
+	payload := email + "|" + strconv.FormatInt(time.Now().Add(magicLinkTTL).Unix(), 10)
+	token := base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + a.sign(payload)
+	link := a.s.ServiceURL + "/auth/email/callback?token=" + url.QueryEscape(token)
+
+	if a.s.SMTPAddr == "" {
+		log.Warn().Str("email", email).Str("link", link).
+			Msg("SMTP_ADDR not set, not sending login link.")
+	} else {
+		var auth smtp.Auth
+		if a.s.SMTPUser != "" {
+			host := strings.Split(a.s.SMTPAddr, ":")[0]
+			auth = smtp.PlainAuth("", a.s.SMTPUser, a.s.SMTPPassword, host)
+		}
+		message := "From: " + a.s.EmailFrom + "\r\n" +
+			"To: " + email + "\r\n" +
+			"Subject: your login link\r\n" +
+			"\r\n" +
+			"open " + link + " to log in.\r\n" +
+			"it expires in " + magicLinkTTL.String() + ".\r\n"
+		err := smtp.SendMail(a.s.SMTPAddr, auth, a.s.EmailFrom, []string{email}, []byte(message))
+		if err != nil {
+			log.Error().Err(err).Str("email", email).Msg("failed to send login link")
+			http.Error(w, "failed to send email", 500)
+			return
+		}
+	}
+
+	fmt.Fprintf(w, "we've sent a login link to %s.", email)
+}
+
+func (a emailAuth) Finish(w http.ResponseWriter, r *http.Request) (identity Identity, err error) {
+	parts := strings.SplitN(r.URL.Query().Get("token"), ".", 2)
+	if len(parts) != 2 {
+		return identity, errors.New("invalid token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return identity, errors.New("invalid token")
+	}
+	if !hmac.Equal([]byte(a.sign(string(payload))), []byte(parts[1])) {
+		return identity, errors.New("invalid token signature")
+	}
+
+	fields := strings.SplitN(string(payload), "|", 2)
+	if len(fields) != 2 {
+		return identity, errors.New("invalid token")
+	}
+	expires, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return identity, errors.New("expired token")
+	}
+
+	return Identity{Id: fields[0], Accounts: []string{fields[0]}}, nil
+}
+
+func (a emailAuth) sign(payload string) string {
+	mac := hmac.New(sha256.New, []byte(a.s.SecretKey))
+	mac.Write([]byte("email-login|" + payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// mockAuth logs in as whatever `user` is given, with the accounts in
+// `account`. only for development and tests.
+type mockAuth struct{}
+
+func (a mockAuth) Start(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "/auth/mock/callback?"+r.URL.RawQuery, 302)
+}
+
+func (a mockAuth) Finish(w http.ResponseWriter, r *http.Request) (identity Identity, err error) {
+	qs := r.URL.Query()
+	if qs.Get("user") == "" {
+		return identity, errors.New("no user")
+	}
+	return Identity{Id: qs.Get("user"), Accounts: qs["account"]}, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a standard 5-field cron expression
+// (minute, hour, day of month, month, day of week), evaluated in UTC.
+// fields accept `*`, numbers, ranges (`a-b`), steps (`*/n`, `a-b/n`) and
+// comma-separated lists of those.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// as in vixie cron, when both day fields are restricted a day matches
+	// if either of them matches.
+	domStar, dowStar bool
+}
+
+func parseCron(expr string) (cron cronSchedule, err error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return cron, errors.New("cron expressions must have 5 fields")
+	}
+
+	if cron.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return
+	}
+	if cron.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return
+	}
+	if cron.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return
+	}
+	if cron.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return
+	}
+	if cron.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return
+	}
+
+	// sunday can be both 0 and 7
+	if cron.dow&(1<<7) != 0 {
+		cron.dow |= 1
+	}
+
+	// `*/2` is still a star, as in vixie cron
+	cron.domStar = strings.HasPrefix(fields[2], "*")
+	cron.dowStar = strings.HasPrefix(fields[4], "*")
+	return
+}
+
+func parseCronField(field string, min, max int) (bits uint64, err error) {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i != -1 {
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, errors.New("invalid step in cron field: " + field)
+			}
+			part = part[:i]
+		}
+
+		start, end := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			start, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, errors.New("invalid cron field: " + field)
+			}
+			end = start
+			if len(bounds) == 2 {
+				end, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, errors.New("invalid cron field: " + field)
+				}
+			} else if step != 1 {
+				// `a/n` means from a to the end
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			return 0, errors.New("out of range cron field: " + field)
+		}
+
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return
+}
+
+func (cron cronSchedule) matchesDay(t time.Time) bool {
+	dom := cron.dom&(1<<uint(t.Day())) != 0
+	dow := cron.dow&(1<<uint(t.Weekday())) != 0
+
+	if cron.domStar || cron.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first time after `after` that matches the schedule.
+func (cron cronSchedule) next(after time.Time) (time.Time, error) {
+	t := after.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if cron.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !cron.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if cron.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if cron.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t, nil
+	}
+
+	return t, errors.New("cron expression never matches")
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func date(s string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestParseCron(t *testing.T) {
+	for _, test := range []struct {
+		expr  string
+		valid bool
+	}{
+		{"* * * * *", true},
+		{"*/15 9-17 * * 1-5", true},
+		{"0 0 1,15 * *", true},
+		{"0 0 * * 7", true},
+		{"5/10 * * * *", true},
+		{"0-30/10 * * * *", true},
+		{"* * * *", false},
+		{"* * * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"*/0 * * * *", false},
+		{"10-5 * * * *", false},
+		{"a * * * *", false},
+	} {
+		_, err := parseCron(test.expr)
+		if (err == nil) != test.valid {
+			t.Errorf("parseCron(%q): got error %v, want valid %v", test.expr, err, test.valid)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	for _, test := range []struct {
+		expr  string
+		after string
+		want  string
+	}{
+		// steps and ranges
+		{"*/15 * * * *", "2017-03-01 10:07", "2017-03-01 10:15"},
+		{"*/15 * * * *", "2017-03-01 10:45", "2017-03-01 11:00"},
+		{"5/20 * * * *", "2017-03-01 10:26", "2017-03-01 10:45"},
+		{"0 9-17/4 * * *", "2017-03-01 13:00", "2017-03-01 17:00"},
+		{"0 9-17/4 * * *", "2017-03-01 17:00", "2017-03-02 09:00"},
+		{"30 8 1,15 * *", "2017-03-02 00:00", "2017-03-15 08:30"},
+
+		// strictly after
+		{"0 0 * * *", "2017-03-01 00:00", "2017-03-02 00:00"},
+
+		// day of week, sunday as 0 and 7
+		{"0 12 * * 1-5", "2017-03-03 13:00", "2017-03-06 12:00"},
+		{"0 0 * * 0", "2017-03-01 00:00", "2017-03-05 00:00"},
+		{"0 0 * * 7", "2017-03-01 00:00", "2017-03-05 00:00"},
+
+		// both days restricted: either matches
+		{"0 0 13 * 5", "2017-03-01 00:00", "2017-03-03 00:00"},
+		{"0 0 13 * 5", "2017-03-10 00:00", "2017-03-13 00:00"},
+
+		// one of them a star, even with a step: both must match
+		{"0 0 13 * *", "2017-03-01 00:00", "2017-03-13 00:00"},
+		{"0 0 */2 * 5", "2017-03-01 00:00", "2017-03-03 00:00"},
+		{"0 0 */2 * 5", "2017-03-03 00:00", "2017-03-17 00:00"},
+		{"0 0 13 * */1", "2017-03-01 00:00", "2017-03-13 00:00"},
+		{"0 0 13 * */7", "2017-03-01 00:00", "2017-08-13 00:00"},
+
+		// months
+		{"0 0 1 */3 *", "2017-02-10 00:00", "2017-04-01 00:00"},
+		{"0 0 1 1 *", "2017-06-01 00:00", "2018-01-01 00:00"},
+
+		// feb 29 and the end of months
+		{"0 0 29 2 *", "2017-03-01 00:00", "2020-02-29 00:00"},
+		{"0 0 31 * *", "2017-04-01 00:00", "2017-05-31 00:00"},
+		{"0 0 30 * *", "2017-01-31 00:00", "2017-03-30 00:00"},
+		{"59 23 31 12 *", "2017-12-31 23:58", "2017-12-31 23:59"},
+		{"0 0 1 * *", "2017-12-31 23:59", "2018-01-01 00:00"},
+	} {
+		cron, err := parseCron(test.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", test.expr, err)
+			continue
+		}
+		next, err := cron.next(date(test.after))
+		if err != nil {
+			t.Errorf("%q after %s: %v", test.expr, test.after, err)
+			continue
+		}
+		if !next.Equal(date(test.want)) {
+			t.Errorf("%q after %s: got %s, want %s",
+				test.expr, test.after, next.Format("2006-01-02 15:04"), test.want)
+		}
+	}
+}
+
+func TestCronNeverMatches(t *testing.T) {
+	cron, err := parseCron("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cron.next(date("2017-01-01 00:00")); err == nil {
+		t.Error("february 30th matched")
+	}
+}
@@ -0,0 +1,736 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stellar/go/clients/horizon"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/network"
+	"github.com/stellar/go/xdr"
+)
+
+// FakeHorizon is a stellar ledger kept in memory that applies the
+// transactions submitted to it, so we can run without any stellar network
+// (STELLAR_NETWORK=fake) and have deterministic balances to look at.
+//
+// it knows about accounts, lumens, trustlines, credit balances and offers and
+// it checks sequence numbers, fees and signatures like stellar-core does.
+// it doesn't enforce reserves, ignores account options other than the home
+// domain and only crosses offers on path payments, never when they are
+// created.
+type FakeHorizon struct {
+	mu sync.Mutex
+
+	passphrase string
+	ledger     int32
+	accounts   map[string]*fakeAccount
+	offers     []*fakeOffer
+	nextOffer  int64
+	applied    map[string]int64 // transaction hash -> fee charged
+}
+
+// fakeAsset has a blank code for lumens.
+type fakeAsset struct {
+	Code   string
+	Issuer string
+}
+
+type fakeTrustline struct {
+	Balance int64
+	Limit   int64
+}
+
+type fakeAccount struct {
+	Address    string
+	Sequence   xdr.SequenceNumber
+	Native     int64
+	HomeDomain string
+	Lines      map[fakeAsset]*fakeTrustline
+}
+
+// an offer to sell `Amount` of `Selling` for N/D `Buying` each.
+type fakeOffer struct {
+	Id      int64
+	Seller  string
+	Selling fakeAsset
+	Buying  fakeAsset
+	Amount  int64
+	N, D    int32
+}
+
+// how many lumens, in stroops, the accounts given to NewFakeHorizon start with.
+const fakeStartingBalance = 1000000000 * 10000000
+
+// NewFakeHorizon starts an empty ledger with the given accounts funded.
+func NewFakeHorizon(passphrase string, funded ...string) *FakeHorizon {
+	fh := &FakeHorizon{
+		passphrase: passphrase,
+		ledger:     1,
+		accounts:   make(map[string]*fakeAccount),
+		nextOffer:  1,
+		applied:    make(map[string]int64),
+	}
+	for _, address := range funded {
+		if address != "" {
+			fh.accounts[address] = fh.newAccount(address, fakeStartingBalance)
+		}
+	}
+	return fh
+}
+
+func (fh *FakeHorizon) newAccount(address string, native int64) *fakeAccount {
+	return &fakeAccount{
+		Address:  address,
+		Sequence: xdr.SequenceNumber(fh.ledger) << 32,
+		Native:   native,
+		Lines:    make(map[fakeAsset]*fakeTrustline),
+	}
+}
+
+func (fh *FakeHorizon) String() string {
+	return "fake"
+}
+
+func (fh *FakeHorizon) LoadAccount(address string) (ha horizon.Account, err error) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	acc, ok := fh.accounts[address]
+	if !ok {
+		return ha, fakeNotFound()
+	}
+
+	ha.ID = acc.Address
+	ha.Sequence = strconv.FormatInt(int64(acc.Sequence), 10)
+
+	// only the master key, and all thresholds are 0
+	ha.Signers = []horizon.Signer{{PublicKey: acc.Address, Weight: 1}}
+
+	assets := make([]fakeAsset, 0, len(acc.Lines))
+	for asset := range acc.Lines {
+		assets = append(assets, asset)
+	}
+	sort.Slice(assets, func(i, j int) bool {
+		if assets[i].Code != assets[j].Code {
+			return assets[i].Code < assets[j].Code
+		}
+		return assets[i].Issuer < assets[j].Issuer
+	})
+	for _, asset := range assets {
+		line := acc.Lines[asset]
+		ha.Balances = append(ha.Balances, horizon.Balance{
+			Balance: fakeAmount(line.Balance),
+			Limit:   fakeAmount(line.Limit),
+			Asset:   asset.horizon(),
+		})
+	}
+
+	// horizon lists lumens last
+	ha.Balances = append(ha.Balances, horizon.Balance{
+		Balance: fakeAmount(acc.Native),
+		Asset:   horizon.Asset{Type: "native"},
+	})
+
+	return ha, nil
+}
+
+func (fh *FakeHorizon) LoadAccountOffers(address string) (page horizon.OffersPage, err error) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	// like horizon, accounts that don't exist just have no offers
+	for _, offer := range fh.offers {
+		if offer.Seller != address {
+			continue
+		}
+		page.Embedded.Records = append(page.Embedded.Records, horizon.Offer{
+			ID:      offer.Id,
+			Selling: offer.Selling.horizon(),
+			Buying:  offer.Buying.horizon(),
+			Amount:  fakeAmount(offer.Amount),
+			Price: decimal.New(int64(offer.N), 0).
+				DivRound(decimal.New(int64(offer.D), 0), 7).StringFixed(7),
+		})
+	}
+	return page, nil
+}
+
+func (fh *FakeHorizon) SequenceForAccount(address string) (xdr.SequenceNumber, error) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	acc, ok := fh.accounts[address]
+	if !ok {
+		return 0, fakeNotFound()
+	}
+	return acc.Sequence, nil
+}
+
+func (fh *FakeHorizon) TransactionApplied(hash string) (bool, int64, error) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	fee, ok := fh.applied[hash]
+	return ok, fee, nil
+}
+
+func (fh *FakeHorizon) RecentBaseFee() (int, error) {
+	return minBaseFee, nil
+}
+
+// SubmitTransaction applies all the operations of a transaction or none.
+// as on stellar, a transaction that fails after being accepted still takes
+// its fee and sequence number.
+func (fh *FakeHorizon) SubmitTransaction(blob string) (success horizon.TransactionSuccess, err error) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	var envelope xdr.TransactionEnvelope
+	err = xdr.SafeUnmarshalBase64(blob, &envelope)
+	if err != nil {
+		return success, fakeTransactionError("tx_malformed")
+	}
+	tx := envelope.Tx
+
+	txhash, err := network.HashTransaction(&tx, fh.passphrase)
+	if err != nil {
+		return success, fakeTransactionError("tx_malformed")
+	}
+
+	source, ok := fh.accounts[tx.SourceAccount.Address()]
+	if !ok {
+		return success, fakeTransactionError("tx_no_account")
+	}
+	if len(tx.Operations) == 0 {
+		return success, fakeTransactionError("tx_missing_operation")
+	}
+	if tx.SeqNum != source.Sequence+1 {
+		return success, fakeTransactionError("tx_bad_seq")
+	}
+	if tx.TimeBounds != nil && tx.TimeBounds.MaxTime != 0 &&
+		xdr.Uint64(time.Now().Unix()) > tx.TimeBounds.MaxTime {
+		return success, fakeTransactionError("tx_too_late")
+	}
+	fee := int64(minBaseFee * len(tx.Operations))
+	if int64(tx.Fee) < fee || source.Native < fee {
+		return success, fakeTransactionError("tx_insufficient_fee")
+	}
+
+	// every source account must have signed, and nobody else
+	used := make(map[int]bool)
+	for _, address := range append([]string{source.Address}, operationSources(tx)...) {
+		i, signed := fakeSignature(address, txhash, envelope.Signatures)
+		if !signed {
+			return success, fakeTransactionError("tx_bad_auth")
+		}
+		used[i] = true
+	}
+	if len(used) < len(envelope.Signatures) {
+		return success, fakeTransactionError("tx_bad_auth_extra")
+	}
+
+	source.Native -= fee
+	source.Sequence = tx.SeqNum
+
+	accounts, offers := fh.snapshot()
+	opcodes := make([]string, len(tx.Operations))
+	failed := false
+	for i, op := range tx.Operations {
+		opsource := source.Address
+		if op.SourceAccount != nil {
+			opsource = op.SourceAccount.Address()
+		}
+		opcodes[i] = fh.apply(opsource, op.Body)
+		if opcodes[i] != "op_success" {
+			failed = true
+		}
+	}
+	fh.ledger++
+	if failed {
+		fh.accounts, fh.offers = accounts, offers
+		return success, fakeTransactionError("tx_failed", opcodes...)
+	}
+
+	hash := hex.EncodeToString(txhash[:])
+	fh.applied[hash] = fee
+
+	results := []xdr.OperationResult{}
+	var buf bytes.Buffer
+	_, err = xdr.Marshal(&buf, xdr.TransactionResult{
+		FeeCharged: xdr.Int64(fee),
+		Result: xdr.TransactionResultResult{
+			Code:    xdr.TransactionResultCodeTxSuccess,
+			Results: &results,
+		},
+	})
+	if err != nil {
+		return success, err
+	}
+
+	success.Hash = hash
+	success.Ledger = fh.ledger
+	success.Env = blob
+	success.Result = base64.StdEncoding.EncodeToString(buf.Bytes())
+	return success, nil
+}
+
+// FindPaths looks for chains of offers, up to 4 long, that turn what `from`
+// holds into `asset`.
+func (fh *FakeHorizon) FindPaths(from, to string, asset Asset) (data HorizonPathResponse, err error) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	acc, ok := fh.accounts[from]
+	if !ok {
+		return data, fakeNotFound()
+	}
+	if _, ok := fh.accounts[to]; !ok {
+		return data, fakeNotFound()
+	}
+
+	target := fakeAsset{asset.Code, asset.IssuerAddress}
+	sources := []fakeAsset{{}}
+	for asset, line := range acc.Lines {
+		if line.Balance > 0 {
+			sources = append(sources, asset)
+		}
+	}
+
+	for _, src := range sources {
+		path, found := fh.findPath(src, target, 4)
+		if !found {
+			continue
+		}
+
+		record := HorizonPath{
+			SrcAssetCode:   src.Code,
+			SrcAssetIssuer: src.Issuer,
+			Intermediaries: []HorizonPathAsset{},
+			DstAssetCode:   target.Code,
+			DstAssetIssuer: target.Issuer,
+		}
+		for _, inter := range path {
+			record.Intermediaries = append(record.Intermediaries,
+				HorizonPathAsset{inter.Code, inter.Issuer})
+		}
+		data.Embedded.Records = append(data.Embedded.Records, record)
+	}
+	return data, nil
+}
+
+// findPath does a breadth-first search on the offers and returns the assets
+// between `from` and `to`.
+func (fh *FakeHorizon) findPath(from, to fakeAsset, maxHops int) ([]fakeAsset, bool) {
+	if from == to {
+		return nil, true
+	}
+
+	previous := map[fakeAsset]fakeAsset{from: from}
+	frontier := []fakeAsset{from}
+	for hop := 0; hop < maxHops && len(frontier) > 0; hop++ {
+		var next []fakeAsset
+		for _, asset := range frontier {
+			for _, offer := range fh.offers {
+				if offer.Buying != asset || offer.Amount == 0 {
+					continue
+				}
+				if _, seen := previous[offer.Selling]; seen {
+					continue
+				}
+				previous[offer.Selling] = asset
+				next = append(next, offer.Selling)
+			}
+		}
+
+		if _, found := previous[to]; found {
+			var path []fakeAsset
+			for asset := previous[to]; asset != from; asset = previous[asset] {
+				path = append([]fakeAsset{asset}, path...)
+			}
+			return path, true
+		}
+		frontier = next
+	}
+	return nil, false
+}
+
+func (fh *FakeHorizon) snapshot() (map[string]*fakeAccount, []*fakeOffer) {
+	accounts := make(map[string]*fakeAccount, len(fh.accounts))
+	for address, acc := range fh.accounts {
+		copied := *acc
+		copied.Lines = make(map[fakeAsset]*fakeTrustline, len(acc.Lines))
+		for asset, line := range acc.Lines {
+			l := *line
+			copied.Lines[asset] = &l
+		}
+		accounts[address] = &copied
+	}
+
+	offers := make([]*fakeOffer, len(fh.offers))
+	for i, offer := range fh.offers {
+		o := *offer
+		offers[i] = &o
+	}
+	return accounts, offers
+}
+
+// apply runs an operation and returns its result code.
+func (fh *FakeHorizon) apply(source string, body xdr.OperationBody) string {
+	src, ok := fh.accounts[source]
+	if !ok {
+		return "op_no_source_account"
+	}
+
+	switch body.Type {
+	case xdr.OperationTypeCreateAccount:
+		op := body.CreateAccountOp
+		address := op.Destination.Address()
+		if _, exists := fh.accounts[address]; exists {
+			return "op_already_exists"
+		}
+		if src.Native < int64(op.StartingBalance) {
+			return "op_underfunded"
+		}
+		src.Native -= int64(op.StartingBalance)
+		fh.accounts[address] = fh.newAccount(address, int64(op.StartingBalance))
+		return "op_success"
+
+	case xdr.OperationTypePayment:
+		op := body.PaymentOp
+		dst, ok := fh.accounts[op.Destination.Address()]
+		if !ok {
+			return "op_no_destination"
+		}
+		return fh.transfer(src, dst, fakeAssetOf(op.Asset), int64(op.Amount))
+
+	case xdr.OperationTypePathPayment:
+		return fh.pathPayment(src, body.PathPaymentOp)
+
+	case xdr.OperationTypeManageOffer:
+		return fh.manageOffer(src, body.ManageOfferOp)
+
+	case xdr.OperationTypeSetOptions:
+		if body.SetOptionsOp.HomeDomain != nil {
+			src.HomeDomain = string(*body.SetOptionsOp.HomeDomain)
+		}
+		return "op_success"
+
+	case xdr.OperationTypeAccountMerge:
+		dst, ok := fh.accounts[body.Destination.Address()]
+		if !ok || dst == src {
+			return "op_no_account"
+		}
+		if len(src.Lines) > 0 {
+			return "op_has_sub_entries"
+		}
+		for _, offer := range fh.offers {
+			if offer.Seller == src.Address {
+				return "op_has_sub_entries"
+			}
+		}
+		dst.Native += src.Native
+		delete(fh.accounts, src.Address)
+		return "op_success"
+
+	case xdr.OperationTypeChangeTrust:
+		op := body.ChangeTrustOp
+		asset := fakeAssetOf(op.Line)
+		limit := int64(op.Limit)
+		if asset.Code == "" || asset.Issuer == src.Address || limit < 0 {
+			return "op_malformed"
+		}
+		if _, ok := fh.accounts[asset.Issuer]; !ok {
+			return "op_no_issuer"
+		}
+
+		line, exists := src.Lines[asset]
+		switch {
+		case !exists && limit == 0:
+			return "op_invalid_limit"
+		case !exists:
+			src.Lines[asset] = &fakeTrustline{Limit: limit}
+		case limit < line.Balance:
+			return "op_invalid_limit"
+		case limit == 0:
+			delete(src.Lines, asset)
+		default:
+			line.Limit = limit
+		}
+		return "op_success"
+	}
+
+	return "op_not_supported"
+}
+
+func (fh *FakeHorizon) transfer(from, to *fakeAccount, asset fakeAsset, amount int64) string {
+	if amount <= 0 {
+		return "op_malformed"
+	}
+	if code := fakeAdjust(from, asset, -amount, true); code != "" {
+		return code
+	}
+	if code := fakeAdjust(to, asset, amount, true); code != "" {
+		return code
+	}
+	return "op_success"
+}
+
+// fakeAdjust adds `delta` to the balance of `asset` on `acc`, or only checks
+// if that would be possible when `apply` is false. issuers can send and
+// receive any amount of their own assets.
+func fakeAdjust(acc *fakeAccount, asset fakeAsset, delta int64, apply bool) string {
+	if asset.Code == "" {
+		if acc.Native+delta < 0 {
+			return "op_underfunded"
+		}
+		if apply {
+			acc.Native += delta
+		}
+		return ""
+	}
+
+	if asset.Issuer == acc.Address {
+		return ""
+	}
+
+	line, ok := acc.Lines[asset]
+	switch {
+	case !ok && delta < 0:
+		return "op_src_no_trust"
+	case !ok:
+		return "op_no_trust"
+	case line.Balance+delta < 0:
+		return "op_underfunded"
+	case line.Balance+delta > line.Limit:
+		return "op_line_full"
+	}
+	if apply {
+		line.Balance += delta
+	}
+	return ""
+}
+
+func (fh *FakeHorizon) pathPayment(src *fakeAccount, op *xdr.PathPaymentOp) string {
+	dst, ok := fh.accounts[op.Destination.Address()]
+	if !ok {
+		return "op_no_destination"
+	}
+
+	hops := []fakeAsset{fakeAssetOf(op.SendAsset)}
+	for _, asset := range op.Path {
+		hops = append(hops, fakeAssetOf(asset))
+	}
+	hops = append(hops, fakeAssetOf(op.DestAsset))
+
+	// going backwards, buy what each hop needs with the asset before it
+	need := int64(op.DestAmount)
+	for i := len(hops) - 1; i > 0; i-- {
+		if hops[i] == hops[i-1] {
+			continue
+		}
+
+		var code string
+		need, code = fh.cross(hops[i], hops[i-1], need)
+		if code != "" {
+			return code
+		}
+	}
+	if need > int64(op.SendMax) {
+		return "op_over_source_max"
+	}
+
+	if code := fakeAdjust(src, hops[0], -need, true); code != "" {
+		return code
+	}
+	if code := fakeAdjust(dst, hops[len(hops)-1], int64(op.DestAmount), true); code != "" {
+		return code
+	}
+	return "op_success"
+}
+
+// cross takes `amount` of `buying` from the best offers selling it for
+// `paying` and returns how much of `paying` that cost.
+func (fh *FakeHorizon) cross(buying, paying fakeAsset, amount int64) (cost int64, code string) {
+	var candidates []*fakeOffer
+	for _, offer := range fh.offers {
+		if offer.Selling == buying && offer.Buying == paying {
+			candidates = append(candidates, offer)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		// a/b < c/d
+		return int64(candidates[i].N)*int64(candidates[j].D) <
+			int64(candidates[j].N)*int64(candidates[i].D)
+	})
+
+	for _, offer := range candidates {
+		if amount == 0 {
+			break
+		}
+		seller := fh.accounts[offer.Seller]
+
+		take := offer.Amount
+		if take > amount {
+			take = amount
+		}
+		price := decimal.New(int64(offer.N), 0).Div(decimal.New(int64(offer.D), 0))
+		pay := decimal.New(take, 0).Mul(price).Ceil().IntPart()
+
+		if fakeAdjust(seller, buying, -take, false) != "" ||
+			fakeAdjust(seller, paying, pay, false) != "" {
+			// the seller can't honor it anymore
+			continue
+		}
+		fakeAdjust(seller, buying, -take, true)
+		fakeAdjust(seller, paying, pay, true)
+
+		offer.Amount -= take
+		amount -= take
+		cost += pay
+	}
+	fh.removeEmptyOffers()
+
+	if amount > 0 {
+		return 0, "op_too_few_offers"
+	}
+	return cost, ""
+}
+
+func (fh *FakeHorizon) manageOffer(src *fakeAccount, op *xdr.ManageOfferOp) string {
+	selling := fakeAssetOf(op.Selling)
+	buying := fakeAssetOf(op.Buying)
+	amount := int64(op.Amount)
+	if amount < 0 || op.Price.N <= 0 || op.Price.D <= 0 || selling == buying {
+		return "op_malformed"
+	}
+
+	if op.OfferId != 0 {
+		for _, offer := range fh.offers {
+			if offer.Id != int64(op.OfferId) || offer.Seller != src.Address {
+				continue
+			}
+			offer.Selling, offer.Buying = selling, buying
+			offer.Amount = amount
+			offer.N, offer.D = int32(op.Price.N), int32(op.Price.D)
+			fh.removeEmptyOffers()
+			return "op_success"
+		}
+		return "op_not_found"
+	}
+
+	if amount == 0 {
+		return "op_malformed"
+	}
+	if _, trusts := src.Lines[selling]; selling.Code != "" &&
+		selling.Issuer != src.Address && !trusts {
+		return "op_sell_no_trust"
+	}
+	if _, trusts := src.Lines[buying]; buying.Code != "" &&
+		buying.Issuer != src.Address && !trusts {
+		return "op_buy_no_trust"
+	}
+
+	fh.offers = append(fh.offers, &fakeOffer{
+		Id:      fh.nextOffer,
+		Seller:  src.Address,
+		Selling: selling,
+		Buying:  buying,
+		Amount:  amount,
+		N:       int32(op.Price.N),
+		D:       int32(op.Price.D),
+	})
+	fh.nextOffer++
+	return "op_success"
+}
+
+func (fh *FakeHorizon) removeEmptyOffers() {
+	offers := fh.offers[:0]
+	for _, offer := range fh.offers {
+		if offer.Amount > 0 {
+			offers = append(offers, offer)
+		}
+	}
+	fh.offers = offers
+}
+
+func fakeAssetOf(asset xdr.Asset) fakeAsset {
+	switch asset.Type {
+	case xdr.AssetTypeAssetTypeCreditAlphanum4:
+		return fakeAsset{
+			strings.TrimRight(string(asset.AlphaNum4.AssetCode[:]), "\x00"),
+			asset.AlphaNum4.Issuer.Address(),
+		}
+	case xdr.AssetTypeAssetTypeCreditAlphanum12:
+		return fakeAsset{
+			strings.TrimRight(string(asset.AlphaNum12.AssetCode[:]), "\x00"),
+			asset.AlphaNum12.Issuer.Address(),
+		}
+	}
+	return fakeAsset{}
+}
+
+func (asset fakeAsset) horizon() horizon.Asset {
+	switch {
+	case asset.Code == "":
+		return horizon.Asset{Type: "native"}
+	case len(asset.Code) <= 4:
+		return horizon.Asset{Type: "credit_alphanum4", Code: asset.Code, Issuer: asset.Issuer}
+	default:
+		return horizon.Asset{Type: "credit_alphanum12", Code: asset.Code, Issuer: asset.Issuer}
+	}
+}
+
+func fakeAmount(stroops int64) string {
+	return decimal.New(stroops, -7).StringFixed(7)
+}
+
+// fakeSignature finds the signature made by `address`.
+func fakeSignature(address string, hash [32]byte, signatures []xdr.DecoratedSignature) (int, bool) {
+	kp, err := keypair.Parse(address)
+	if err != nil {
+		return 0, false
+	}
+	for i, sig := range signatures {
+		if kp.Verify(hash[:], sig.Signature) == nil {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func fakeNotFound() error {
+	return &horizon.Error{
+		Response: &http.Response{StatusCode: http.StatusNotFound},
+		Problem: horizon.Problem{
+			Type:   "not_found",
+			Title:  "Resource Missing",
+			Status: http.StatusNotFound,
+		},
+	}
+}
+
+func fakeTransactionError(code string, opcodes ...string) error {
+	codes, _ := json.Marshal(map[string]interface{}{
+		"transaction": code,
+		"operations":  opcodes,
+	})
+	return &horizon.Error{
+		Response: &http.Response{StatusCode: http.StatusBadRequest},
+		Problem: horizon.Problem{
+			Type:   "transaction_failed",
+			Title:  "Transaction Failed",
+			Status: http.StatusBadRequest,
+			Extras: map[string]json.RawMessage{"result_codes": codes},
+		},
+	}
+}
@@ -3,13 +3,66 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
 
 	"github.com/stellar/go/protocols/federation"
 )
 
-func fed(w http.ResponseWriter, r *http.Request) {
+// fedRecord is the response to forward and txid queries. the ones to txid
+// queries also tell where the transaction came from.
+type fedRecord struct {
+	StellarAddress string `json:"stellar_address"`
+	AccountID      string `json:"account_id"`
+	Kind           string `json:"debtmoney_kind,omitempty"` // "thing", "payment" or "settlement"
+	Id             string `json:"debtmoney_id,omitempty"`
+}
+
+// federationDomains maps each domain served here to the prefix of the ids of
+// its users. the home domain has no prefix.
+func (app *App) federationDomains() map[string]string {
+	domains := map[string]string{strings.ToLower(app.s.HomeDomain): ""}
+	for domain, prefix := range app.s.FederationDomains {
+		domain = strings.ToLower(domain)
+		if _, ok := domains[domain]; !ok {
+			domains[domain] = prefix
+		}
+	}
+	return domains
+}
+
+// loginDomain returns the domain served here that `host` is, along with the
+// prefix of the ids of its users, or the home domain if it isn't one.
+func (app *App) loginDomain(host string) (domain, prefix string) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if prefix, ok := app.federationDomains()[host]; ok {
+		return host, prefix
+	}
+	return strings.ToLower(app.s.HomeDomain), ""
+}
+
+// federationAddress splits the federation address of a user in name and
+// domain. the domain is the one with the longest prefix matching the id, so
+// ids of the home domain can't start with the prefix of another domain, see
+// login.
+func (app *App) federationAddress(userId string) (name, domain string) {
+	name, domain = userId, app.s.HomeDomain
+	longest := 0
+	for d, prefix := range app.federationDomains() {
+		if len(prefix) > longest && strings.HasPrefix(userId, prefix) &&
+			len(prefix) < len(userId) {
+			name, domain = userId[len(prefix):], d
+			longest = len(prefix)
+		}
+	}
+	return
+}
+
+func (app *App) fed(w http.ResponseWriter, r *http.Request) {
 	qs := r.URL.Query()
 	q := qs.Get("q")
 	typ := qs.Get("type")
@@ -20,13 +73,15 @@ func fed(w http.ResponseWriter, r *http.Request) {
 		if len(splitted) != 2 {
 			http.Error(
 				w,
-				"send a proper name: user*debtmoney.xyz",
+				"send a proper name: user*"+app.s.HomeDomain,
 				http.StatusBadRequest,
 			)
 			return
 		}
 
-		if splitted[1] != "debtmoney.xyz" {
+		domain := strings.ToLower(splitted[1])
+		prefix, ok := app.federationDomains()[domain]
+		if !ok {
 			http.Error(
 				w,
 				fmt.Sprintf("'%s' is not controlled by this server", splitted[1]),
@@ -35,8 +90,11 @@ func fed(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// names of the home domain can't reach users of other domains
 		var addr string
-		pg.Get(&addr, "SELECT address FROM users WHERE id = $1", splitted[0])
+		if _, d := app.federationAddress(prefix + splitted[0]); strings.EqualFold(d, domain) {
+			app.pg.Get(&addr, "SELECT address FROM users WHERE id = $1", prefix+splitted[0])
+		}
 
 		if addr == "" {
 			http.Error(
@@ -52,7 +110,7 @@ func fed(w http.ResponseWriter, r *http.Request) {
 		})
 	case "id":
 		var userId string
-		pg.Get(&userId, "SELECT id FROM users WHERE address = $1", q)
+		app.pg.Get(&userId, "SELECT id FROM users WHERE address = $1", q)
 
 		if userId == "" {
 			http.Error(
@@ -63,13 +121,88 @@ func fed(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		name, domain := app.federationAddress(userId)
 		json.NewEncoder(w).Encode(federation.IDResponse{
-			Address: userId + "*debtmoney.xyz",
+			Address: name + "*" + domain,
 		})
 	case "forward":
-		http.Error(w, "forward type queries are not supported", http.StatusNotImplemented)
+		// debts can be declared with people who aren't here yet by their
+		// accounts elsewhere, like fulano@twitter. these resolve to whoever
+		// claimed that account when logging in, see /auth/callback.
+		forwardType := qs.Get("forward_type")
+		account := qs.Get("account")
+		if forwardType == "" || account == "" {
+			http.Error(
+				w,
+				"send a forward_type and an account, like forward_type=twitter&account=fulano",
+				http.StatusBadRequest,
+			)
+			return
+		}
+		accountName := strings.ToLower(account + "@" + forwardType)
+
+		var userId string
+		app.pg.Get(&userId, `
+SELECT coalesce(
+  (SELECT user_id FROM parties
+   WHERE account_name = $1 AND user_id IS NOT NULL AND user_id != $1
+   LIMIT 1),
+  (SELECT id FROM users WHERE id = $1)
+)
+        `, accountName)
+
+		user, _ := app.getExistingUser(userId)
+		if userId == "" || user.Address == "" {
+			http.Error(
+				w,
+				fmt.Sprintf("'%s' is not known", accountName),
+				http.StatusNotFound,
+			)
+			return
+		}
+
+		name, domain := app.federationAddress(user.Id)
+		json.NewEncoder(w).Encode(fedRecord{
+			StellarAddress: name + "*" + domain,
+			AccountID:      user.Address,
+		})
 	case "txid":
-		http.Error(w, "txid type queries are not supported", http.StatusNotImplemented)
+		// the record of who sent the transaction, and what it was here.
+		var origin struct {
+			Kind   string `db:"kind"`
+			Id     string `db:"id"`
+			Sender string `db:"sender"`
+		}
+		app.pg.Get(&origin, `
+SELECT 'thing' AS kind, id, created_by AS sender FROM things WHERE txn = $1
+UNION ALL
+SELECT 'thing', things.id, things.created_by FROM thing_transactions
+INNER JOIN things ON things.id = thing_transactions.thing_id
+WHERE thing_transactions.hash = $1
+UNION ALL
+SELECT 'payment', id, from_user FROM payments WHERE txn = $1
+UNION ALL
+SELECT 'settlement', id, payee FROM settlements WHERE txn = $1
+LIMIT 1
+        `, strings.ToLower(q))
+
+		user, _ := app.getExistingUser(origin.Sender)
+		if origin.Id == "" || user.Address == "" {
+			http.Error(
+				w,
+				fmt.Sprintf("'%s' is not known", q),
+				http.StatusNotFound,
+			)
+			return
+		}
+
+		name, domain := app.federationAddress(user.Id)
+		json.NewEncoder(w).Encode(fedRecord{
+			StellarAddress: name + "*" + domain,
+			AccountID:      user.Address,
+			Kind:           origin.Kind,
+			Id:             origin.Id,
+		})
 	default:
 		http.Error(w, fmt.Sprintf("invalid type: '%s'", typ), http.StatusBadRequest)
 	}
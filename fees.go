@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/shopspring/decimal"
+)
+
+// stellar charges at least this many stroops for each operation, but when
+// ledgers are full only the transactions offering more get in. we offer what
+// most transactions in the recent ledgers were charged, up to MAX_BASE_FEE,
+// and offer more if horizon still says it is not enough (see sequence.go).
+
+const minBaseFee = 100
+
+// baseFee returns the fee per operation to offer, in stroops.
+func (app *App) baseFee() int {
+	fee, err := app.h.RecentBaseFee()
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to load fee stats, using the minimum fee")
+		fee = minBaseFee
+	}
+	return app.limitBaseFee(fee)
+}
+
+func (app *App) limitBaseFee(fee int) int {
+	if fee < minBaseFee {
+		fee = minBaseFee
+	}
+	if app.s.MaxBaseFee > 0 && fee > app.s.MaxBaseFee {
+		fee = app.s.MaxBaseFee
+	}
+	return fee
+}
+
+func stroopsToXLM(stroops int64) string {
+	return decimal.New(stroops, -7).String()
+}
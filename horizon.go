@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/stellar/go/clients/horizon"
+	"github.com/stellar/go/xdr"
+)
+
+// Horizon is everything we ask of a horizon server. horizonClient talks to a
+// real one and FakeHorizon (see fakehorizon.go) keeps a ledger in memory.
+type Horizon interface {
+	LoadAccount(address string) (horizon.Account, error)
+	LoadAccountOffers(address string) (horizon.OffersPage, error)
+	SequenceForAccount(address string) (xdr.SequenceNumber, error)
+	SubmitTransaction(blob string) (horizon.TransactionSuccess, error)
+
+	// FindPaths lists the ways `from` can pay `to` in its `asset`.
+	FindPaths(from, to string, asset Asset) (HorizonPathResponse, error)
+
+	// TransactionApplied tells if a transaction with this hash is on the
+	// ledger and how much it was charged, in stroops.
+	TransactionApplied(hash string) (applied bool, fee int64, err error)
+
+	// RecentBaseFee is the fee per operation most transactions on the last
+	// ledgers were charged, in stroops.
+	RecentBaseFee() (int, error)
+
+	String() string
+}
+
+type HorizonPathResponse struct {
+	Embedded struct {
+		Records []HorizonPath `json:"records"`
+	} `json:"_embedded"`
+}
+
+type HorizonPath struct {
+	SrcAssetCode   string             `json:"source_asset_code"`
+	SrcAssetIssuer string             `json:"source_asset_issuer"`
+	Intermediaries []HorizonPathAsset `json:"path"`
+	DstAssetCode   string             `json:"destination_asset_code"`
+	DstAssetIssuer string             `json:"destination_asset_issuer"`
+}
+
+type HorizonPathAsset struct {
+	Code   string `json:"asset_code"`
+	Issuer string `json:"asset_issuer"`
+}
+
+type horizonClient struct {
+	*horizon.Client
+}
+
+func (c horizonClient) String() string {
+	return c.URL
+}
+
+func (c horizonClient) LoadAccount(address string) (horizon.Account, error) {
+	return c.Client.LoadAccount(address)
+}
+
+func (c horizonClient) LoadAccountOffers(address string) (horizon.OffersPage, error) {
+	return c.Client.LoadAccountOffers(address)
+}
+
+func (c horizonClient) SequenceForAccount(address string) (xdr.SequenceNumber, error) {
+	return c.Client.SequenceForAccount(address)
+}
+
+func (c horizonClient) SubmitTransaction(blob string) (horizon.TransactionSuccess, error) {
+	return c.Client.SubmitTransaction(blob)
+}
+
+func (c horizonClient) FindPaths(
+	from_address string,
+	to_address string,
+	to_asset Asset,
+) (data HorizonPathResponse, err error) {
+	qs := url.Values{}
+
+	qs.Set("source_account", from_address)
+	qs.Set("destination_account", to_address)
+	qs.Set("destination_asset_type", "credit_alphanum4")
+	qs.Set("destination_asset_code", to_asset.Code)
+	qs.Set("destination_asset_issuer", to_asset.IssuerAddress)
+	qs.Set("destination_amount", "1")
+
+	var resp *http.Response
+	resp, err = http.Get(c.URL + "/paths?" + qs.Encode())
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		err = errors.New("Horizon returned status " + strconv.Itoa(resp.StatusCode))
+		return
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	return
+}
+
+func (c horizonClient) TransactionApplied(hash string) (applied bool, fee int64, err error) {
+	resp, err := http.Get(c.URL + "/transactions/" + hash)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, 0, nil
+	}
+	if resp.StatusCode >= 300 {
+		err = errors.New("Horizon returned status " + strconv.Itoa(resp.StatusCode))
+		return
+	}
+
+	// newer horizons also keep failed transactions and have renamed
+	// fee_paid to fee_charged, which is now a string.
+	var data struct {
+		Successful *bool       `json:"successful"`
+		FeePaid    interface{} `json:"fee_paid"`
+		FeeCharged interface{} `json:"fee_charged"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	if err != nil {
+		return
+	}
+
+	for _, v := range []interface{}{data.FeeCharged, data.FeePaid} {
+		if v == nil {
+			continue
+		}
+		fee, _ = strconv.ParseInt(fmt.Sprint(v), 10, 64)
+		break
+	}
+	return data.Successful == nil || *data.Successful, fee, nil
+}
+
+// RecentBaseFee takes the 70th percentile of the fees charged on the last
+// ledgers from /fee_stats.
+func (c horizonClient) RecentBaseFee() (int, error) {
+	resp, err := http.Get(c.URL + "/fee_stats")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return 0, errors.New("Horizon returned status " + strconv.Itoa(resp.StatusCode))
+	}
+
+	// older horizons only have the flat fields, some of them as numbers
+	var data struct {
+		FeeCharged struct {
+			P70 interface{} `json:"p70"`
+		} `json:"fee_charged"`
+		P70AcceptedFee    interface{} `json:"p70_accepted_fee"`
+		LastLedgerBaseFee interface{} `json:"last_ledger_base_fee"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, v := range []interface{}{
+		data.FeeCharged.P70,
+		data.P70AcceptedFee,
+		data.LastLedgerBaseFee,
+	} {
+		if v == nil {
+			continue
+		}
+		if fee, err := strconv.Atoi(fmt.Sprint(v)); err == nil {
+			return fee, nil
+		}
+	}
+	return 0, errors.New("no fees on /fee_stats")
+}
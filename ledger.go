@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/shopspring/decimal"
+)
+
+// the ledger export writes everything that touched the logged user as a
+// plain-text accounting journal, either in the hledger (also ledger) or in
+// the beancount format. each published thing is a transaction where what
+// the user paid leaves their cash, their share is an expense and the IOUs
+// issued go to receivable or payable accounts for each counterparty:
+//
+//   2017-03-01 Dinner  ; thing:cj0..., txn:4f6e...
+//       expenses:debtmoney          30 USD
+//       assets:cash                -90 USD
+//       assets:receivable:bob       30 USD
+//       assets:receivable:carol     30 USD
+//
+// settlements pay these accounts back from cash. path payments move them
+// too: paying someone with their IOUs lowers what they owe us and paying
+// with ours raises what we owe them, the other side being an expense for the
+// payer and income for the recipient. settlement plans move them between
+// counterparties.
+
+type LedgerTransaction struct {
+	Date        time.Time
+	Description string
+	Meta        [][2]string
+	Postings    []LedgerPosting
+}
+
+type LedgerPosting struct {
+	Account []string
+	Amount  decimal.Decimal
+	Asset   string
+}
+
+func (app *App) exportLedger(w http.ResponseWriter, r *http.Request) {
+	session, err := app.sessionStore.Get(r, "auth-session")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	userId, ok := session.Values["userId"].(string)
+	if !ok {
+		http.Error(w, "no-logged-user", 401)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "hledger"
+	}
+	var render func([]LedgerTransaction) []byte
+	var extension string
+	switch format {
+	case "hledger", "ledger":
+		render, extension = renderHledger, "journal"
+	case "beancount":
+		render, extension = renderBeancount, "beancount"
+	default:
+		http.Error(w, "invalid-format", 400)
+		return
+	}
+
+	transactions, err := app.ledgerTransactions(userId)
+	if err != nil {
+		log.Warn().Err(err).Str("user", userId).Msg("failed to export ledger")
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition",
+		`attachment; filename="debtmoney.`+extension+`"`)
+	w.Write(render(transactions))
+}
+
+// ledgerTransactions lists, oldest first, the published things, the burnt
+// settlements, the path payments and the published settlement plans of
+// `userId` as balanced transactions.
+func (app *App) ledgerTransactions(userId string) (transactions []LedgerTransaction, err error) {
+	var things []Thing
+	err = app.pg.Select(&things, `
+SELECT `+(Thing{}).columns()+` FROM things
+WHERE coalesce(txn, '') != ''
+  AND EXISTS (SELECT 1 FROM parties WHERE thing_id = things.id AND user_id = $1)
+    `, userId)
+	if err != nil {
+		return
+	}
+	for _, thing := range things {
+		err = thing.fillParties(app)
+		if err != nil {
+			return
+		}
+		var debts []Transfer
+		debts, err = thing.debts(app)
+		if err != nil {
+			return
+		}
+
+		// debts() leaves the share of each party on workingDue
+		paid := decimal.Decimal{}
+		due := decimal.Decimal{}
+		for _, party := range thing.Parties {
+			if party.UserId == userId {
+				paid = paid.Add(party.Paid)
+				due = due.Add(party.workingDue)
+			}
+		}
+
+		description := thing.Name
+		if description == "" {
+			description = "thing " + thing.Id
+		}
+
+		date, _ := time.Parse(time.RFC3339, thing.ActualDate)
+		t := LedgerTransaction{
+			Date:        date,
+			Description: description,
+			Meta:        [][2]string{{"thing", thing.Id}, {"txn", thing.Transaction}},
+		}
+		t.add([]string{"expenses", "debtmoney"}, due, thing.Asset)
+		t.add([]string{"assets", "cash"}, paid.Neg(), thing.Asset)
+		for _, debt := range debts {
+			if debt.To == userId {
+				t.add([]string{"assets", "receivable", debt.From}, debt.Amount, debt.Asset)
+			} else if debt.From == userId {
+				t.add([]string{"liabilities", "payable", debt.To}, debt.Amount.Neg(), debt.Asset)
+			}
+		}
+		if len(t.Postings) > 0 {
+			transactions = append(transactions, t)
+		}
+	}
+
+	var settlements []Settlement
+	err = app.pg.Select(&settlements, `
+SELECT `+(Settlement{}).columns()+` FROM settlements
+WHERE coalesce(txn, '') != '' AND (payer = $1 OR payee = $1)
+    `, userId)
+	if err != nil {
+		return
+	}
+	for _, settlement := range settlements {
+		description := "settlement (" + settlement.Method + ")"
+		if settlement.Reference != "" {
+			description += " " + settlement.Reference
+		}
+
+		date, _ := time.Parse(time.RFC3339, settlement.ActualDate)
+		t := LedgerTransaction{
+			Date:        date,
+			Description: description,
+			Meta: [][2]string{
+				{"settlement", settlement.Id},
+				{"txn", settlement.Transaction},
+			},
+		}
+		if settlement.Payer == userId {
+			t.add([]string{"liabilities", "payable", settlement.Payee},
+				settlement.Amount, settlement.Asset)
+			t.add([]string{"assets", "cash"}, settlement.Amount.Neg(), settlement.Asset)
+		} else {
+			t.add([]string{"assets", "cash"}, settlement.Amount, settlement.Asset)
+			t.add([]string{"assets", "receivable", settlement.Payer},
+				settlement.Amount.Neg(), settlement.Asset)
+		}
+		transactions = append(transactions, t)
+	}
+
+	var payments []Payment
+	err = app.pg.Select(&payments, `
+SELECT `+(Payment{}).columns()+` FROM payments
+WHERE (from_user = $1 OR to_user = $1)
+  AND dst_issuer IN (SELECT address FROM users WHERE id IN (from_user, to_user))
+    `, userId)
+	if err != nil {
+		return
+	}
+	user, err := app.getExistingUser(userId)
+	if err != nil {
+		return
+	}
+	for _, payment := range payments {
+		date, _ := time.Parse(time.RFC3339, payment.CreatedAt)
+		t := LedgerTransaction{
+			Date:        date,
+			Description: "payment",
+			Meta:        [][2]string{{"payment", payment.Id}, {"txn", payment.Hash}},
+		}
+
+		// the IOUs are either ours or the other's
+		other, amount := payment.To, payment.Amount
+		if payment.From != userId {
+			other, amount = payment.From, amount.Neg()
+		}
+		account := []string{"assets", "receivable", other}
+		if payment.DstIssuer == user.Address {
+			account = []string{"liabilities", "payable", other}
+		}
+
+		t.add(account, amount.Neg(), payment.DstAsset)
+		if payment.From == userId {
+			t.add([]string{"expenses", "debtmoney"}, amount, payment.DstAsset)
+		} else {
+			t.add([]string{"income", "debtmoney"}, amount, payment.DstAsset)
+		}
+		transactions = append(transactions, t)
+	}
+
+	netted, err := app.nettedTransfers(userId)
+	if err != nil {
+		return
+	}
+	var nettings []LedgerTransaction
+	plans := make(map[string]int)
+	for _, transfer := range netted {
+		i, ok := plans[transfer.PlanId]
+		if !ok {
+			date, _ := time.Parse(time.RFC3339, transfer.CreatedAt)
+			plans[transfer.PlanId] = len(nettings)
+			nettings = append(nettings, LedgerTransaction{
+				Date:        date,
+				Description: "settlement plan",
+				Meta: [][2]string{
+					{"plan", transfer.PlanId},
+					{"txn", transfer.Transaction},
+				},
+			})
+			i = len(nettings) - 1
+		}
+
+		t := &nettings[i]
+		if transfer.To == userId {
+			t.add([]string{"assets", "receivable", transfer.From},
+				transfer.owed(), transfer.Asset)
+		} else {
+			t.add([]string{"liabilities", "payable", transfer.To},
+				transfer.owed().Neg(), transfer.Asset)
+		}
+	}
+	for _, t := range nettings {
+		// plans that left our counterparties as they were
+		for _, p := range t.Postings {
+			if !p.Amount.Equals(decimal.Decimal{}) {
+				transactions = append(transactions, t)
+				break
+			}
+		}
+	}
+
+	sort.SliceStable(transactions, func(i, j int) bool {
+		return transactions[i].Date.Before(transactions[j].Date)
+	})
+	return
+}
+
+// add appends a posting, merging it with one on the same account.
+func (t *LedgerTransaction) add(account []string, amount decimal.Decimal, asset string) {
+	if amount.Equals(decimal.Decimal{}) {
+		return
+	}
+	name := strings.Join(account, ":")
+	for i, p := range t.Postings {
+		if strings.Join(p.Account, ":") == name && p.Asset == asset {
+			t.Postings[i].Amount = p.Amount.Add(amount)
+			return
+		}
+	}
+	t.Postings = append(t.Postings, LedgerPosting{account, amount, asset})
+}
+
+func renderHledger(transactions []LedgerTransaction) []byte {
+	var buf bytes.Buffer
+	for _, t := range transactions {
+		tags := make([]string, len(t.Meta))
+		for i, kv := range t.Meta {
+			tags[i] = kv[0] + ":" + kv[1]
+		}
+		fmt.Fprintf(&buf, "%s %s  ; %s\n",
+			t.Date.Format("2006-01-02"),
+			strings.Replace(t.Description, "\n", " ", -1),
+			strings.Join(tags, ", "))
+
+		for _, p := range t.Postings {
+			fmt.Fprintf(&buf, "    %-40s  %s %s\n",
+				strings.Join(p.Account, ":"), p.Amount.String(), p.Asset)
+		}
+		buf.WriteString("\n")
+	}
+	return buf.Bytes()
+}
+
+// beancount wants accounts declared before they are used, capitalized
+// account components and uppercase currencies.
+func renderBeancount(transactions []LedgerTransaction) []byte {
+	var buf bytes.Buffer
+
+	opened := make(map[string]bool)
+	var accounts []string
+	for _, t := range transactions {
+		for _, p := range t.Postings {
+			name := beancountAccount(p.Account)
+			if !opened[name] {
+				opened[name] = true
+				accounts = append(accounts, name)
+			}
+		}
+	}
+	if len(accounts) > 0 {
+		sort.Strings(accounts)
+		first := transactions[0].Date.Format("2006-01-02")
+		for _, name := range accounts {
+			fmt.Fprintf(&buf, "%s open %s\n", first, name)
+		}
+		buf.WriteString("\n")
+	}
+
+	for _, t := range transactions {
+		fmt.Fprintf(&buf, "%s * %q\n",
+			t.Date.Format("2006-01-02"),
+			strings.Replace(t.Description, "\n", " ", -1))
+		for _, kv := range t.Meta {
+			fmt.Fprintf(&buf, "  %s: %q\n", kv[0], kv[1])
+		}
+		for _, p := range t.Postings {
+			fmt.Fprintf(&buf, "  %-40s  %s %s\n",
+				beancountAccount(p.Account), p.Amount.String(), strings.ToUpper(p.Asset))
+		}
+		buf.WriteString("\n")
+	}
+	return buf.Bytes()
+}
+
+func beancountAccount(account []string) string {
+	components := make([]string, len(account))
+	for i, component := range account {
+		clean := []rune(strings.Map(func(r rune) rune {
+			if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+				return r
+			}
+			return '-'
+		}, component))
+		if len(clean) == 0 || !unicode.IsLetter(clean[0]) && !unicode.IsDigit(clean[0]) {
+			clean = append([]rune{'X'}, clean...)
+		}
+		clean[0] = unicode.ToUpper(clean[0])
+		components[i] = string(clean)
+	}
+	return strings.Join(components, ":")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestLedgerMatchesIOUs(t *testing.T) {
+	app := newTestApp(t)
+
+	// bob owes alice 10, then alice owes bob 6.
+	publishTestThing(t, app, createTestThing(t, app, "dinner", "alice", "20",
+		map[string]interface{}{"account": "alice", "paid": "20"},
+		map[string]interface{}{"account": "bob", "paid": "0"},
+	))
+	publishTestThing(t, app, createTestThing(t, app, "lunch", "bob", "12",
+		map[string]interface{}{"account": "alice", "paid": "0"},
+		map[string]interface{}{"account": "bob", "paid": "12"},
+	))
+
+	// alice pays with bob's IOUs, bob with his own.
+	for _, payment := range []struct{ from, to, issuer, amount string }{
+		{"alice", "bob", "bob", "6"},
+		{"bob", "alice", "bob", "1"},
+	} {
+		r := sendTestPayment(t, app, payment.from, payment.to, payment.issuer, payment.amount)
+		if len(r.Errors) > 0 {
+			t.Fatal(r.Errors)
+		}
+	}
+
+	for _, test := range []struct {
+		user, other string
+	}{
+		{"alice", "bob"},
+		{"bob", "alice"},
+	} {
+		transactions, err := app.ledgerTransactions(test.user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(transactions) != 4 {
+			t.Fatalf("%s's journal has %d transactions, want 4", test.user, len(transactions))
+		}
+
+		totals := make(map[string]decimal.Decimal)
+		for _, tx := range transactions {
+			sum := decimal.Decimal{}
+			for _, p := range tx.Postings {
+				totals[strings.Join(p.Account, ":")] =
+					totals[strings.Join(p.Account, ":")].Add(p.Amount)
+				sum = sum.Add(p.Amount)
+			}
+			if !sum.Equals(decimal.Decimal{}) {
+				t.Errorf("%s: %q doesn't balance: %s", test.user, tx.Description, sum)
+			}
+		}
+
+		// what we hold of theirs, and minus what they hold of ours
+		held, _ := decimal.NewFromString(balanceOf(t, app, test.user, test.other, "USD"))
+		owed, _ := decimal.NewFromString(balanceOf(t, app, test.other, test.user, "USD"))
+
+		receivable := totals["assets:receivable:"+test.other]
+		if !receivable.Equals(held) {
+			t.Errorf("%s's receivable from %s is %s, holds %s on stellar",
+				test.user, test.other, receivable, held)
+		}
+		payable := totals["liabilities:payable:"+test.other]
+		if !payable.Equals(owed.Neg()) {
+			t.Errorf("%s's payable to %s is %s, %s holds %s on stellar",
+				test.user, test.other, payable, test.other, owed)
+		}
+		if net := netWith(t, app, test.user, test.other); !receivable.Add(payable).Equals(net) {
+			t.Errorf("%s's net with %s is %s on the journal, %s on stellar",
+				test.user, test.other, receivable.Add(payable), net)
+		}
+	}
+}
@@ -2,10 +2,9 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"net/http"
 	"os"
-	"strconv"
 	"strings"
 	"time"
 
@@ -13,7 +12,6 @@ import (
 	"github.com/graphql-go/handler"
 	_ "github.com/lib/pq"
 
-	"github.com/fiatjaf/accountd"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 	"github.com/jmoiron/sqlx"
@@ -21,7 +19,6 @@ import (
 	"github.com/rs/cors"
 	"github.com/rs/zerolog"
 	"github.com/stellar/go/build"
-	"github.com/stellar/go/clients/horizon"
 	"gopkg.in/tylerb/graceful.v1"
 )
 
@@ -31,49 +28,220 @@ type Settings struct {
 	PostgresURL   string `envconfig:"DATABASE_URL"`
 	SecretKey     string `envconfig:"SECRET_KEY"`
 	ServiceURL    string `envconfig:"SERVICE_URL"`
+
+	// which stellar network to use: "test", "public", "standalone" or "fake"
+	// (an in-memory ledger, see fakehorizon.go).
+	// HorizonURL and NetworkPassphrase, if set, override the defaults
+	// for the chosen network.
+	StellarNetwork    string `envconfig:"STELLAR_NETWORK" default:"test"`
+	HorizonURL        string `envconfig:"HORIZON_URL"`
+	NetworkPassphrase string `envconfig:"NETWORK_PASSPHRASE"`
+
+	// federation addresses are like user*HomeDomain, see federation.go.
+	// other domains can be served too, each with its own namespace of users,
+	// as "domain:prefix,...": with "debts.ourco.example:ourco-" the address
+	// alice*debts.ourco.example is the user "ourco-alice".
+	HomeDomain        string            `envconfig:"HOME_DOMAIN" default:"debtmoney.xyz"`
+	FederationDomains map[string]string `envconfig:"FEDERATION_DOMAINS"`
+
+	// login providers, see auth.go: "accountd", "oauth2", "email", "sep10"
+	// and "mock" (which lets anyone log in as anyone, only for development).
+	AuthProviders []string `envconfig:"AUTH_PROVIDERS" default:"accountd"`
+	AccountdHost  string   `envconfig:"ACCOUNTD_HOST" default:"https://cantillon.alhur.es:6336"`
+
+	// any OAuth2 or OpenID Connect provider. users are identified by the
+	// OAuth2IdClaim of their userinfo followed by OAuth2Suffix, so with
+	// "login" and "@github" they become fulano@github.
+	OAuth2AuthURL      string `envconfig:"OAUTH2_AUTH_URL"`
+	OAuth2TokenURL     string `envconfig:"OAUTH2_TOKEN_URL"`
+	OAuth2UserInfoURL  string `envconfig:"OAUTH2_USERINFO_URL"`
+	OAuth2ClientID     string `envconfig:"OAUTH2_CLIENT_ID"`
+	OAuth2ClientSecret string `envconfig:"OAUTH2_CLIENT_SECRET"`
+	OAuth2Scopes       string `envconfig:"OAUTH2_SCOPES" default:"openid email profile"`
+	OAuth2IdClaim      string `envconfig:"OAUTH2_ID_CLAIM" default:"email"`
+	OAuth2Suffix       string `envconfig:"OAUTH2_SUFFIX"`
+
+	// email login links are sent through this server. if it isn't set they
+	// are only logged.
+	SMTPAddr     string `envconfig:"SMTP_ADDR"`
+	SMTPUser     string `envconfig:"SMTP_USER"`
+	SMTPPassword string `envconfig:"SMTP_PASSWORD"`
+	EmailFrom    string `envconfig:"EMAIL_FROM" default:"debtmoney <login@debtmoney.xyz>"`
+
+	// about who runs this server, published on stellar.toml, see toml.go.
+	OrgName          string `envconfig:"ORG_NAME" default:"debtmoney"`
+	OrgURL           string `envconfig:"ORG_URL"`
+	OrgDescription   string `envconfig:"ORG_DESCRIPTION"`
+	OrgLogo          string `envconfig:"ORG_LOGO"`
+	OrgOfficialEmail string `envconfig:"ORG_OFFICIAL_EMAIL"`
+
+	// the most we'll pay for each operation, in stroops, see fees.go.
+	MaxBaseFee int `envconfig:"MAX_BASE_FEE" default:"10000"`
+
+	// file with the master keys used to encrypt user seeds, see seeds.go.
+	SeedKeysFile string `envconfig:"SEED_KEYS_FILE"`
+
+	// database migrations, see migrate.go.
+	MigrationsDir string `envconfig:"MIGRATIONS_DIR" default:"./migrations"`
+	AutoMigrate   bool   `envconfig:"AUTO_MIGRATE" default:"true"`
 }
 
-var err error
-var s Settings
-var h *horizon.Client
-var n build.Network
-var pg *sqlx.DB
-var router *mux.Router
-var schema graphql.Schema
-var sessionStore *sessions.CookieStore
 var log = zerolog.New(os.Stderr).Output(zerolog.ConsoleWriter{Out: os.Stderr})
 
-func main() {
-	err = envconfig.Process("", &s)
-	if err != nil {
-		log.Fatal().Err(err).Msg("couldn't process envconfig.")
-	}
+// App is a debtmoney instance: its settings and everything it talks to.
+// functions that touch the database or the stellar network hang from it, so
+// many instances can live in the same process.
+type App struct {
+	s            Settings
+	h            Horizon
+	n            build.Network
+	pg           *sqlx.DB
+	km           KeyManager
+	router       *mux.Router
+	schema       graphql.Schema
+	sessionStore *sessions.CookieStore
 
-	accountd.HOST = "https://cantillon.alhur.es:6336"
-	zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	authenticators map[string]Authenticator
+
+	sequences  SequenceManager
+	precisions Precisions
+}
+
+// NewApp connects to the database and to the stellar network given in the
+// settings and sets up the graphql schema and the http routes. it doesn't
+// apply migrations nor start the scheduler and the publisher, see main.
+func NewApp(s Settings) (app *App, err error) {
+	app = &App{s: s}
 
 	// cookie store
-	sessionStore = sessions.NewCookieStore([]byte(s.SecretKey))
+	app.sessionStore = sessions.NewCookieStore([]byte(s.SecretKey))
 
 	// stellar clients
-	h = horizon.DefaultTestNetClient
-	n = build.TestNetwork
+	app.h, app.n, err = stellarNetwork(
+		s.StellarNetwork, s.HorizonURL, s.NetworkPassphrase, s.SourceAddress)
+	if err != nil {
+		log.Error().Err(err).Str("network", s.StellarNetwork).
+			Msg("failed to setup stellar network")
+		return nil, err
+	}
+	log.Info().
+		Str("network", s.StellarNetwork).
+		Str("horizon", app.h.String()).
+		Str("passphrase", app.n.Passphrase).
+		Msg("using stellar network.")
+
+	// login providers
+	app.authenticators, err = newAuthenticators(s, app.sessionStore, app.h, app.n)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to setup login providers")
+		return nil, err
+	}
 
 	// postgres client
-	pg, err = sqlx.Open("postgres", s.PostgresURL)
+	app.pg, err = sqlx.Open("postgres", s.PostgresURL)
 	if err != nil {
-		log.Fatal().Err(err).Str("uri", s.PostgresURL).Msg("failed to connect to pg")
+		log.Error().Err(err).Str("uri", s.PostgresURL).Msg("failed to connect to pg")
+		return nil, err
+	}
+
+	// seeds encryption
+	if s.SeedKeysFile != "" {
+		app.km, err = loadFileKeyManager(s.SeedKeysFile)
+		if err != nil {
+			log.Error().Err(err).Str("file", s.SeedKeysFile).
+				Msg("failed to load seed keys")
+			return nil, err
+		}
+	} else if s.StellarNetwork == "public" {
+		// these seeds hold real money
+		err = errors.New("SEED_KEYS_FILE must be set on the public network")
+		log.Error().Err(err).Msg("refusing to store user seeds in plaintext")
+		return nil, err
+	} else {
+		log.Warn().Msg("SEED_KEYS_FILE not set, user seeds will be stored in plaintext.")
 	}
 
 	// graphql schema
-	schema, err = graphql.NewSchema(schemaConfig)
+	app.schema, err = graphql.NewSchema(schemaConfig)
 	if err != nil {
-		log.Fatal().Err(err).Msg("failed to create graphql schema")
+		log.Error().Err(err).Msg("failed to create graphql schema")
+		return nil, err
 	}
-	handler := handler.New(&handler.Config{Schema: &schema})
 
-	// define routes
-	router = mux.NewRouter()
+	app.router = app.routes()
+	return app, nil
+}
+
+func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	app.router.ServeHTTP(w, r)
+}
+
+func main() {
+	var s Settings
+	err := envconfig.Process("", &s)
+	if err != nil {
+		log.Fatal().Err(err).Msg("couldn't process envconfig.")
+	}
+
+	zerolog.SetGlobalLevel(zerolog.DebugLevel)
+
+	app, err := NewApp(s)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to start")
+	}
+
+	// subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rekey-seeds":
+			err = app.rekeySeeds()
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to rekey seeds")
+			}
+		case "migrate":
+			err = app.migrateCommand(s.MigrationsDir, os.Args[2:])
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to migrate")
+			}
+		case "import-splitwise":
+			err = app.importSplitwiseCommand(os.Args[2:])
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to import splitwise export")
+			}
+		default:
+			log.Fatal().Str("command", os.Args[1]).Msg("unknown command")
+		}
+		return
+	}
+
+	// database schema
+	if s.AutoMigrate {
+		err = app.migrateUp(s.MigrationsDir)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to apply migrations")
+		}
+	}
+
+	c := cors.New(cors.Options{
+		AllowCredentials: true,
+		AllowOriginFunc:  func(origin string) bool { return true },
+	})
+
+	// list on stellar.toml the IOUs of things planned by older versions
+	go app.recordPastIssuedAssets()
+
+	// create things from recurring templates
+	go app.runScheduler()
+	go app.runPublisher()
+
+	// start the server
+	log.Info().Str("port", os.Getenv("PORT")).Msg("listening.")
+	graceful.Run(":"+os.Getenv("PORT"), 10*time.Second, c.Handler(app))
+}
+
+func (app *App) routes() *mux.Router {
+	handler := handler.New(&handler.Config{Schema: &app.schema})
+	router := mux.NewRouter()
 
 	router.PathPrefix("/app/").Methods("GET").HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
@@ -85,28 +253,24 @@ func main() {
 		},
 	)
 
-	router.Path("/.well-known/stellar.toml").Methods("GET").HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Content-Type", "application/toml")
-			fmt.Fprint(w, `
-FEDERATION_SERVER="`+s.ServiceURL+`/federation"
-            `)
-		},
-	)
-	router.Path("/federation").Methods("GET").HandlerFunc(fed)
-	router.Path("/federation/").Methods("GET").HandlerFunc(fed)
+	router.Path("/.well-known/stellar.toml").Methods("GET").HandlerFunc(app.stellarToml)
+	router.Path("/sep7/callback").Methods("POST").HandlerFunc(app.sep7Callback)
+	router.Path("/federation").Methods("GET").HandlerFunc(app.fed)
+	router.Path("/federation/").Methods("GET").HandlerFunc(app.fed)
+	router.Path("/export/ledger").Methods("GET").HandlerFunc(app.exportLedger)
 
 	router.Path("/_graphql").Methods("POST").HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
 			ctx := context.TODO()
 
-			session, err := sessionStore.Get(r, "auth-session")
+			session, err := app.sessionStore.Get(r, "auth-session")
 			if err != nil {
 				http.Error(w, err.Error(), 500)
 				return
 			}
 
+			// resolvers take the app from here
+			ctx = context.WithValue(ctx, "app", app)
 			if userId, ok := session.Values["userId"]; ok {
 				ctx = context.WithValue(ctx, "userId", userId)
 			}
@@ -116,56 +280,10 @@ FEDERATION_SERVER="`+s.ServiceURL+`/federation"
 		},
 	)
 
-	router.Path("/auth/callback").Methods("GET").HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			code := r.URL.Query().Get("code")
-
-			accountduser, err := accountd.VerifyAuth(code)
-
-			if err != nil {
-				log.Error().Err(err).Msg("invalid authorization")
-				http.Error(w, "invalid authorization", 401)
-				return
-			} else {
-				session, err := sessionStore.Get(r, "auth-session")
-				if err != nil {
-					http.Error(w, err.Error(), 500)
-					return
-				}
-
-				ensureUser(accountduser.Id)
-
-				// we now check if this user owns one of the accounts
-				// we have registered here (like if some debtmoney user
-				// has declared a debt with fulano@twitter we want to
-				// know if this new logged user owns fulano@twitter and
-				// redirect these debts to him).
-				params := make([]interface{}, len(accountduser.Accounts)+1)
-				params[0] = accountduser.Id
-				accvars := make([]string, len(accountduser.Accounts)+1)
-				accvars[0] = "$1"
-				for i, account := range accountduser.Accounts {
-					accvars[i+1] = "$" + strconv.Itoa(i+2)
-					params[i+1] = account.Account
-				}
-				vars := strings.Join(accvars, ",")
-
-				_, err = pg.Exec(`
-UPDATE parties SET user_id = $1
-WHERE account_name IN (`+vars+`)
-                `, params...)
-				if err != nil {
-					log.Error().Err(err).Str("user", accountduser.Id).
-						Msg("failed to update parties records to user")
-				}
-
-				// finally we set up the session
-				session.Values["userId"] = accountduser.Id
-				session.Save(r, w)
-				http.Redirect(w, r, "/app/", 302)
-			}
-		},
-	)
+	router.Path("/auth/callback").Methods("GET").HandlerFunc(app.finishLogin)
+	router.Path("/auth/{provider:sep10}").Methods("POST").HandlerFunc(app.finishLogin)
+	router.Path("/auth/{provider}").Methods("GET", "POST").HandlerFunc(app.startLogin)
+	router.Path("/auth/{provider}/callback").Methods("GET", "POST").HandlerFunc(app.finishLogin)
 
 	router.Path("/").Methods("GET").HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
@@ -173,12 +291,5 @@ WHERE account_name IN (`+vars+`)
 		},
 	)
 
-	c := cors.New(cors.Options{
-		AllowCredentials: true,
-		AllowOriginFunc:  func(origin string) bool { return true },
-	})
-
-	// start the server
-	log.Info().Str("port", os.Getenv("PORT")).Msg("listening.")
-	graceful.Run(":"+os.Getenv("PORT"), 10*time.Second, c.Handler(router))
+	return router
 }
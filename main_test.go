@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stellar/go/keypair"
+)
+
+// tests that touch the database run on TEST_DATABASE_URL, which is wiped and
+// migrated from scratch each time, and on the fake stellar network. they
+// are skipped when it isn't set.
+func newTestApp(t *testing.T) *App {
+	t.Helper()
+
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	source, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app, err := NewApp(Settings{
+		SourceAddress:  source.Address(),
+		SourceSeed:     source.Seed(),
+		PostgresURL:    url,
+		SecretKey:      "test",
+		ServiceURL:     "http://localhost",
+		StellarNetwork: "fake",
+		HomeDomain:     "debtmoney.xyz",
+		MaxBaseFee:     10000,
+		MigrationsDir:  "./migrations",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = app.pg.Exec(`DROP SCHEMA public CASCADE; CREATE SCHEMA public;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.migrateUp(app.s.MigrationsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return app
+}
+
+// createTestThing stores a thing of `total` USD with the given parties, each
+// a map like the ones setThing takes, and creates their users.
+func createTestThing(
+	t *testing.T,
+	app *App,
+	id, creator, total string,
+	parties ...map[string]interface{},
+) Thing {
+	t.Helper()
+
+	iparties := make([]interface{}, len(parties))
+	for i, party := range parties {
+		_, err := app.ensureUser(party["account"].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		iparties[i] = party
+	}
+	_, err := app.ensureUser(creator)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txn, err := app.pg.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Rollback()
+
+	thing, err := insertThing(txn, id, "2017-10-01", creator, creator,
+		"test thing", "USD", total, "equal", iparties, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = txn.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return thing
+}
+
+// publishTestThing confirms a thing on behalf of all its parties and runs
+// the publisher until it is done.
+func publishTestThing(t *testing.T, app *App, thing Thing) {
+	t.Helper()
+
+	queued := false
+	for _, party := range thing.Parties {
+		var err error
+		_, queued, err = app.confirmThing(thing.Id, party.UserId, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !queued {
+		t.Fatalf("%s wasn't queued after all parties confirmed", thing.Id)
+	}
+
+	worked, err := app.processPublication()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !worked {
+		t.Fatalf("%s wasn't published", thing.Id)
+	}
+}
+
+// balanceOf returns how many of `issuer`'s `asset` the fake ledger says
+// `holder` has.
+func balanceOf(t *testing.T, app *App, holder, issuer, asset string) string {
+	t.Helper()
+
+	h, err := app.getExistingUser(holder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := app.getExistingUser(issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ha, err := app.h.LoadAccount(h.Address)
+	if err != nil {
+		t.Fatalf("loading %s: %v", holder, err)
+	}
+	for _, balance := range ha.Balances {
+		if balance.Asset.Code == asset && balance.Asset.Issuer == i.Address {
+			return balance.Balance
+		}
+	}
+	return ""
+}
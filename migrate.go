@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// migrations are pairs of files on the migrations directory named like
+// 0002_some_description.up.sql and 0002_some_description.down.sql. the
+// applied versions are recorded on the schema_migrations table.
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+func loadMigrations(dir string) (migrations []Migration, err error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, file := range files {
+		name := file.Name()
+
+		var direction string
+		if strings.HasSuffix(name, ".up.sql") {
+			direction = "up"
+		} else if strings.HasSuffix(name, ".down.sql") {
+			direction = "down"
+		} else {
+			continue
+		}
+
+		parts := strings.SplitN(name, "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 {
+			return nil, errors.New("invalid migration file name: " + name)
+		}
+
+		sql, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{
+				Version: version,
+				Name:    strings.TrimSuffix(parts[1], "."+direction+".sql"),
+			}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(sql)
+		} else {
+			m.Down = string(sql)
+		}
+	}
+
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, errors.New("migration " + strconv.Itoa(m.Version) + " has no up file")
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return
+}
+
+func (app *App) appliedMigrations() (versions map[int]bool, err error) {
+	_, err = app.pg.Exec(`
+CREATE TABLE IF NOT EXISTS schema_migrations (
+  version integer PRIMARY KEY,
+  applied_at timestamp NOT NULL DEFAULT now()
+)
+    `)
+	if err != nil {
+		return
+	}
+
+	var applied []int
+	err = app.pg.Select(&applied, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return
+	}
+
+	versions = make(map[int]bool, len(applied))
+	for _, v := range applied {
+		versions[v] = true
+	}
+	return
+}
+
+// an arbitrary key for pg_advisory_lock, like sourceSequenceLock.
+const migrationsLock = 52118041
+
+// lockMigrations waits until no other instance is migrating the database
+// and keeps it that way until `unlock` is called. the lock belongs to the
+// session, so it's taken on a connection of its own.
+func (app *App) lockMigrations() (unlock func(), err error) {
+	ctx := context.Background()
+	conn, err := app.pg.DB.Conn(ctx)
+	if err != nil {
+		return
+	}
+
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationsLock)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	return func() {
+		_, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationsLock)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to unlock migrations")
+		}
+		conn.Close()
+	}, nil
+}
+
+// migrateUp applies all pending migrations, each in its own transaction.
+// instances starting at the same time take turns, so the ones that come
+// later find the migrations already applied.
+func (app *App) migrateUp(dir string) error {
+	migrations, err := loadMigrations(dir)
+	if err != nil {
+		return err
+	}
+	unlock, err := app.lockMigrations()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	applied, err := app.appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+
+		log.Info().Int("version", m.Version).Str("name", m.Name).Msg("applying migration")
+		err = app.runMigration(m.Version, m.Up, `
+INSERT INTO schema_migrations (version) VALUES ($1)
+        `)
+		if err != nil {
+			log.Error().Err(err).Int("version", m.Version).Msg("migration failed")
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateDown reverts the last `steps` applied migrations.
+func (app *App) migrateDown(dir string, steps int) error {
+	migrations, err := loadMigrations(dir)
+	if err != nil {
+		return err
+	}
+	unlock, err := app.lockMigrations()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	applied, err := app.appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		m := migrations[i]
+		if !applied[m.Version] {
+			continue
+		}
+		if m.Down == "" {
+			return errors.New("migration " + strconv.Itoa(m.Version) + " can't be reverted")
+		}
+
+		log.Info().Int("version", m.Version).Str("name", m.Name).Msg("reverting migration")
+		err = app.runMigration(m.Version, m.Down, `
+DELETE FROM schema_migrations WHERE version = $1
+        `)
+		if err != nil {
+			log.Error().Err(err).Int("version", m.Version).Msg("migration failed")
+			return err
+		}
+		steps--
+	}
+
+	return nil
+}
+
+// migrateBaseline marks all migrations up to `version` as applied without
+// running them, for databases that were created by hand before migrations.
+func (app *App) migrateBaseline(dir string, version int) error {
+	migrations, err := loadMigrations(dir)
+	if err != nil {
+		return err
+	}
+	if _, err = app.appliedMigrations(); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.Version > version {
+			break
+		}
+		_, err = app.pg.Exec(`
+INSERT INTO schema_migrations (version) VALUES ($1)
+ON CONFLICT DO NOTHING
+        `, m.Version)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (app *App) runMigration(version int, sql, record string) error {
+	txn, err := app.pg.Beginx()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	_, err = txn.Exec(sql)
+	if err != nil {
+		return err
+	}
+	_, err = txn.Exec(record, version)
+	if err != nil {
+		return err
+	}
+
+	return txn.Commit()
+}
+
+func (app *App) migrationStatus(dir string) error {
+	migrations, err := loadMigrations(dir)
+	if err != nil {
+		return err
+	}
+	applied, err := app.appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		log.Info().
+			Int("version", m.Version).
+			Str("name", m.Name).
+			Bool("applied", applied[m.Version]).
+			Msg("migration")
+	}
+	return nil
+}
+
+// migrateCommand handles `migrate up|down [steps]|baseline <version>|status`.
+func (app *App) migrateCommand(dir string, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: migrate up|down [steps]|baseline <version>|status")
+	}
+
+	switch args[0] {
+	case "up":
+		return app.migrateUp(dir)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			steps, err = strconv.Atoi(args[1])
+			if err != nil {
+				return err
+			}
+		}
+		return app.migrateDown(dir, steps)
+	case "baseline":
+		if len(args) < 2 {
+			return errors.New("usage: migrate baseline <version>")
+		}
+		version, err := strconv.Atoi(args[1])
+		if err != nil {
+			return err
+		}
+		return app.migrateBaseline(dir, version)
+	case "status":
+		return app.migrationStatus(dir)
+	default:
+		return errors.New("unknown migrate command: " + args[0])
+	}
+}
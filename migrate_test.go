@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+)
+
+// instances starting together on a fresh database must not apply the same
+// migration twice.
+func TestConcurrentMigrations(t *testing.T) {
+	app := newTestApp(t)
+	other, err := NewApp(app.s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = app.pg.Exec(`DROP SCHEMA public CASCADE; CREATE SCHEMA public;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 2)
+	for _, a := range []*App{app, other} {
+		go func(a *App) {
+			errs <- a.migrateUp(a.s.MigrationsDir)
+		}(a)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("migrateUp failed: %v", err)
+		}
+	}
+
+	migrations, err := loadMigrations(app.s.MigrationsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var applied int
+	err = app.pg.Get(&applied, `SELECT count(*) FROM schema_migrations`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(migrations) {
+		t.Errorf("%d migrations applied, want %d", applied, len(migrations))
+	}
+}
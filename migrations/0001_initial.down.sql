@@ -0,0 +1,14 @@
+-- BEWARE: this drops all the data, including the users and their keys.
+
+DROP TRIGGER refresh_friends ON parties;
+DROP FUNCTION refresh_friends();
+DROP MATERIALIZED VIEW friends;
+DROP TRIGGER thing_totals ON parties;
+DROP TRIGGER thing_totals ON things;
+DROP FUNCTION thing_totals();
+DROP FUNCTION publishable(things);
+DROP FUNCTION default_asset(users);
+DROP FUNCTION nullable(text);
+DROP TABLE parties;
+DROP TABLE things;
+DROP TABLE users;
@@ -1,3 +1,8 @@
+-- initial schema, as it was when postgres.sql was run by hand.
+-- note that users.default_asset and things.publishable are not columns, but
+-- the functions default_asset(users) and publishable(things) called with the
+-- attribute notation.
+
 CREATE TABLE users (
   id text PRIMARY KEY,
   address text,
@@ -144,18 +149,3 @@ $$ LANGUAGE plpgsql;
 CREATE TRIGGER refresh_friends AFTER INSERT OR UPDATE ON parties
   FOR EACH STATEMENT
   EXECUTE PROCEDURE refresh_friends();
-
--- drop everything
-
--- DROP TABLE users; -- BEWARE, DON'T DROP THIS
--- DROP TABLE parties;
--- DROP TABLE things;
-DROP TRIGGER thing_totals ON parties;
-DROP TRIGGER thing_totals ON things;
-DROP FUNCTION thing_totals();
-DROP FUNCTION publishable(things);
-DROP FUNCTION default_asset(users);
-DROP FUNCTION nullable(text);
-DROP TRIGGER refresh_friends ON parties;
-DROP FUNCTION refresh_friends();
-DROP MATERIALIZED VIEW friends;
@@ -0,0 +1,2 @@
+DROP TABLE pending_signatures;
+ALTER TABLE things DROP COLUMN envelope;
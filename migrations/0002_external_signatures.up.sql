@@ -0,0 +1,11 @@
+-- things with parties who hold their own keys wait for their signatures on
+-- a partially signed transaction, see signatures.go.
+ALTER TABLE things ADD COLUMN envelope text;
+
+CREATE TABLE pending_signatures (
+  thing_id text NOT NULL REFERENCES things(id),
+  address text NOT NULL,
+  signed boolean NOT NULL DEFAULT false,
+
+  PRIMARY KEY (thing_id, address)
+);
@@ -0,0 +1,2 @@
+DROP TABLE recurring_autoconfirm;
+DROP TABLE recurring_things;
@@ -0,0 +1,25 @@
+CREATE TABLE recurring_things (
+  id text PRIMARY KEY,
+  created_at timestamp NOT NULL DEFAULT now(),
+  created_by text NOT NULL REFERENCES users(id),
+  name text,
+  asset text NOT NULL,
+  total_due text,
+  parties jsonb NOT NULL, -- [{account, paid, due}], as taken by setThing
+  schedule text NOT NULL, -- "monthly", "weekly" or a cron expression
+  starts_at timestamp NOT NULL,
+  next_run timestamp NOT NULL,
+  active boolean NOT NULL DEFAULT true,
+
+  CONSTRAINT name_notempty CHECK (name != ''),
+  CONSTRAINT asset_notempty CHECK (asset != '')
+);
+
+CREATE INDEX recurring_things_next_run ON recurring_things (next_run) WHERE active;
+
+CREATE TABLE recurring_autoconfirm (
+  recurring_id text NOT NULL REFERENCES recurring_things(id),
+  user_id text NOT NULL REFERENCES users(id),
+
+  PRIMARY KEY (recurring_id, user_id)
+);
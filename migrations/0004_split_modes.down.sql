@@ -0,0 +1,43 @@
+DROP TRIGGER thing_totals ON thing_items;
+
+CREATE OR REPLACE FUNCTION thing_totals() RETURNS trigger AS $thing_totals$
+  DECLARE
+    tid text;
+    total numeric;
+    parties_due numeric;
+    parties_paid numeric;
+  BEGIN
+    IF TG_TABLE_NAME = 'things' THEN
+      tid = NEW.id;
+      total = NEW.total_due::numeric;
+    ELSE
+      tid = NEW.thing_id;
+      SELECT total_due::numeric INTO total FROM things WHERE id = tid;
+    END IF;
+
+    SELECT sum(due::numeric) INTO parties_due FROM parties WHERE thing_id = tid;
+    SELECT sum(paid::numeric) INTO parties_paid FROM parties WHERE thing_id = tid;
+
+    IF total IS NULL THEN
+      IF parties_due != parties_paid THEN
+        RAISE EXCEPTION 'since there is no total_due set, the sum of parties.due must equal the sum of parties.paid.';
+      END IF;
+    ELSE
+      IF total != parties_paid THEN
+        RAISE EXCEPTION 'if set, total_due must equal the sum of parties.paid.';
+      END IF;
+
+      IF parties_due > total THEN
+        RAISE EXCEPTION 'sum of parties.due is more than total_due.';
+      END IF;
+    END IF;
+
+    RETURN NULL;
+  END;
+$thing_totals$ LANGUAGE plpgsql;
+
+ALTER TABLE recurring_things DROP COLUMN items;
+ALTER TABLE recurring_things DROP COLUMN split_mode;
+DROP TABLE thing_items;
+ALTER TABLE parties DROP COLUMN weight;
+ALTER TABLE things DROP COLUMN split_mode;
@@ -0,0 +1,113 @@
+ALTER TABLE things ADD COLUMN split_mode text NOT NULL DEFAULT 'equal';
+ALTER TABLE things ADD CONSTRAINT valid_split_mode
+  CHECK (split_mode IN ('equal', 'shares', 'percentage', 'itemized'));
+
+-- shares when split_mode = 'shares', percent when split_mode = 'percentage'
+ALTER TABLE parties ADD COLUMN weight text;
+ALTER TABLE parties ADD CONSTRAINT numeric_weight CHECK (weight::NUMERIC >= 0);
+
+CREATE TABLE thing_items (
+  id serial PRIMARY KEY,
+  thing_id text NOT NULL REFERENCES things(id),
+  description text,
+  amount text NOT NULL,
+  accounts text[] NOT NULL, -- parties.account_name of those who consumed it
+
+  CONSTRAINT positive_amount CHECK (amount::NUMERIC > 0),
+  CONSTRAINT has_accounts CHECK (cardinality(accounts) > 0)
+);
+
+CREATE INDEX thing_items_thing ON thing_items (thing_id);
+
+ALTER TABLE recurring_things ADD COLUMN split_mode text NOT NULL DEFAULT 'equal';
+ALTER TABLE recurring_things ADD COLUMN items jsonb NOT NULL DEFAULT '[]';
+
+CREATE OR REPLACE FUNCTION thing_totals() RETURNS trigger AS $thing_totals$
+  DECLARE
+    tid text;
+    total numeric;
+    mode text;
+    parties_due numeric;
+    parties_paid numeric;
+    parties_weight numeric;
+    parties_due_unset integer;
+    items_total numeric;
+  BEGIN
+    IF TG_TABLE_NAME = 'things' THEN
+      tid = NEW.id;
+      total = NEW.total_due::numeric;
+      mode = NEW.split_mode;
+    ELSE
+      tid = NEW.thing_id;
+      SELECT total_due::numeric, split_mode INTO total, mode FROM things WHERE id = tid;
+    END IF;
+
+    SELECT sum(due::numeric), sum(paid::numeric), sum(weight::numeric), count(*) - count(due)
+      INTO parties_due, parties_paid, parties_weight, parties_due_unset
+      FROM parties WHERE thing_id = tid;
+
+    IF total IS NULL THEN
+      IF mode != 'equal' THEN
+        RAISE EXCEPTION 'split_mode % requires total_due to be set.', mode;
+      END IF;
+
+      IF parties_due != parties_paid THEN
+        RAISE EXCEPTION 'since there is no total_due set, the sum of parties.due must equal the sum of parties.paid.';
+      END IF;
+    ELSE
+      IF total != parties_paid THEN
+        RAISE EXCEPTION 'if set, total_due must equal the sum of parties.paid.';
+      END IF;
+
+      IF parties_due > total THEN
+        RAISE EXCEPTION 'sum of parties.due is more than total_due.';
+      END IF;
+
+      IF mode IN ('equal', 'shares') AND parties_due_unset = 0 AND parties_due != total THEN
+        RAISE EXCEPTION 'all parties.due are set, so their sum must equal total_due.';
+      END IF;
+
+      IF mode IN ('percentage', 'itemized') AND parties_due IS NOT NULL THEN
+        RAISE EXCEPTION 'parties.due can''t be set with split_mode %.', mode;
+      END IF;
+
+      IF mode = 'shares' AND EXISTS (
+        SELECT 1 FROM parties WHERE thing_id = tid AND due IS NULL AND weight::numeric = 0
+      ) THEN
+        RAISE EXCEPTION 'parties.weight must be positive.';
+      END IF;
+
+      IF mode = 'percentage' AND coalesce(parties_weight, 0) != 100 THEN
+        RAISE EXCEPTION 'sum of parties.weight must be 100 percent.';
+      END IF;
+
+      IF mode = 'itemized' THEN
+        SELECT sum(amount::numeric) INTO items_total FROM thing_items WHERE thing_id = tid;
+
+        IF items_total IS NULL THEN
+          RAISE EXCEPTION 'split_mode itemized requires items.';
+        END IF;
+
+        IF items_total > total THEN
+          RAISE EXCEPTION 'sum of items is more than total_due.';
+        END IF;
+
+        IF EXISTS (
+          SELECT 1 FROM thing_items, unnest(accounts) AS account
+          WHERE thing_id = tid AND account NOT IN (
+            SELECT account_name FROM parties WHERE thing_id = tid
+          )
+        ) THEN
+          RAISE EXCEPTION 'items can only be assigned to parties.';
+        END IF;
+      END IF;
+    END IF;
+
+    RETURN NULL;
+  END;
+$thing_totals$ LANGUAGE plpgsql;
+
+CREATE CONSTRAINT TRIGGER thing_totals AFTER INSERT OR UPDATE ON thing_items
+  DEFERRABLE INITIALLY DEFERRED
+  FOR EACH ROW
+  EXECUTE PROCEDURE thing_totals();
@@ -0,0 +1,282 @@
+-- number of decimal places used by each asset. codes not listed here use 2.
+-- seeded from client/Data/Currencies.elm with the ISO 4217 minor units, plus
+-- some crypto assets. stellar itself supports at most 7 decimal places.
+CREATE TABLE assets (
+  code text PRIMARY KEY,
+  precision integer NOT NULL,
+
+  CONSTRAINT stellar_precision CHECK (precision >= 0 AND precision <= 7)
+);
+
+INSERT INTO assets (code, precision) VALUES
+  ('AED', 2),
+  ('AFN', 2),
+  ('ALL', 2),
+  ('AMD', 2),
+  ('ANG', 2),
+  ('AOA', 2),
+  ('ARS', 2),
+  ('AUD', 2),
+  ('AWG', 2),
+  ('AZN', 2),
+  ('BAM', 2),
+  ('BBD', 2),
+  ('BDT', 2),
+  ('BGN', 2),
+  ('BHD', 3),
+  ('BIF', 0),
+  ('BMD', 2),
+  ('BND', 2),
+  ('BOB', 2),
+  ('BRL', 2),
+  ('BSD', 2),
+  ('BTN', 2),
+  ('BWP', 2),
+  ('BYN', 2),
+  ('BZD', 2),
+  ('CAD', 2),
+  ('CDF', 2),
+  ('CHF', 2),
+  ('CLP', 0),
+  ('CNY', 2),
+  ('COP', 2),
+  ('CRC', 2),
+  ('CUC', 2),
+  ('CUP', 2),
+  ('CVE', 2),
+  ('CZK', 2),
+  ('DJF', 0),
+  ('DKK', 2),
+  ('DOP', 2),
+  ('DZD', 2),
+  ('EGP', 2),
+  ('ERN', 2),
+  ('ETB', 2),
+  ('EUR', 2),
+  ('FJD', 2),
+  ('FKP', 2),
+  ('GBP', 2),
+  ('GEL', 2),
+  ('GGP', 2),
+  ('GHS', 2),
+  ('GIP', 2),
+  ('GMD', 2),
+  ('GNF', 0),
+  ('GTQ', 2),
+  ('GYD', 2),
+  ('HKD', 2),
+  ('HNL', 2),
+  ('HRK', 2),
+  ('HTG', 2),
+  ('HUF', 2),
+  ('IDR', 2),
+  ('ILS', 2),
+  ('IMP', 2),
+  ('INR', 2),
+  ('IQD', 3),
+  ('IRR', 2),
+  ('ISK', 0),
+  ('JEP', 2),
+  ('JMD', 2),
+  ('JOD', 3),
+  ('JPY', 0),
+  ('KES', 2),
+  ('KGS', 2),
+  ('KHR', 2),
+  ('KMF', 0),
+  ('KPW', 2),
+  ('KRW', 0),
+  ('KWD', 3),
+  ('KYD', 2),
+  ('KZT', 2),
+  ('LAK', 2),
+  ('LBP', 2),
+  ('LKR', 2),
+  ('LRD', 2),
+  ('LSL', 2),
+  ('LYD', 3),
+  ('MAD', 2),
+  ('MDL', 2),
+  ('MGA', 2),
+  ('MKD', 2),
+  ('MMK', 2),
+  ('MNT', 2),
+  ('MOP', 2),
+  ('MRO', 2),
+  ('MUR', 2),
+  ('MVR', 2),
+  ('MWK', 2),
+  ('MXN', 2),
+  ('MYR', 2),
+  ('MZN', 2),
+  ('NAD', 2),
+  ('NGN', 2),
+  ('NIO', 2),
+  ('NOK', 2),
+  ('NPR', 2),
+  ('NZD', 2),
+  ('OMR', 3),
+  ('PAB', 2),
+  ('PEN', 2),
+  ('PGK', 2),
+  ('PHP', 2),
+  ('PKR', 2),
+  ('PLN', 2),
+  ('PYG', 0),
+  ('QAR', 2),
+  ('RON', 2),
+  ('RSD', 2),
+  ('RUB', 2),
+  ('RWF', 0),
+  ('SAR', 2),
+  ('SBD', 2),
+  ('SCR', 2),
+  ('SDG', 2),
+  ('SEK', 2),
+  ('SGD', 2),
+  ('SHP', 2),
+  ('SLL', 2),
+  ('SOS', 2),
+  ('SPL', 2),
+  ('SRD', 2),
+  ('STD', 2),
+  ('SVC', 2),
+  ('SYP', 2),
+  ('SZL', 2),
+  ('THB', 2),
+  ('TJS', 2),
+  ('TMT', 2),
+  ('TND', 3),
+  ('TOP', 2),
+  ('TRY', 2),
+  ('TTD', 2),
+  ('TVD', 2),
+  ('TWD', 2),
+  ('TZS', 2),
+  ('UAH', 2),
+  ('UGX', 0),
+  ('USD', 2),
+  ('UYU', 2),
+  ('UZS', 2),
+  ('VEF', 2),
+  ('VND', 0),
+  ('VUV', 0),
+  ('WST', 2),
+  ('XAF', 0),
+  ('XCD', 2),
+  ('XDR', 2),
+  ('XOF', 0),
+  ('XPF', 0),
+  ('YER', 2),
+  ('ZAR', 2),
+  ('ZMW', 2),
+  ('ZWD', 2),
+  ('BTC', 7),
+  ('SAT', 0);
+
+CREATE FUNCTION asset_precision(code text) RETURNS integer AS $$
+  SELECT coalesce((SELECT precision FROM assets WHERE assets.code = $1), 2);
+$$ LANGUAGE SQL STABLE;
+
+CREATE FUNCTION fits_precision(amount text, code text) RETURNS boolean AS $$
+  SELECT $1 IS NULL OR $1::numeric = round($1::numeric, asset_precision($2));
+$$ LANGUAGE SQL STABLE;
+
+CREATE OR REPLACE FUNCTION thing_totals() RETURNS trigger AS $thing_totals$
+  DECLARE
+    tid text;
+    total numeric;
+    mode text;
+    code text;
+    parties_due numeric;
+    parties_paid numeric;
+    parties_weight numeric;
+    parties_due_unset integer;
+    items_total numeric;
+  BEGIN
+    IF TG_TABLE_NAME = 'things' THEN
+      tid = NEW.id;
+      total = NEW.total_due::numeric;
+      mode = NEW.split_mode;
+      code = NEW.asset;
+    ELSE
+      tid = NEW.thing_id;
+      SELECT total_due::numeric, split_mode, asset INTO total, mode, code
+        FROM things WHERE id = tid;
+    END IF;
+
+    IF NOT fits_precision(total::text, code) OR EXISTS (
+      SELECT 1 FROM parties
+      WHERE thing_id = tid
+        AND NOT (fits_precision(due, code) AND fits_precision(paid, code))
+    ) OR EXISTS (
+      SELECT 1 FROM thing_items
+      WHERE thing_id = tid AND NOT fits_precision(amount, code)
+    ) THEN
+      RAISE EXCEPTION 'amounts in % can have at most % decimal places.', code, asset_precision(code);
+    END IF;
+
+    SELECT sum(due::numeric), sum(paid::numeric), sum(weight::numeric), count(*) - count(due)
+      INTO parties_due, parties_paid, parties_weight, parties_due_unset
+      FROM parties WHERE thing_id = tid;
+
+    IF total IS NULL THEN
+      IF mode != 'equal' THEN
+        RAISE EXCEPTION 'split_mode % requires total_due to be set.', mode;
+      END IF;
+
+      IF parties_due != parties_paid THEN
+        RAISE EXCEPTION 'since there is no total_due set, the sum of parties.due must equal the sum of parties.paid.';
+      END IF;
+    ELSE
+      IF total != parties_paid THEN
+        RAISE EXCEPTION 'if set, total_due must equal the sum of parties.paid.';
+      END IF;
+
+      IF parties_due > total THEN
+        RAISE EXCEPTION 'sum of parties.due is more than total_due.';
+      END IF;
+
+      IF mode IN ('equal', 'shares') AND parties_due_unset = 0 AND parties_due != total THEN
+        RAISE EXCEPTION 'all parties.due are set, so their sum must equal total_due.';
+      END IF;
+
+      IF mode IN ('percentage', 'itemized') AND parties_due IS NOT NULL THEN
+        RAISE EXCEPTION 'parties.due can''t be set with split_mode %.', mode;
+      END IF;
+
+      IF mode = 'shares' AND EXISTS (
+        SELECT 1 FROM parties WHERE thing_id = tid AND due IS NULL AND weight::numeric = 0
+      ) THEN
+        RAISE EXCEPTION 'parties.weight must be positive.';
+      END IF;
+
+      IF mode = 'percentage' AND coalesce(parties_weight, 0) != 100 THEN
+        RAISE EXCEPTION 'sum of parties.weight must be 100 percent.';
+      END IF;
+
+      IF mode = 'itemized' THEN
+        SELECT sum(amount::numeric) INTO items_total FROM thing_items WHERE thing_id = tid;
+
+        IF items_total IS NULL THEN
+          RAISE EXCEPTION 'split_mode itemized requires items.';
+        END IF;
+
+        IF items_total > total THEN
+          RAISE EXCEPTION 'sum of items is more than total_due.';
+        END IF;
+
+        IF EXISTS (
+          SELECT 1 FROM thing_items, unnest(accounts) AS account
+          WHERE thing_id = tid AND account NOT IN (
+            SELECT account_name FROM parties WHERE thing_id = tid
+          )
+        ) THEN
+          RAISE EXCEPTION 'items can only be assigned to parties.';
+        END IF;
+      END IF;
+    END IF;
+
+    RETURN NULL;
+  END;
+$thing_totals$ LANGUAGE plpgsql;
@@ -0,0 +1 @@
+DROP TABLE thing_transactions;
@@ -0,0 +1,13 @@
+-- things with too many operations for a single stellar transaction are
+-- published in many. the transactions are stored here, in the order they
+-- must be applied, without sequence numbers or signatures. `signers` are the
+-- addresses other than the source account that must sign each one and
+-- `hash` is set once it is applied.
+CREATE TABLE thing_transactions (
+  thing_id text NOT NULL REFERENCES things (id),
+  position integer NOT NULL,
+  tx text NOT NULL,
+  signers text[] NOT NULL DEFAULT '{}',
+  hash text,
+  PRIMARY KEY (thing_id, position)
+);
@@ -0,0 +1,3 @@
+ALTER TABLE thing_transactions DROP COLUMN envelope_hash;
+ALTER TABLE thing_transactions DROP COLUMN envelope;
+DROP TABLE publications;
@@ -0,0 +1,23 @@
+-- things waiting to be published by the publication worker.
+--   - pending: will be tried when next_attempt comes.
+--   - submitted: handed over to the signers, waiting for their signatures.
+--   - confirmed: all transactions applied, things.txn is set.
+--   - failed: gave up after too many attempts, can be retried by hand.
+CREATE TABLE publications (
+  thing_id text PRIMARY KEY REFERENCES things (id),
+  status text NOT NULL DEFAULT 'pending',
+  attempts integer NOT NULL DEFAULT 0,
+  next_attempt timestamp NOT NULL DEFAULT now(),
+  last_error text,
+  updated_at timestamp NOT NULL DEFAULT now(),
+
+  CONSTRAINT valid_status
+    CHECK (status IN ('pending', 'submitted', 'confirmed', 'failed'))
+);
+
+CREATE INDEX ON publications (next_attempt) WHERE status = 'pending';
+
+-- the last signed envelope sent to horizon for each transaction, and its
+-- hash, so we can find out whether it was applied before sending another.
+ALTER TABLE thing_transactions ADD COLUMN envelope text;
+ALTER TABLE thing_transactions ADD COLUMN envelope_hash text;
@@ -0,0 +1 @@
+ALTER TABLE thing_transactions DROP COLUMN fee_charged;
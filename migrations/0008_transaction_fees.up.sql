@@ -0,0 +1,2 @@
+-- what stellar charged for each transaction, in stroops.
+ALTER TABLE thing_transactions ADD COLUMN fee_charged bigint;
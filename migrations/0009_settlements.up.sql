@@ -0,0 +1,27 @@
+-- payments made outside stellar (cash, bank transfers, pix). once both the
+-- payer and the payee confirm one, the payee sends the payer's IOUs back to
+-- the payer, burning them, and `txn` is set.
+CREATE TABLE settlements (
+  id text PRIMARY KEY,
+  created_at timestamp NOT NULL DEFAULT now(),
+  created_by text NOT NULL REFERENCES users (id),
+  payer text NOT NULL REFERENCES users (id),
+  payee text NOT NULL REFERENCES users (id),
+  asset text NOT NULL,
+  amount text NOT NULL,
+  method text NOT NULL,
+  reference text,
+  actual_date timestamp NOT NULL DEFAULT now(),
+  payer_confirmed boolean NOT NULL DEFAULT false,
+  payee_confirmed boolean NOT NULL DEFAULT false,
+  txn text,
+
+  CONSTRAINT positive_amount CHECK (amount::NUMERIC > 0),
+  CONSTRAINT asset_notempty CHECK (asset != ''),
+  CONSTRAINT different_users CHECK (payer != payee),
+  CONSTRAINT valid_method
+    CHECK (method IN ('cash', 'bank_transfer', 'pix', 'other'))
+);
+
+CREATE INDEX ON settlements (payer);
+CREATE INDEX ON settlements (payee);
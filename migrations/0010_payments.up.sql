@@ -0,0 +1,17 @@
+-- path payments users made to each other with sendPayment, so they show up
+-- on statements. `amount` is in the destination asset.
+CREATE TABLE payments (
+  id text PRIMARY KEY,
+  created_at timestamp NOT NULL DEFAULT now(),
+  from_user text NOT NULL REFERENCES users (id),
+  to_user text NOT NULL REFERENCES users (id),
+  src_asset text NOT NULL,
+  src_issuer text NOT NULL,
+  dst_asset text NOT NULL,
+  dst_issuer text NOT NULL,
+  amount text NOT NULL,
+  txn text NOT NULL UNIQUE
+);
+
+CREATE INDEX ON payments (from_user);
+CREATE INDEX ON payments (to_user);
@@ -0,0 +1,4 @@
+DROP TABLE settlement_plan_transactions;
+DROP TABLE settlement_plan_transfers;
+DROP TABLE settlement_plan_members;
+DROP TABLE settlement_plans;
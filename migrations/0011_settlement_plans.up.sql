@@ -0,0 +1,46 @@
+-- settlement plans net the IOUs of a group of users, see netting.go. every
+-- member must confirm a plan before it is published. `debt` transfers are
+-- the IOUs it cancels and `transfer` ones the IOUs it issues instead.
+CREATE TABLE settlement_plans (
+  id text PRIMARY KEY,
+  created_at timestamp NOT NULL DEFAULT now(),
+  created_by text NOT NULL REFERENCES users (id),
+  txn text
+);
+
+CREATE TABLE settlement_plan_members (
+  plan_id text NOT NULL REFERENCES settlement_plans (id),
+  user_id text NOT NULL REFERENCES users (id),
+  confirmed boolean NOT NULL DEFAULT false,
+
+  PRIMARY KEY (plan_id, user_id)
+);
+
+CREATE INDEX ON settlement_plan_members (user_id);
+
+CREATE TABLE settlement_plan_transfers (
+  plan_id text NOT NULL REFERENCES settlement_plans (id),
+  kind text NOT NULL,
+  from_user text NOT NULL REFERENCES users (id),
+  to_user text NOT NULL REFERENCES users (id),
+  asset text NOT NULL,
+  amount text NOT NULL,
+
+  CONSTRAINT valid_kind CHECK (kind IN ('debt', 'transfer'))
+);
+
+CREATE INDEX ON settlement_plan_transfers (plan_id);
+
+-- like thing_transactions, so an interrupted publication resumes from the
+-- first transaction that wasn't applied.
+CREATE TABLE settlement_plan_transactions (
+  plan_id text NOT NULL REFERENCES settlement_plans (id),
+  position integer NOT NULL,
+  tx text NOT NULL,
+  hash text,
+  envelope text,
+  envelope_hash text,
+  fee_charged bigint,
+
+  PRIMARY KEY (plan_id, position)
+);
@@ -0,0 +1 @@
+ALTER TABLE things DROP COLUMN envelope_position;
@@ -0,0 +1,2 @@
+-- which of the thing_transactions the envelope waiting for signatures is.
+ALTER TABLE things ADD COLUMN envelope_position integer;
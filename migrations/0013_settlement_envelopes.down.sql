@@ -0,0 +1,3 @@
+ALTER TABLE settlements DROP COLUMN awaiting_signature;
+ALTER TABLE settlements DROP COLUMN envelope_hash;
+ALTER TABLE settlements DROP COLUMN envelope;
@@ -0,0 +1,7 @@
+-- settlements are burnt like the transactions of things: the envelope and
+-- its hash are stored before it is sent, so it is never built twice. when the
+-- payee holds their own keys it waits here for their signature while
+-- awaiting_signature is set.
+ALTER TABLE settlements ADD COLUMN envelope text;
+ALTER TABLE settlements ADD COLUMN envelope_hash text;
+ALTER TABLE settlements ADD COLUMN awaiting_signature boolean NOT NULL DEFAULT false;
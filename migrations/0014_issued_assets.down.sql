@@ -0,0 +1,2 @@
+ALTER TABLE things DROP COLUMN assets_recorded;
+DROP TABLE issued_assets;
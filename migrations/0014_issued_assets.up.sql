@@ -0,0 +1,19 @@
+-- the IOUs our users issued on things and settlement plans, listed on
+-- stellar.toml. things record theirs when their transactions are planned
+-- and set assets_recorded, the ones planned before are recorded on startup
+-- by recordPastIssuedAssets.
+CREATE TABLE issued_assets (
+  user_id text NOT NULL REFERENCES users (id),
+  asset text NOT NULL,
+
+  PRIMARY KEY (user_id, asset)
+);
+
+ALTER TABLE things ADD COLUMN assets_recorded boolean NOT NULL DEFAULT false;
+
+INSERT INTO issued_assets (user_id, asset)
+SELECT DISTINCT from_user, asset
+FROM settlement_plan_transfers
+INNER JOIN settlement_plans ON settlement_plans.id = plan_id
+WHERE kind = 'transfer' AND coalesce(txn, '') != ''
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,737 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/lucsky/cuid"
+	"github.com/shopspring/decimal"
+	b "github.com/stellar/go/build"
+	"github.com/stellar/go/xdr"
+)
+
+// a Transfer is an amount of `asset` owed by `from` to `to`. it is used both
+// for the IOUs that already exist on stellar and for the netted transfers
+// that should replace them.
+type Transfer struct {
+	From   string          `json:"from"   db:"from_user"`
+	To     string          `json:"to"     db:"to_user"`
+	Asset  string          `json:"asset"  db:"asset"`
+	Amount decimal.Decimal `json:"amount" db:"amount"`
+}
+
+// a SettlementPlan cancels the IOUs a group of users issued to each other
+// and issues new ones that keep everybody's net position. since it moves
+// IOUs between the other members too, all of them must confirm it before it
+// is published.
+type SettlementPlan struct {
+	Id          string       `json:"id"         db:"id"`
+	CreatedBy   string       `json:"created_by" db:"created_by"`
+	Transaction string       `json:"txn"        db:"txn"`
+	Members     []PlanMember `json:"members"    db:"-"`
+	Users       []User       `json:"-"          db:"-"`
+	Debts       []Transfer   `json:"debts"      db:"-"`
+	Transfers   []Transfer   `json:"transfers"  db:"-"`
+}
+
+type PlanMember struct {
+	UserId    string `json:"user"      db:"user_id"`
+	Confirmed bool   `json:"confirmed" db:"confirmed"`
+}
+
+var errSettlementPlanNotFound = errors.New("settlement-plan-not-found")
+
+// buildSettlementPlan loads all the IOUs the given users have issued to each
+// other and computes the transfers that settle the same net positions.
+func (app *App) buildSettlementPlan(userIds []string) (plan SettlementPlan, err error) {
+	plan.Users, err = app.loadGroup(userIds)
+	if err != nil {
+		return
+	}
+
+	plan.Debts = currentDebts(plan.Users)
+	plan.Transfers = netDebts(plan.Debts)
+	return
+}
+
+// settlementGroup returns the ids of the users that will take part in a
+// settlement plan requested by `loggedUserId`, who can only net their IOUs
+// with the users they share things with. if no users are given we use all
+// of these.
+func (app *App) settlementGroup(loggedUserId string, userIds []interface{}) (ids []string, err error) {
+	var friends []string
+	err = app.pg.Select(&friends, `
+SELECT friend FROM friends
+WHERE main = $1
+    `, loggedUserId)
+	if err != nil {
+		log.Warn().Err(err).Str("user", loggedUserId).
+			Msg("failed to load friends for settlement")
+		return
+	}
+
+	ids = []string{loggedUserId}
+	if len(userIds) == 0 {
+		ids = append(ids, friends...)
+		return
+	}
+
+	allowed := make(map[string]bool, len(friends))
+	for _, friend := range friends {
+		allowed[friend] = true
+	}
+	for _, iid := range userIds {
+		id, _ := iid.(string)
+		if id == "" || id == loggedUserId {
+			continue
+		}
+		if !allowed[id] {
+			return nil, errNotAllowed
+		}
+		ids = append(ids, id)
+	}
+	return
+}
+
+// proposeSettlementPlan stores the plan that nets the IOUs of the given
+// users. only the ones with IOUs to cancel become members, and `userId`,
+// who proposes it, confirms it right away.
+func (app *App) proposeSettlementPlan(userId string, userIds []string) (plan SettlementPlan, err error) {
+	plan, err = app.buildSettlementPlan(userIds)
+	if err != nil {
+		return
+	}
+	if len(plan.Transfers) == 0 {
+		return plan, errors.New("nothing to settle")
+	}
+
+	involved := make(map[string]bool)
+	for _, debt := range plan.Debts {
+		involved[debt.From] = true
+		involved[debt.To] = true
+	}
+	for _, user := range plan.Users {
+		if !involved[user.Id] {
+			continue
+		}
+		// we can't ask them to sign a transaction for each batch
+		if !user.custodial() {
+			return plan, errors.New("settlement plans can't include users who hold their own keys")
+		}
+		plan.Members = append(plan.Members, PlanMember{user.Id, user.Id == userId})
+	}
+
+	txn, err := app.pg.Beginx()
+	if err != nil {
+		return
+	}
+	defer txn.Rollback()
+
+	plan.Id = cuid.Slug()
+	plan.CreatedBy = userId
+	_, err = txn.Exec(`
+INSERT INTO settlement_plans (id, created_by) VALUES ($1, $2)
+    `, plan.Id, userId)
+	if err != nil {
+		log.Warn().Err(err).Str("user", userId).Msg("failed to store settlement plan")
+		return
+	}
+
+	for _, member := range plan.Members {
+		_, err = txn.Exec(`
+INSERT INTO settlement_plan_members (plan_id, user_id, confirmed)
+VALUES ($1, $2, $3)
+        `, plan.Id, member.UserId, member.Confirmed)
+		if err != nil {
+			return
+		}
+	}
+
+	for kind, transfers := range map[string][]Transfer{
+		"debt":     plan.Debts,
+		"transfer": plan.Transfers,
+	} {
+		for _, t := range transfers {
+			_, err = txn.Exec(`
+INSERT INTO settlement_plan_transfers (plan_id, kind, from_user, to_user, asset, amount)
+VALUES ($1, $2, $3, $4, $5, $6)
+            `, plan.Id, kind, t.From, t.To, t.Asset, t.Amount.String())
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	log.Info().
+		Str("plan", plan.Id).
+		Str("user", userId).
+		Int("members", len(plan.Members)).
+		Int("debts", len(plan.Debts)).
+		Int("transfers", len(plan.Transfers)).
+		Msg("settlement plan proposed")
+	return plan, txn.Commit()
+}
+
+func (app *App) getSettlementPlan(id string) (plan SettlementPlan, err error) {
+	err = app.pg.Get(&plan, `
+SELECT id, created_by, coalesce(txn, '') AS txn FROM settlement_plans
+WHERE id = $1
+    `, id)
+	if err == sql.ErrNoRows {
+		return plan, errSettlementPlanNotFound
+	} else if err != nil {
+		return
+	}
+
+	err = app.pg.Select(&plan.Members, `
+SELECT user_id, confirmed FROM settlement_plan_members
+WHERE plan_id = $1
+ORDER BY user_id
+    `, id)
+	if err != nil {
+		return
+	}
+
+	for kind, transfers := range map[string]*[]Transfer{
+		"debt":     &plan.Debts,
+		"transfer": &plan.Transfers,
+	} {
+		err = app.pg.Select(transfers, `
+SELECT from_user, to_user, asset, amount FROM settlement_plan_transfers
+WHERE plan_id = $1 AND kind = $2
+ORDER BY asset, from_user, to_user
+        `, id, kind)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// a NettedTransfer is one of the transfers of a published settlement plan.
+type NettedTransfer struct {
+	Transfer
+	PlanId      string `db:"plan_id"`
+	CreatedAt   string `db:"created_at"`
+	Transaction string `db:"txn"`
+	Kind        string `db:"kind"`
+}
+
+// owed is how much more `From` owes `To` after the plan: the IOUs it cancels
+// count as paid back and the ones it issues as new debts.
+func (t NettedTransfer) owed() decimal.Decimal {
+	if t.Kind == "debt" {
+		return t.Amount.Neg()
+	}
+	return t.Amount
+}
+
+// nettedTransfers lists the transfers of the published settlement plans that
+// involve `userId`, oldest plan first.
+func (app *App) nettedTransfers(userId string) (transfers []NettedTransfer, err error) {
+	err = app.pg.Select(&transfers, `
+SELECT
+  plan_id, created_at, txn, kind,
+  from_user, to_user, asset, amount
+FROM settlement_plan_transfers
+INNER JOIN settlement_plans ON settlement_plans.id = plan_id
+WHERE coalesce(txn, '') != '' AND (from_user = $1 OR to_user = $1)
+ORDER BY created_at, plan_id
+    `, userId)
+	if err != nil {
+		log.Warn().Err(err).Str("user", userId).Msg("failed to load netted transfers")
+	}
+	return
+}
+
+func (plan SettlementPlan) isMember(userId string) bool {
+	for _, member := range plan.Members {
+		if member.UserId == userId {
+			return true
+		}
+	}
+	return false
+}
+
+func (plan SettlementPlan) confirmed() bool {
+	for _, member := range plan.Members {
+		if !member.Confirmed {
+			return false
+		}
+	}
+	return len(plan.Members) > 0
+}
+
+// confirmSettlementPlan sets the confirmation of `userId` on a plan. it
+// can't be changed anymore once the plan starts being published, which
+// happens as soon as the last member confirms it.
+func (app *App) confirmSettlementPlan(id, userId string, confirm bool) (plan SettlementPlan, err error) {
+	res, err := app.pg.Exec(`
+UPDATE settlement_plan_members SET confirmed = $3
+WHERE plan_id = $1 AND user_id = $2 AND NOT EXISTS (
+  SELECT 1 FROM settlement_plan_transactions WHERE plan_id = $1
+)
+    `, id, userId, confirm)
+	if err != nil {
+		log.Warn().Err(err).Str("plan", id).Msg("failed to confirm settlement plan")
+		return
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+
+	plan, err = app.getSettlementPlan(id)
+	if err != nil {
+		return
+	}
+	if affected == 0 {
+		if plan.isMember(userId) {
+			return plan, errAlreadyPublished
+		}
+		return plan, errNotAllowed
+	}
+
+	if plan.confirmed() {
+		plan.Transaction, err = plan.publish(app)
+	}
+	return
+}
+
+// loadGroup loads the given users from the database and their accounts
+// from stellar.
+func (app *App) loadGroup(userIds []string) (users []User, err error) {
+	seen := make(map[string]bool)
+	for _, id := range userIds {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		var user User
+		user, err = app.getExistingUser(id)
+		if err != nil {
+			return
+		}
+		if user.Id == "" {
+			err = errors.New("user '" + id + "' doesn't exist")
+			return
+		}
+		users = append(users, user)
+	}
+
+	// ignore errors -- because the account may not be created on stellar yet
+	var wg sync.WaitGroup
+	for i, user := range users {
+		wg.Add(1)
+		go func(index int, addr string) {
+			defer wg.Done()
+			ha, _ := app.h.LoadAccount(addr)
+			users[index].ha = ha
+		}(i, user.Address)
+	}
+	wg.Wait()
+
+	return
+}
+
+// currentDebts reads the trustline balances of each user and returns
+// the IOUs they hold that were issued by other users in the group.
+func currentDebts(users []User) (debts []Transfer) {
+	byAddress := make(map[string]User, len(users))
+	for _, user := range users {
+		byAddress[user.Address] = user
+	}
+
+	zero := decimal.Decimal{}
+	for _, holder := range users {
+		for _, balance := range holder.ha.Balances {
+			if balance.Asset.Type == "native" {
+				continue
+			}
+
+			issuer, ok := byAddress[balance.Asset.Issuer]
+			if !ok {
+				continue
+			}
+
+			amount, err := decimal.NewFromString(balance.Balance)
+			if err != nil {
+				log.Warn().Err(err).
+					Str("balance", balance.Balance).
+					Msg("wrong values received from horizon")
+				continue
+			}
+			if amount.Equals(zero) {
+				continue
+			}
+
+			debts = append(debts, Transfer{
+				From:   issuer.Id,
+				To:     holder.Id,
+				Asset:  balance.Asset.Code,
+				Amount: amount,
+			})
+		}
+	}
+
+	return
+}
+
+// netDebts computes, for each asset, the net position of each user and then
+// repeatedly matches the biggest debtor with the biggest creditor. this
+// settles everything with at most one transfer less than the number of users
+// with a nonzero position.
+func netDebts(debts []Transfer) (transfers []Transfer) {
+	type position struct {
+		user   string
+		amount decimal.Decimal
+	}
+
+	nets := make(map[string]map[string]decimal.Decimal)
+	for _, debt := range debts {
+		if _, ok := nets[debt.Asset]; !ok {
+			nets[debt.Asset] = make(map[string]decimal.Decimal)
+		}
+		nets[debt.Asset][debt.From] = nets[debt.Asset][debt.From].Sub(debt.Amount)
+		nets[debt.Asset][debt.To] = nets[debt.Asset][debt.To].Add(debt.Amount)
+	}
+
+	assets := make([]string, 0, len(nets))
+	for asset := range nets {
+		assets = append(assets, asset)
+	}
+	sort.Strings(assets)
+
+	zero := decimal.Decimal{}
+	for _, asset := range assets {
+		var creditors []position
+		var debtors []position
+		for user, amount := range nets[asset] {
+			if amount.GreaterThan(zero) {
+				creditors = append(creditors, position{user, amount})
+			} else if amount.LessThan(zero) {
+				debtors = append(debtors, position{user, amount.Neg()})
+			}
+		}
+
+		// biggest first, ties broken by user id so the plan is deterministic
+		for _, list := range [][]position{creditors, debtors} {
+			sort.Slice(list, func(i, j int) bool {
+				if list[i].amount.Equals(list[j].amount) {
+					return list[i].user < list[j].user
+				}
+				return list[i].amount.GreaterThan(list[j].amount)
+			})
+		}
+
+		c, d := 0, 0
+		for c < len(creditors) && d < len(debtors) {
+			value := creditors[c].amount
+			if debtors[d].amount.LessThan(value) {
+				value = debtors[d].amount
+			}
+
+			transfers = append(transfers, Transfer{
+				From:   debtors[d].user,
+				To:     creditors[c].user,
+				Asset:  asset,
+				Amount: value,
+			})
+
+			creditors[c].amount = creditors[c].amount.Sub(value)
+			debtors[d].amount = debtors[d].amount.Sub(value)
+			if creditors[c].amount.Equals(zero) {
+				c++
+			}
+			if debtors[d].amount.Equals(zero) {
+				d++
+			}
+		}
+	}
+
+	return
+}
+
+// publish replaces the existing IOUs by the netted transfers: every holder
+// sends the IOUs it holds back to their issuers, cancelling them, then new
+// IOUs are issued for each transfer. the operations are planned in as many
+// transactions as needed, which are stored and submitted in order like the
+// ones of things (see transactions.go), so it can be called again to resume
+// a publication that failed midway. the hash of the last one is returned.
+func (plan SettlementPlan) publish(app *App) (hash string, err error) {
+	if plan.Transaction != "" {
+		return plan.Transaction, nil
+	}
+	if !plan.confirmed() {
+		return "", errors.New("not confirmed by all members")
+	}
+
+	// only one publisher at a time, the others wait here and then find the
+	// transactions it applied. progress is stored outside this transaction,
+	// so it isn't lost if we fail.
+	txn, err := app.pg.Beginx()
+	if err != nil {
+		return
+	}
+	defer txn.Rollback()
+
+	_, err = txn.Exec(`
+SELECT 1 FROM settlement_plans WHERE id = $1 FOR NO KEY UPDATE
+    `, plan.Id)
+	if err != nil {
+		return
+	}
+
+	err = plan.planTransactions(app)
+	if err != nil {
+		return
+	}
+	hash, err = plan.submitTransactions(app)
+	if err != nil {
+		return
+	}
+
+	_, err = txn.Exec(`
+UPDATE settlement_plans SET txn = $2 WHERE id = $1
+    `, plan.Id, hash)
+	if err != nil {
+		log.Error().Err(err).Str("plan", plan.Id).Str("tx", hash).
+			Msg("settlement plan published but failed to store its hash")
+		return
+	}
+
+	// the new IOUs are listed on stellar.toml
+	_, err = txn.Exec(`
+INSERT INTO issued_assets (user_id, asset)
+SELECT DISTINCT from_user, asset FROM settlement_plan_transfers
+WHERE plan_id = $1 AND kind = 'transfer'
+ON CONFLICT DO NOTHING
+    `, plan.Id)
+	if err != nil {
+		log.Error().Err(err).Str("plan", plan.Id).Msg("failed to record issued assets")
+		return
+	}
+
+	log.Info().Str("plan", plan.Id).Str("tx", hash).Msg("settlement plan published")
+	return hash, txn.Commit()
+}
+
+// planTransactions builds and stores the transactions of a plan, unless
+// that was done before. the IOUs must still be the ones the members
+// confirmed, otherwise a new plan must be made.
+func (plan SettlementPlan) planTransactions(app *App) (err error) {
+	var planned int
+	err = app.pg.Get(&planned, `
+SELECT count(*) FROM settlement_plan_transactions
+WHERE plan_id = $1
+    `, plan.Id)
+	if err != nil || planned > 0 {
+		return
+	}
+
+	ids := make([]string, len(plan.Members))
+	for i, member := range plan.Members {
+		ids[i] = member.UserId
+	}
+	users, err := app.loadGroup(ids)
+	if err != nil {
+		return
+	}
+	if !sameTransfers(currentDebts(users), plan.Debts) {
+		return errors.New("settlement-plan-outdated")
+	}
+
+	byId := make(map[string]User, len(users))
+	tofund := make(map[string]int, len(users))
+	for _, user := range users {
+		byId[user.Id] = user
+		tofund[user.Id] = 0
+	}
+
+	var operations []Operation
+
+	// cancel the existing IOUs
+	for _, debt := range plan.Debts {
+		issuer := byId[debt.From]
+		holder := byId[debt.To]
+
+		operations = append(operations, Operation{
+			Step:   paymentStep,
+			Signer: holder,
+			Mutator: b.Payment(
+				b.SourceAccount{holder.Address},
+				b.Destination{issuer.Address},
+				b.CreditAmount{debt.Asset, issuer.Address, debt.Amount.String()},
+			),
+		})
+	}
+
+	// issue the new ones
+	for _, transfer := range plan.Transfers {
+		var ops []Operation
+		var funds int
+		ops, funds, err = app.issueOperations(
+			byId[transfer.From], byId[transfer.To], transfer.Asset, transfer.Amount)
+		if err != nil {
+			return
+		}
+
+		operations = append(operations, ops...)
+		tofund[transfer.To] += funds
+	}
+	operations = append(operations, app.setupOperations(users, tofund)...)
+
+	batches := batchOperations(operations)
+	for i, batch := range batches {
+		tx := app.createStellarTransaction()
+		tx.Mutate(b.MemoText{"settlement"})
+		for _, op := range batch {
+			tx.Mutate(op.Mutator)
+		}
+		if tx.Err != nil {
+			log.Warn().Err(tx.Err).Msg("failed to build transaction")
+			return tx.Err
+		}
+
+		var buf bytes.Buffer
+		_, err = xdr.Marshal(&buf, tx.TX)
+		if err != nil {
+			return
+		}
+
+		_, err = app.pg.Exec(`
+INSERT INTO settlement_plan_transactions (plan_id, position, tx)
+VALUES ($1, $2, $3)
+        `, plan.Id, i, base64.StdEncoding.EncodeToString(buf.Bytes()))
+		if err != nil {
+			log.Error().Err(err).Str("plan", plan.Id).Int("position", i).
+				Msg("failed to store planned transaction")
+			return
+		}
+	}
+
+	log.Info().
+		Str("plan", plan.Id).
+		Int("debts", len(plan.Debts)).
+		Int("transfers", len(plan.Transfers)).
+		Int("transactions", len(batches)).
+		Msg("planned settlement plan transactions")
+	return nil
+}
+
+// submitTransactions submits, in order, the planned transactions of a plan
+// that weren't applied yet, storing each envelope before it is sent.
+func (plan SettlementPlan) submitTransactions(app *App) (hash string, err error) {
+	var planned []struct {
+		Position     int    `db:"position"`
+		Tx           string `db:"tx"`
+		Hash         string `db:"hash"`
+		Envelope     string `db:"envelope"`
+		EnvelopeHash string `db:"envelope_hash"`
+	}
+	err = app.pg.Select(&planned, `
+SELECT
+  position, tx,
+  coalesce(hash, '') AS hash,
+  coalesce(envelope, '') AS envelope,
+  coalesce(envelope_hash, '') AS envelope_hash
+FROM settlement_plan_transactions
+WHERE plan_id = $1
+ORDER BY position
+    `, plan.Id)
+	if err != nil {
+		return
+	}
+
+	for _, ptx := range planned {
+		if ptx.Hash != "" {
+			hash = ptx.Hash
+			continue
+		}
+
+		hash = ""
+		var fee int64
+		if ptx.Envelope != "" {
+			hash, fee, err = app.settleEnvelope(ptx.EnvelopeHash, ptx.Envelope)
+			if err != nil {
+				return
+			}
+			if hash == "" {
+				_, err = app.pg.Exec(`
+UPDATE settlement_plan_transactions SET envelope = NULL, envelope_hash = NULL
+WHERE plan_id = $1 AND position = $2
+                `, plan.Id, ptx.Position)
+				if err != nil {
+					return
+				}
+			}
+		}
+
+		if hash == "" {
+			var tx *b.TransactionBuilder
+			tx, err = app.rebuildStellarTransaction(ptx.Tx)
+			if err != nil {
+				return
+			}
+
+			var seeds, external []string
+			seeds, external, err = app.signingKeys(operationSources(*tx.TX))
+			if err != nil {
+				return
+			}
+			if len(external) > 0 {
+				return "", errors.New("settlement plans can't include users who hold their own keys")
+			}
+
+			position := ptx.Position
+			hash, fee, err = app.sequences.submit(app, tx, seeds, func(blob, envelopeHash string) error {
+				_, err := app.pg.Exec(`
+UPDATE settlement_plan_transactions SET envelope = $3, envelope_hash = $4
+WHERE plan_id = $1 AND position = $2
+                `, plan.Id, position, blob, envelopeHash)
+				return err
+			})
+			if err != nil {
+				log.Warn().Err(err).Str("plan", plan.Id).Int("position", ptx.Position).
+					Int("transactions", len(planned)).
+					Msg("settlement plan interrupted, will resume from here")
+				return "", err
+			}
+		}
+
+		_, err = app.pg.Exec(`
+UPDATE settlement_plan_transactions SET hash = $3, fee_charged = $4
+WHERE plan_id = $1 AND position = $2 AND hash IS NULL
+        `, plan.Id, ptx.Position, hash, fee)
+		if err != nil {
+			log.Error().Err(err).Str("plan", plan.Id).Str("tx", hash).
+				Msg("failed to store the hash of a settlement plan transaction")
+			return "", err
+		}
+	}
+
+	return hash, nil
+}
+
+// sameTransfers tells if both lists have the same transfers, in any order.
+func sameTransfers(x, y []Transfer) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	amounts := make(map[[3]string]decimal.Decimal, len(x))
+	for _, t := range x {
+		amounts[[3]string{t.From, t.To, t.Asset}] = t.Amount
+	}
+	for _, t := range y {
+		amount, ok := amounts[[3]string{t.From, t.To, t.Asset}]
+		if !ok || !amount.Equals(t.Amount) {
+			return false
+		}
+	}
+	return true
+}
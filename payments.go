@@ -0,0 +1,53 @@
+package main
+
+import (
+	"github.com/lucsky/cuid"
+	"github.com/shopspring/decimal"
+)
+
+// Payment is a path payment made with sendPayment, as stored on the
+// payments table.
+type Payment struct {
+	Id        string          `json:"id"         db:"id"`
+	CreatedAt string          `json:"created_at" db:"created_at"`
+	From      string          `json:"from"       db:"from_user"`
+	To        string          `json:"to"         db:"to_user"`
+	SrcAsset  string          `json:"src_asset"  db:"src_asset"`
+	SrcIssuer string          `json:"src_issuer" db:"src_issuer"`
+	DstAsset  string          `json:"dst_asset"  db:"dst_asset"`
+	DstIssuer string          `json:"dst_issuer" db:"dst_issuer"`
+	Amount    decimal.Decimal `json:"amount"     db:"amount"`
+	Hash      string          `json:"txn"        db:"txn"`
+}
+
+func (payment Payment) columns() string {
+	return `
+payments.id,
+created_at,
+from_user,
+to_user,
+src_asset,
+src_issuer,
+dst_asset,
+dst_issuer,
+amount,
+txn
+    `
+}
+
+// recordPayment logs a payment that was already applied on stellar.
+func (app *App) recordPayment(payment Payment) error {
+	_, err := app.pg.Exec(`
+INSERT INTO payments
+  (id, from_user, to_user, src_asset, src_issuer, dst_asset, dst_issuer,
+   amount, txn)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+ON CONFLICT (txn) DO NOTHING
+    `, cuid.Slug(), payment.From, payment.To,
+		payment.SrcAsset, payment.SrcIssuer, payment.DstAsset, payment.DstIssuer,
+		payment.Amount.String(), payment.Hash)
+	if err != nil {
+		log.Error().Err(err).Str("tx", payment.Hash).Msg("failed to record payment")
+	}
+	return err
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// things are not published while answering the request that made them
+// publishable. instead they are queued on the publications table and a
+// worker takes them from there, retrying with backoff on failures.
+
+const maxPublicationAttempts = 10
+
+type Publication struct {
+	ThingId     string    `json:"thing_id"   db:"thing_id"`
+	Status      string    `json:"status"     db:"status"`
+	Attempts    int       `json:"attempts"   db:"attempts"`
+	NextAttempt time.Time `json:"-"          db:"next_attempt"`
+	LastError   string    `json:"last_error" db:"last_error"`
+	UpdatedAt   time.Time `json:"-"          db:"updated_at"`
+}
+
+func (pub Publication) columns() string {
+	return `
+thing_id,
+status,
+attempts,
+next_attempt,
+coalesce(last_error, '') AS last_error,
+updated_at
+    `
+}
+
+// enqueuePublication queues a thing to be published as soon as possible.
+// failed publications are reset so they get all their attempts again.
+func enqueuePublication(db sqlx.Execer, thingId string) error {
+	_, err := db.Exec(`
+INSERT INTO publications (thing_id) VALUES ($1)
+ON CONFLICT (thing_id) DO UPDATE SET
+  status = 'pending',
+  attempts = 0,
+  next_attempt = now(),
+  last_error = NULL,
+  updated_at = now()
+WHERE publications.status <> 'confirmed'
+    `, thingId)
+	if err != nil {
+		log.Error().Err(err).Str("thing", thingId).Msg("failed to queue publication")
+	}
+	return err
+}
+
+func (app *App) getPublication(thingId string) (pub Publication, err error) {
+	err = app.pg.Get(&pub, `
+SELECT `+pub.columns()+` FROM publications
+WHERE thing_id = $1
+    `, thingId)
+	return
+}
+
+// runPublisher publishes the queued things, forever. it's safe to run on
+// many instances at the same time.
+func (app *App) runPublisher() {
+	for {
+		worked, err := app.processPublication()
+		if err != nil {
+			log.Error().Err(err).Msg("failed to process publication queue")
+		}
+		if !worked || err != nil {
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
+
+// processPublication takes the next due publication from the queue and
+// tries to publish its thing. the row stays locked meanwhile, so if we die
+// it's just left pending for the next try.
+func (app *App) processPublication() (worked bool, err error) {
+	txn, err := app.pg.Beginx()
+	if err != nil {
+		return
+	}
+	defer txn.Rollback()
+
+	var pub Publication
+	err = txn.Get(&pub, `
+SELECT `+pub.columns()+` FROM publications
+WHERE status = 'pending' AND next_attempt <= now()
+ORDER BY next_attempt
+LIMIT 1
+FOR UPDATE SKIP LOCKED
+    `)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return
+	}
+
+	var thing Thing
+	err = app.pg.Get(&thing, `
+SELECT `+thing.columns()+` FROM things
+WHERE id = $1
+    `, pub.ThingId)
+	if err != nil {
+		return
+	}
+
+	status := "pending"
+	var perr error
+	if !thing.Publishable && thing.Transaction == "" {
+		// someone took back their confirmation
+		status = "failed"
+	} else {
+		var published bool
+		published, perr = thing.publish(app)
+		if published {
+			status = "confirmed"
+		} else if perr == nil {
+			status = "submitted"
+		} else if pub.Attempts+1 >= maxPublicationAttempts {
+			status = "failed"
+		}
+	}
+
+	var lastError string
+	if perr != nil {
+		lastError = perr.Error()
+	} else if status == "failed" {
+		lastError = "not confirmed by all parties"
+	}
+
+	// 30 seconds, 1 minute, 2 minutes... up to an hour
+	backoff := 30 * time.Second << uint(pub.Attempts)
+	if backoff > time.Hour || backoff <= 0 {
+		backoff = time.Hour
+	}
+
+	log.Info().
+		Str("thing", pub.ThingId).
+		Str("status", status).
+		Int("attempt", pub.Attempts+1).
+		Str("error", lastError).
+		Msg("publication attempt")
+
+	_, err = txn.Exec(`
+UPDATE publications SET
+  status = $2,
+  attempts = attempts + 1,
+  next_attempt = now() + $3 * interval '1 second',
+  last_error = nullable($4),
+  updated_at = now()
+WHERE thing_id = $1
+    `, pub.ThingId, status, int(backoff.Seconds()), lastError)
+	if err != nil {
+		return
+	}
+
+	return true, txn.Commit()
+}
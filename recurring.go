@@ -0,0 +1,454 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/lucsky/cuid"
+)
+
+// recurring things are templates from which a new thing is created on each
+// occurrence of their schedule, which is either "monthly", "weekly" or a
+// cron expression (see cron.go). parties that opted in have their
+// confirmation set automatically on the created things, until the parties
+// or the amounts of the template change.
+type RecurringThing struct {
+	Id          string    `json:"id"         db:"id"`
+	CreatedBy   string    `json:"created_by" db:"created_by"`
+	Name        string    `json:"name"       db:"name"`
+	Asset       string    `json:"asset"      db:"asset"`
+	TotalDue    string    `json:"total_due"  db:"total_due"`
+	SplitMode   string    `json:"split_mode" db:"split_mode"`
+	Schedule    string    `json:"schedule"   db:"schedule"`
+	StartsAt    time.Time `json:"-"          db:"starts_at"`
+	NextRun     time.Time `json:"-"          db:"next_run"`
+	Active      bool      `json:"active"     db:"active"`
+	PartiesJSON string    `json:"-"          db:"parties"`
+	ItemsJSON   string    `json:"-"          db:"items"`
+}
+
+type RecurringParty struct {
+	Account     string `json:"account"`
+	Paid        string `json:"paid"`
+	Due         string `json:"due"`
+	Weight      string `json:"weight"`
+	AutoConfirm bool   `json:"autoconfirm"`
+}
+
+func (rt RecurringThing) columns() string {
+	return `
+recurring_things.id,
+created_by,
+coalesce(name, '') AS name,
+asset,
+coalesce(total_due, '') AS total_due,
+split_mode,
+schedule,
+starts_at,
+next_run,
+active,
+parties::text AS parties,
+items::text AS items
+    `
+}
+
+// the parties and items in the same format taken by insertThing.
+func (rt RecurringThing) inputParties() (parties []interface{}, items []interface{}, err error) {
+	err = json.Unmarshal([]byte(rt.PartiesJSON), &parties)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal([]byte(rt.ItemsJSON), &items)
+	return
+}
+
+func (rt RecurringThing) parties(app *App) (parties []RecurringParty, err error) {
+	err = json.Unmarshal([]byte(rt.PartiesJSON), &parties)
+	if err != nil {
+		return
+	}
+
+	var autoconfirm []string
+	err = app.pg.Select(&autoconfirm, `
+SELECT user_id FROM recurring_autoconfirm
+WHERE recurring_id = $1
+    `, rt.Id)
+	if err != nil {
+		return
+	}
+	for i := range parties {
+		for _, userId := range autoconfirm {
+			if parties[i].Account == userId {
+				parties[i].AutoConfirm = true
+			}
+		}
+	}
+	return
+}
+
+// upcoming returns the next `count` dates on which things will be created.
+func (rt RecurringThing) upcoming(count int) (dates []time.Time, err error) {
+	if !rt.Active {
+		return
+	}
+
+	next := rt.NextRun
+	for i := 0; i < count; i++ {
+		dates = append(dates, next)
+		next, err = nextOccurrence(rt.Schedule, rt.StartsAt, next)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// nextOccurrence returns the first occurrence of `schedule` after `after`.
+// monthly and weekly schedules are counted from `anchor`, so a thing that
+// starts on the 31st happens on the last day of shorter months.
+func nextOccurrence(schedule string, anchor, after time.Time) (time.Time, error) {
+	switch schedule {
+	case "monthly":
+		for k := 0; ; k++ {
+			next := addMonthsClamped(anchor, k)
+			if next.After(after) {
+				return next, nil
+			}
+		}
+	case "weekly":
+		for k := 0; ; k++ {
+			next := anchor.AddDate(0, 0, 7*k)
+			if next.After(after) {
+				return next, nil
+			}
+		}
+	default:
+		cron, err := parseCron(schedule)
+		if err != nil {
+			return after, err
+		}
+		return cron.next(after)
+	}
+}
+
+func addMonthsClamped(t time.Time, months int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(months), 1,
+		t.Hour(), t.Minute(), t.Second(), 0, t.Location())
+	lastDay := first.AddDate(0, 1, -1).Day()
+
+	day := t.Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+func (app *App) getRecurringThing(id string) (rt RecurringThing, err error) {
+	err = app.pg.Get(&rt, `
+SELECT `+rt.columns()+` FROM recurring_things
+WHERE id = $1
+    `, id)
+	if err == sql.ErrNoRows {
+		err = errThingNotFound
+	}
+	return
+}
+
+// setRecurringThing creates or updates a template. the template is validated
+// by inserting a thing with it on a transaction that is then rolled back.
+func (app *App) setRecurringThing(
+	id, userId, name, asset, total_due, split_mode, schedule, starts string,
+	parties []interface{},
+	items []interface{},
+) (rt RecurringThing, err error) {
+	if id != "" {
+		rt, err = app.getRecurringThing(id)
+		if err != nil {
+			return
+		}
+		if rt.CreatedBy != userId {
+			return rt, errNotAllowed
+		}
+	}
+
+	startsAt := time.Now().UTC()
+	if starts != "" {
+		startsAt, err = time.Parse("2006-01-02", starts)
+		if err != nil {
+			return rt, errors.New("invalid-date")
+		}
+	}
+
+	// past occurrences are not created
+	from := startsAt
+	if now := time.Now().UTC(); from.Before(now) {
+		from = now
+	}
+	nextRun, err := nextOccurrence(schedule, startsAt, from.Add(-time.Minute))
+	if err != nil {
+		return rt, errors.New("invalid-schedule")
+	}
+
+	if split_mode == "" {
+		split_mode = "equal"
+	}
+	if items == nil {
+		items = []interface{}{}
+	}
+
+	partiesJSON, err := json.Marshal(parties)
+	if err != nil {
+		return
+	}
+	itemsJSON, err := json.Marshal(items)
+	if err != nil {
+		return
+	}
+
+	err = app.validateThing(userId, name, asset, total_due, split_mode, parties, items)
+	if err != nil {
+		return
+	}
+
+	if id == "" {
+		id = cuid.Slug()
+	}
+
+	txn, err := app.pg.Beginx()
+	if err != nil {
+		return
+	}
+	defer txn.Rollback()
+
+	// parties opted in to confirm what the template was, not what it becomes
+	_, err = txn.Exec(`
+DELETE FROM recurring_autoconfirm
+WHERE recurring_id = $1 AND EXISTS (
+  SELECT 1 FROM recurring_things
+  WHERE id = $1 AND (
+    asset != $2
+    OR coalesce(total_due, '') != $3
+    OR split_mode != $4
+    OR parties != $5::jsonb
+    OR items != $6::jsonb
+  )
+)
+    `, id, asset, total_due, split_mode, string(partiesJSON), string(itemsJSON))
+	if err != nil {
+		log.Warn().Err(err).Str("id", id).Msg("failed to reset recurring autoconfirm")
+		return
+	}
+
+	err = txn.Get(&rt, `
+INSERT INTO recurring_things
+  (id, created_by, name, asset, total_due, schedule, starts_at, next_run,
+   parties, split_mode, items)
+VALUES ($1, $2, nullable($3), $4, nullable($5), $6, $7, $8,
+        $9::jsonb, $10, $11::jsonb)
+ON CONFLICT (id) DO UPDATE SET
+  name = excluded.name,
+  asset = excluded.asset,
+  total_due = excluded.total_due,
+  split_mode = excluded.split_mode,
+  items = excluded.items,
+  schedule = excluded.schedule,
+  starts_at = excluded.starts_at,
+  next_run = excluded.next_run,
+  parties = excluded.parties,
+  active = true
+RETURNING `+rt.columns(),
+		id, userId, name, asset, total_due, schedule, startsAt, nextRun,
+		string(partiesJSON), split_mode, string(itemsJSON))
+	if err != nil {
+		log.Warn().Err(err).Str("id", id).Msg("failed to save recurring thing")
+		return
+	}
+
+	return rt, txn.Commit()
+}
+
+// validateThing checks that a thing with these values could be created,
+// running the thing_totals constraints immediately and then discarding it.
+func (app *App) validateThing(
+	userId, name, asset, total_due, split_mode string,
+	parties []interface{},
+	items []interface{},
+) error {
+	txn, err := app.pg.Beginx()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	_, err = insertThing(txn,
+		cuid.Slug(), time.Now().Format("2006-01-02"),
+		userId, userId, name, asset, total_due, split_mode, parties, items)
+	if err != nil {
+		return err
+	}
+	_, err = txn.Exec(`SET CONSTRAINTS ALL IMMEDIATE`)
+	return err
+}
+
+func (app *App) deleteRecurringThing(id, userId string) error {
+	rt, err := app.getRecurringThing(id)
+	if err != nil {
+		return err
+	}
+	if rt.CreatedBy != userId {
+		return errNotAllowed
+	}
+
+	_, err = app.pg.Exec(`
+WITH da AS ( DELETE FROM recurring_autoconfirm WHERE recurring_id = $1 )
+DELETE FROM recurring_things WHERE id = $1
+    `, id)
+	return err
+}
+
+// setRecurringAutoConfirm lets a party opt in or out of having their
+// confirmation set automatically on the things created from a template.
+func (app *App) setRecurringAutoConfirm(id, userId string, autoconfirm bool) error {
+	rt, err := app.getRecurringThing(id)
+	if err != nil {
+		return err
+	}
+	parties, err := rt.parties(app)
+	if err != nil {
+		return err
+	}
+
+	isParty := false
+	for _, party := range parties {
+		if party.Account == userId {
+			isParty = true
+		}
+	}
+	if !isParty {
+		return errNotAllowed
+	}
+
+	if autoconfirm {
+		_, err = app.pg.Exec(`
+INSERT INTO recurring_autoconfirm (recurring_id, user_id) VALUES ($1, $2)
+ON CONFLICT DO NOTHING
+        `, id, userId)
+	} else {
+		_, err = app.pg.Exec(`
+DELETE FROM recurring_autoconfirm WHERE recurring_id = $1 AND user_id = $2
+        `, id, userId)
+	}
+	return err
+}
+
+// runScheduler creates the things from recurring templates that are due,
+// forever. it's safe to run on many instances at the same time.
+func (app *App) runScheduler() {
+	for {
+		var due []string
+		err := app.pg.Select(&due, `
+SELECT id FROM recurring_things
+WHERE active AND next_run <= now()
+        `)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to load due recurring things")
+		}
+
+		for _, id := range due {
+			err = app.instantiateRecurringThing(id)
+			if err != nil {
+				log.Error().Err(err).Str("recurring", id).
+					Msg("failed to create thing from recurring thing")
+			}
+		}
+
+		time.Sleep(time.Minute)
+	}
+}
+
+func (app *App) instantiateRecurringThing(id string) error {
+	txn, err := app.pg.Beginx()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	var rt RecurringThing
+	err = txn.Get(&rt, `
+SELECT `+rt.columns()+` FROM recurring_things
+WHERE id = $1 AND active AND next_run <= now()
+FOR UPDATE SKIP LOCKED
+    `, id)
+	if err == sql.ErrNoRows {
+		// someone else is taking care of it
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	parties, items, err := rt.inputParties()
+	if err != nil {
+		return err
+	}
+
+	thing, err := insertThing(txn,
+		cuid.Slug(), rt.NextRun.Format("2006-01-02"),
+		rt.CreatedBy, rt.CreatedBy, rt.Name, rt.Asset, rt.TotalDue, rt.SplitMode,
+		parties, items)
+	if err != nil {
+		return err
+	}
+
+	_, err = txn.Exec(`
+UPDATE parties SET confirmed = true
+WHERE thing_id = $1 AND user_id IN (
+  SELECT user_id FROM recurring_autoconfirm WHERE recurring_id = $2
+)
+    `, thing.Id, rt.Id)
+	if err != nil {
+		return err
+	}
+
+	next, err := nextOccurrence(rt.Schedule, rt.StartsAt, rt.NextRun)
+	if err != nil {
+		return err
+	}
+	_, err = txn.Exec(`
+UPDATE recurring_things SET next_run = $2 WHERE id = $1
+    `, rt.Id, next)
+	if err != nil {
+		return err
+	}
+
+	// everybody may have auto-confirmed
+	var publishable bool
+	err = txn.Get(&publishable, `
+SELECT things.publishable FROM things
+WHERE id = $1
+    `, thing.Id)
+	if err != nil {
+		return err
+	}
+	if publishable {
+		err = enqueuePublication(txn, thing.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return err
+	}
+
+	log.Info().
+		Str("recurring", rt.Id).
+		Str("thing", thing.Id).
+		Str("next", next.Format(time.RFC3339)).
+		Bool("publishable", publishable).
+		Msg("created thing from recurring thing")
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAddMonthsClamped(t *testing.T) {
+	for _, test := range []struct {
+		from   string
+		months int
+		want   string
+	}{
+		{"2017-01-15 10:30", 1, "2017-02-15 10:30"},
+		{"2017-01-31 10:30", 1, "2017-02-28 10:30"},
+		{"2016-01-31 10:30", 1, "2016-02-29 10:30"},
+		{"2017-01-31 10:30", 3, "2017-04-30 10:30"},
+		{"2017-01-31 10:30", 2, "2017-03-31 10:30"},
+		{"2017-11-30 00:00", 3, "2018-02-28 00:00"},
+		{"2016-02-29 00:00", 12, "2017-02-28 00:00"},
+		{"2016-02-29 00:00", 48, "2020-02-29 00:00"},
+		{"2017-03-31 00:00", -1, "2017-02-28 00:00"},
+		{"2017-03-31 00:00", 0, "2017-03-31 00:00"},
+	} {
+		got := addMonthsClamped(date(test.from), test.months)
+		if !got.Equal(date(test.want)) {
+			t.Errorf("%s + %d months: got %s, want %s",
+				test.from, test.months, got.Format("2006-01-02 15:04"), test.want)
+		}
+	}
+}
+
+func TestNextOccurrence(t *testing.T) {
+	for _, test := range []struct {
+		schedule string
+		anchor   string
+		after    string
+		want     string
+	}{
+		// monthly things keep their day when months are long enough
+		{"monthly", "2017-01-31 09:00", "2017-01-31 09:00", "2017-02-28 09:00"},
+		{"monthly", "2017-01-31 09:00", "2017-02-28 09:00", "2017-03-31 09:00"},
+		{"monthly", "2017-01-31 09:00", "2017-04-15 00:00", "2017-04-30 09:00"},
+		{"monthly", "2016-01-30 09:00", "2016-02-01 00:00", "2016-02-29 09:00"},
+		{"monthly", "2017-03-15 09:00", "2017-01-01 00:00", "2017-03-15 09:00"},
+
+		{"weekly", "2017-03-01 09:00", "2017-03-01 09:00", "2017-03-08 09:00"},
+		{"weekly", "2017-03-01 09:00", "2017-03-20 00:00", "2017-03-22 09:00"},
+		{"weekly", "2017-03-01 09:00", "2017-02-01 00:00", "2017-03-01 09:00"},
+
+		// anything else is cron, which ignores the anchor
+		{"0 9 * * 1", "2017-03-01 00:00", "2017-03-01 00:00", "2017-03-06 09:00"},
+	} {
+		got, err := nextOccurrence(test.schedule, date(test.anchor), date(test.after))
+		if err != nil {
+			t.Errorf("%s from %s after %s: %v", test.schedule, test.anchor, test.after, err)
+			continue
+		}
+		if !got.Equal(date(test.want)) {
+			t.Errorf("%s from %s after %s: got %s, want %s",
+				test.schedule, test.anchor, test.after,
+				got.Format("2006-01-02 15:04"), test.want)
+		}
+	}
+
+	if _, err := nextOccurrence("fortnightly", date("2017-03-01 00:00"),
+		date("2017-03-01 00:00")); err == nil {
+		t.Error("fortnightly isn't a schedule")
+	}
+}
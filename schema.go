@@ -1,13 +1,17 @@
 package main
 
 import (
+	"database/sql"
 	"errors"
 	"strings"
+	"time"
 
 	"github.com/graphql-go/graphql"
 	"github.com/lucsky/cuid"
+	"github.com/shopspring/decimal"
 	b "github.com/stellar/go/build"
 	"github.com/stellar/go/clients/horizon"
+	"github.com/stellar/go/strkey"
 )
 
 var queries = graphql.Fields{
@@ -17,18 +21,20 @@ var queries = graphql.Fields{
 			"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
 		},
 		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			app := p.Context.Value("app").(*App)
+
 			var userId = p.Args["id"].(string)
 			if userId == "me" {
 				userId = p.Context.Value("userId").(string)
 			}
 
-			u, err := ensureUser(userId)
+			u, err := app.ensureUser(userId)
 			if err != nil {
 				return nil, err
 			}
 
 			// this will be used by subqueries on UserType
-			ha, _ := h.LoadAccount(u.Address)
+			ha, _ := app.h.LoadAccount(u.Address)
 			u.ha = ha
 
 			return u, nil
@@ -40,10 +46,12 @@ var queries = graphql.Fields{
 			"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
 		},
 		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			app := p.Context.Value("app").(*App)
+
 			thingId := p.Args["id"].(string)
 
 			var thing Thing
-			err = pg.Get(&thing, `
+			err := app.pg.Get(&thing, `
 SELECT `+thing.columns()+` FROM things
 WHERE id = $1 LIMIT 1
         `, thingId)
@@ -54,6 +62,87 @@ WHERE id = $1 LIMIT 1
 			return thing, err
 		},
 	},
+	"statement": &graphql.Field{
+		Type: graphql.NewList(statementEntryType),
+		Args: graphql.FieldConfigArgument{
+			"with": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+			"from": &graphql.ArgumentConfig{Type: graphql.String},
+			"to":   &graphql.ArgumentConfig{Type: graphql.String},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			app := p.Context.Value("app").(*App)
+
+			userId, ok := p.Context.Value("userId").(string)
+			if !ok {
+				return nil, errors.New("no-logged-user")
+			}
+
+			from, _ := p.Args["from"].(string)
+			to, _ := p.Args["to"].(string)
+			return app.statement(userId, p.Args["with"].(string), from, to)
+		},
+	},
+	"addressChallenge": &graphql.Field{
+		Type: graphql.String,
+		Args: graphql.FieldConfigArgument{
+			"address": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			app := p.Context.Value("app").(*App)
+
+			// a SEP-10 challenge to be signed and given to setAddress.
+			if _, ok := p.Context.Value("userId").(string); !ok {
+				return nil, errors.New("no-logged-user")
+			}
+
+			address := p.Args["address"].(string)
+			_, err := strkey.Decode(strkey.VersionByteAccountID, address)
+			if err != nil {
+				return nil, errors.New("invalid-address")
+			}
+
+			return sep10Auth{app.s, app.h, app.n}.challenge(address)
+		},
+	},
+	"settlementPlan": &graphql.Field{
+		Type: settlementPlanType,
+		Args: graphql.FieldConfigArgument{
+			"id": &graphql.ArgumentConfig{Type: graphql.String},
+			"users": &graphql.ArgumentConfig{
+				Type: graphql.NewList(graphql.String),
+			},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			app := p.Context.Value("app").(*App)
+
+			userId, ok := p.Context.Value("userId").(string)
+			if !ok {
+				return nil, errors.New("no-logged-user")
+			}
+
+			// a proposed plan, or a preview of the plan for these users
+			if id, _ := p.Args["id"].(string); id != "" {
+				plan, err := app.getSettlementPlan(id)
+				if err != nil {
+					return nil, err
+				}
+				if !plan.isMember(userId) {
+					return nil, errNotAllowed
+				}
+				return plan, nil
+			}
+
+			users, _ := p.Args["users"].([]interface{})
+			ids, err := app.settlementGroup(userId, users)
+			if err != nil {
+				return nil, err
+			}
+
+			return app.buildSettlementPlan(ids)
+		},
+	},
 }
 
 var userType = graphql.NewObject(
@@ -63,6 +152,12 @@ var userType = graphql.NewObject(
 			"id":            &graphql.Field{Type: graphql.String},
 			"address":       &graphql.Field{Type: graphql.String},
 			"default_asset": &graphql.Field{Type: graphql.String},
+			"custodial": &graphql.Field{
+				Type: graphql.Boolean,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(User).custodial(), nil
+				},
+			},
 			"balances": &graphql.Field{
 				Type: graphql.NewList(balanceType),
 				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
@@ -91,6 +186,8 @@ var userType = graphql.NewObject(
 			"things": &graphql.Field{
 				Type: graphql.NewList(thingType),
 				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					app := p.Context.Value("app").(*App)
+
 					loggedUserId, ok := p.Context.Value("userId").(string)
 					if !ok {
 						return nil, nil
@@ -101,7 +198,7 @@ var userType = graphql.NewObject(
 					things := []Thing{}
 					var err error
 					if user.Id != loggedUserId {
-						err = pg.Select(&things, `
+						err = app.pg.Select(&things, `
 SELECT `+(Thing{}).columns()+` FROM
   (SELECT thing_id, count(user_id)
    FROM parties
@@ -113,7 +210,7 @@ WHERE x.count >= 2
 ORDER BY actual_date DESC
 `, user.Id, loggedUserId)
 					} else {
-						err = pg.Select(&things, `
+						err = app.pg.Select(&things, `
 SELECT `+(Thing{}).columns()+` FROM things
 INNER JOIN parties ON things.id = parties.thing_id
 WHERE parties.user_id = $1
@@ -132,9 +229,56 @@ ORDER BY actual_date DESC
 					return things, err
 				},
 			},
+			"counterparties": &graphql.Field{
+				Type: graphql.NewList(counterpartyType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					app := p.Context.Value("app").(*App)
+
+					user := p.Source.(User)
+					loggedUserId, ok := p.Context.Value("userId").(string)
+					if !ok || loggedUserId != user.Id {
+						return []Counterparty{}, nil
+					}
+
+					return app.counterparties(user)
+				},
+			},
+			"settlements": &graphql.Field{
+				Type: graphql.NewList(settlementType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					app := p.Context.Value("app").(*App)
+
+					loggedUserId, ok := p.Context.Value("userId").(string)
+					if !ok {
+						return nil, nil
+					}
+
+					user := p.Source.(User)
+
+					// between the two users or, on their own page, all of them
+					settlements := []Settlement{}
+					err := app.pg.Select(&settlements, `
+SELECT `+(Settlement{}).columns()+` FROM settlements
+WHERE (payer = $1 OR payee = $1)
+  AND ($1 = $2 OR payer = $2 OR payee = $2)
+ORDER BY actual_date DESC
+                    `, user.Id, loggedUserId)
+					if err != nil {
+						log.Error().Err(err).
+							Str("logged", loggedUserId).
+							Str("user", user.Id).
+							Msg("on user settlements query")
+						err = nil
+					}
+
+					return settlements, err
+				},
+			},
 			"friends": &graphql.Field{
 				Type: graphql.NewList(graphql.String),
 				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					app := p.Context.Value("app").(*App)
+
 					friends := []string{}
 
 					user := p.Source.(User)
@@ -143,7 +287,7 @@ ORDER BY actual_date DESC
 						return friends, nil
 					}
 
-					err := pg.Select(&friends, `
+					err := app.pg.Select(&friends, `
 SELECT friend FROM friends
 WHERE main = $1
 ORDER BY score DESC
@@ -156,9 +300,38 @@ ORDER BY score DESC
 					return friends, nil
 				},
 			},
+			"recurring": &graphql.Field{
+				Type: graphql.NewList(recurringThingType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					app := p.Context.Value("app").(*App)
+
+					recurring := []RecurringThing{}
+
+					user := p.Source.(User)
+					loggedUserId, ok := p.Context.Value("userId").(string)
+					if !ok || loggedUserId != user.Id {
+						return recurring, nil
+					}
+
+					err := app.pg.Select(&recurring, `
+SELECT `+(RecurringThing{}).columns()+` FROM recurring_things
+WHERE created_by = $1
+   OR parties @> jsonb_build_array(jsonb_build_object('account', $1::text))
+ORDER BY next_run
+                    `, user.Id)
+					if err != nil {
+						log.Warn().Err(err).Str("user", user.Id).
+							Msg("failed to load recurring things")
+					}
+
+					return recurring, nil
+				},
+			},
 			"paths": &graphql.Field{
 				Type: graphql.NewList(pathType),
 				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					app := p.Context.Value("app").(*App)
+
 					paths := []Path{}
 
 					user := p.Source.(User)
@@ -166,7 +339,7 @@ ORDER BY score DESC
 					if !ok || loggedUserId == user.Id {
 						return paths, nil
 					}
-					me, _ := getExistingUser(loggedUserId)
+					me, _ := app.getExistingUser(loggedUserId)
 
 					assetCodes := map[string]bool{
 						user.DefaultAsset: true,
@@ -178,7 +351,7 @@ ORDER BY score DESC
 					}
 
 					for code := range assetCodes {
-						data, err := findPaths(
+						data, err := app.h.FindPaths(
 							me.Address,
 							user.Address,
 							Asset{code, user.Address, ""},
@@ -251,12 +424,14 @@ var assetType = graphql.NewObject(
 			"issuer_id": &graphql.Field{
 				Type: graphql.String,
 				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					app := p.Context.Value("app").(*App)
+
 					asset := p.Source.(Asset)
 
 					/* replace the code here with some faster call to an
 					   in-memory hashmap of addresses->ids */
 
-					err := pg.Get(
+					err := app.pg.Get(
 						&asset.IssuerId,
 						"SELECT id FROM users WHERE address = $1",
 						asset.IssuerAddress,
@@ -287,15 +462,126 @@ var thingType = graphql.NewObject(
 			"total_due":     &graphql.Field{Type: graphql.String},
 			"total_due_set": &graphql.Field{Type: graphql.Boolean},
 			"txn":           &graphql.Field{Type: graphql.String},
+			"transactions": &graphql.Field{
+				Type: graphql.NewList(graphql.String),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					app := p.Context.Value("app").(*App)
+
+					// hashes of the transactions applied so far, in order
+					thing := p.Source.(Thing)
+					planned, err := thing.plannedTransactions(app)
+					if err != nil {
+						return nil, err
+					}
+					hashes := []string{}
+					for _, ttx := range planned {
+						if ttx.Hash != "" {
+							hashes = append(hashes, ttx.Hash)
+						}
+					}
+					if len(planned) == 0 && thing.Transaction != "" {
+						// published before things could have many
+						hashes = append(hashes, thing.Transaction)
+					}
+					return hashes, nil
+				},
+			},
+			"fee": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					app := p.Context.Value("app").(*App)
+
+					// in lumens, for all the transactions applied so far
+					fee, err := p.Source.(Thing).feeCharged(app)
+					return fee.String(), err
+				},
+			},
 			"parties": &graphql.Field{
 				Type: graphql.NewList(partyType),
 				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					app := p.Context.Value("app").(*App)
+
 					thing := p.Source.(Thing)
-					err := thing.fillParties()
+					err := thing.fillParties(app)
 					return thing.Parties, err
 				},
 			},
 			"publishable": &graphql.Field{Type: graphql.Boolean},
+			"split_mode":  &graphql.Field{Type: graphql.String},
+			"items": &graphql.Field{
+				Type: graphql.NewList(itemType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					app := p.Context.Value("app").(*App)
+
+					thing := p.Source.(Thing)
+					err := thing.fillItems(app)
+					return thing.Items, err
+				},
+			},
+			"envelope": &graphql.Field{Type: graphql.String},
+			"pending_signers": &graphql.Field{
+				Type: graphql.NewList(graphql.String),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					app := p.Context.Value("app").(*App)
+
+					thing := p.Source.(Thing)
+					if thing.Envelope == "" {
+						return []string{}, nil
+					}
+					return app.pendingSigners(thing.Id)
+				},
+			},
+			"sep7": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					app := p.Context.Value("app").(*App)
+
+					thing := p.Source.(Thing)
+					if thing.Envelope == "" {
+						return nil, nil
+					}
+					return app.sep7URI("thing", thing.Id, thing.Envelope), nil
+				},
+			},
+			"publication": &graphql.Field{
+				Type: publicationType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					app := p.Context.Value("app").(*App)
+
+					pub, err := app.getPublication(p.Source.(Thing).Id)
+					if err == sql.ErrNoRows {
+						return nil, nil
+					}
+					return pub, err
+				},
+			},
+		},
+	},
+)
+
+var publicationType = graphql.NewObject(
+	graphql.ObjectConfig{
+		Name: "PublicationType",
+		Fields: graphql.Fields{
+			"status":     &graphql.Field{Type: graphql.String},
+			"attempts":   &graphql.Field{Type: graphql.Int},
+			"last_error": &graphql.Field{Type: graphql.String},
+			"next_attempt": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					pub := p.Source.(Publication)
+					if pub.Status != "pending" {
+						return nil, nil
+					}
+					return pub.NextAttempt.Format(time.RFC3339), nil
+				},
+			},
+			"updated_at": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(Publication).UpdatedAt.Format(time.RFC3339), nil
+				},
+			},
 		},
 	},
 )
@@ -310,6 +596,8 @@ var partyType = graphql.NewObject(
 			"paid":         &graphql.Field{Type: graphql.String},
 			"due":          &graphql.Field{Type: graphql.String},
 			"due_set":      &graphql.Field{Type: graphql.Boolean},
+			"weight":       &graphql.Field{Type: graphql.String},
+			"weight_set":   &graphql.Field{Type: graphql.Boolean},
 			"note":         &graphql.Field{Type: graphql.String},
 			"added_by":     &graphql.Field{Type: graphql.String},
 			"confirmed":    &graphql.Field{Type: graphql.Boolean},
@@ -317,77 +605,353 @@ var partyType = graphql.NewObject(
 	},
 )
 
-var inputPartyType = graphql.NewInputObject(
-	graphql.InputObjectConfig{
-		Name: "InputPartyType",
-		Fields: graphql.InputObjectConfigFieldMap{
-			"account": &graphql.InputObjectFieldConfig{Type: graphql.String},
-			"paid":    &graphql.InputObjectFieldConfig{Type: graphql.String},
-			"due":     &graphql.InputObjectFieldConfig{Type: graphql.String},
+var counterpartyType = graphql.NewObject(
+	graphql.ObjectConfig{
+		Name: "CounterpartyType",
+		Fields: graphql.Fields{
+			"user":     &graphql.Field{Type: graphql.String},
+			"balances": &graphql.Field{Type: graphql.NewList(netBalanceType)},
 		},
 	},
 )
 
-var mutations = graphql.Fields{
-	"setThing": &graphql.Field{
-		Type: resultType,
-		Args: graphql.FieldConfigArgument{
-			"id":   &graphql.ArgumentConfig{Type: graphql.String},
-			"date": &graphql.ArgumentConfig{Type: graphql.String},
-			"name": &graphql.ArgumentConfig{Type: graphql.String},
-			"asset": &graphql.ArgumentConfig{
-				Type: graphql.NewNonNull(graphql.String),
+var netBalanceType = graphql.NewObject(
+	graphql.ObjectConfig{
+		Name: "NetBalanceType",
+		Fields: graphql.Fields{
+			"asset":  &graphql.Field{Type: graphql.String},
+			"amount": &graphql.Field{Type: graphql.String},
+		},
+	},
+)
+
+var statementEntryType = graphql.NewObject(
+	graphql.ObjectConfig{
+		Name: "StatementEntryType",
+		Fields: graphql.Fields{
+			"date": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(StatementEntry).Date.Format(time.RFC3339), nil
+				},
 			},
-			"total_due": &graphql.ArgumentConfig{Type: graphql.String},
-			"parties": &graphql.ArgumentConfig{
-				Type: graphql.NewNonNull(graphql.NewList(
-					graphql.NewNonNull(inputPartyType),
-				)),
+			"kind":        &graphql.Field{Type: graphql.String},
+			"id":          &graphql.Field{Type: graphql.String},
+			"description": &graphql.Field{Type: graphql.String},
+			"asset":       &graphql.Field{Type: graphql.String},
+			"amount":      &graphql.Field{Type: graphql.String},
+			"balance":     &graphql.Field{Type: graphql.String},
+			"txn":         &graphql.Field{Type: graphql.String},
+		},
+	},
+)
+
+var settlementType = graphql.NewObject(
+	graphql.ObjectConfig{
+		Name: "SettlementType",
+		Fields: graphql.Fields{
+			"id":              &graphql.Field{Type: graphql.String},
+			"created_at":      &graphql.Field{Type: graphql.String},
+			"created_by":      &graphql.Field{Type: graphql.String},
+			"payer":           &graphql.Field{Type: graphql.String},
+			"payee":           &graphql.Field{Type: graphql.String},
+			"asset":           &graphql.Field{Type: graphql.String},
+			"amount":          &graphql.Field{Type: graphql.String},
+			"method":          &graphql.Field{Type: graphql.String},
+			"reference":       &graphql.Field{Type: graphql.String},
+			"actual_date":     &graphql.Field{Type: graphql.String},
+			"payer_confirmed": &graphql.Field{Type: graphql.Boolean},
+			"payee_confirmed": &graphql.Field{Type: graphql.Boolean},
+			"txn":             &graphql.Field{Type: graphql.String},
+			"envelope": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					settlement := p.Source.(Settlement)
+					if !settlement.AwaitingSignature {
+						return nil, nil
+					}
+					return settlement.Envelope, nil
+				},
+			},
+			"sep7": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					app := p.Context.Value("app").(*App)
+
+					settlement := p.Source.(Settlement)
+					if !settlement.AwaitingSignature {
+						return nil, nil
+					}
+					return app.sep7URI("settlement", settlement.Id, settlement.Envelope), nil
+				},
 			},
 		},
-		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-			userId, ok := p.Context.Value("userId").(string)
-			if ok {
-				_, err := ensureUser(userId)
-				if err != nil {
-					return nil, err
-				}
-			}
+	},
+)
 
-			thingId, _ := p.Args["id"].(string)
-			date, _ := p.Args["date"].(string)
-			name, _ := p.Args["name"].(string)
-			total_due, _ := p.Args["total_due"].(string)
-			asset := p.Args["asset"].(string)
-			parties := p.Args["parties"].([]interface{})
+var importedThingType = graphql.NewObject(
+	graphql.ObjectConfig{
+		Name: "ImportedThingType",
+		Fields: graphql.Fields{
+			"row":     &graphql.Field{Type: graphql.Int},
+			"id":      &graphql.Field{Type: graphql.String},
+			"date":    &graphql.Field{Type: graphql.String},
+			"name":    &graphql.Field{Type: graphql.String},
+			"asset":   &graphql.Field{Type: graphql.String},
+			"parties": &graphql.Field{Type: graphql.NewList(importedPartyType)},
+		},
+	},
+)
 
-			log.Info().
-				Str("id", thingId).
-				Str("date", date).
-				Str("name", name).
-				Str("asset", asset).
-				Str("total_due", total_due).
-				Int("nparties", len(parties)).
-				Msg("creating thing")
+var importedPartyType = graphql.NewObject(
+	graphql.ObjectConfig{
+		Name: "ImportedPartyType",
+		Fields: graphql.Fields{
+			"account": &graphql.Field{Type: graphql.String},
+			"paid":    &graphql.Field{Type: graphql.String},
+			"due":     &graphql.Field{Type: graphql.String},
+		},
+	},
+)
 
-			var thing Thing
-			txn, err := pg.Beginx()
-			if err != nil {
-				return nil, err
-			}
-			defer txn.Rollback()
-			if thingId != "" {
-				err = deleteThing(txn, thingId)
-				if err != nil {
-					log.Warn().Err(err).Msg("failed to delete thing")
-					return nil, err
-				}
+var inputSplitwiseMemberType = graphql.NewInputObject(
+	graphql.InputObjectConfig{
+		Name: "InputSplitwiseMemberType",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"name": &graphql.InputObjectFieldConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+			"account": &graphql.InputObjectFieldConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+		},
+	},
+)
+
+var settlementPlanType = graphql.NewObject(
+	graphql.ObjectConfig{
+		Name: "SettlementPlanType",
+		Fields: graphql.Fields{
+			"id":         &graphql.Field{Type: graphql.String},
+			"created_by": &graphql.Field{Type: graphql.String},
+			"txn":        &graphql.Field{Type: graphql.String},
+			"members":    &graphql.Field{Type: graphql.NewList(planMemberType)},
+			"debts":      &graphql.Field{Type: graphql.NewList(transferType)},
+			"transfers":  &graphql.Field{Type: graphql.NewList(transferType)},
+		},
+	},
+)
+
+var planMemberType = graphql.NewObject(
+	graphql.ObjectConfig{
+		Name: "PlanMemberType",
+		Fields: graphql.Fields{
+			"user":      &graphql.Field{Type: graphql.String},
+			"confirmed": &graphql.Field{Type: graphql.Boolean},
+		},
+	},
+)
+
+var transferType = graphql.NewObject(
+	graphql.ObjectConfig{
+		Name: "TransferType",
+		Fields: graphql.Fields{
+			"from":   &graphql.Field{Type: graphql.String},
+			"to":     &graphql.Field{Type: graphql.String},
+			"asset":  &graphql.Field{Type: graphql.String},
+			"amount": &graphql.Field{Type: graphql.String},
+		},
+	},
+)
+
+var recurringThingType = graphql.NewObject(
+	graphql.ObjectConfig{
+		Name: "RecurringThingType",
+		Fields: graphql.Fields{
+			"id":         &graphql.Field{Type: graphql.String},
+			"created_by": &graphql.Field{Type: graphql.String},
+			"name":       &graphql.Field{Type: graphql.String},
+			"asset":      &graphql.Field{Type: graphql.String},
+			"total_due":  &graphql.Field{Type: graphql.String},
+			"split_mode": &graphql.Field{Type: graphql.String},
+			"schedule":   &graphql.Field{Type: graphql.String},
+			"active":     &graphql.Field{Type: graphql.Boolean},
+			"starts_at": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(RecurringThing).StartsAt.Format(time.RFC3339), nil
+				},
+			},
+			"parties": &graphql.Field{
+				Type: graphql.NewList(recurringPartyType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					app := p.Context.Value("app").(*App)
+
+					return p.Source.(RecurringThing).parties(app)
+				},
+			},
+			"upcoming": &graphql.Field{
+				Type: graphql.NewList(graphql.String),
+				Args: graphql.FieldConfigArgument{
+					"count": &graphql.ArgumentConfig{
+						Type:         graphql.Int,
+						DefaultValue: 3,
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					count, _ := p.Args["count"].(int)
+					if count > 24 {
+						count = 24
+					}
+
+					dates, err := p.Source.(RecurringThing).upcoming(count)
+					upcoming := make([]string, len(dates))
+					for i, date := range dates {
+						upcoming[i] = date.Format(time.RFC3339)
+					}
+					return upcoming, err
+				},
+			},
+		},
+	},
+)
+
+var recurringPartyType = graphql.NewObject(
+	graphql.ObjectConfig{
+		Name: "RecurringPartyType",
+		Fields: graphql.Fields{
+			"account":     &graphql.Field{Type: graphql.String},
+			"paid":        &graphql.Field{Type: graphql.String},
+			"due":         &graphql.Field{Type: graphql.String},
+			"autoconfirm": &graphql.Field{Type: graphql.Boolean},
+		},
+	},
+)
+
+var inputPartyType = graphql.NewInputObject(
+	graphql.InputObjectConfig{
+		Name: "InputPartyType",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"account": &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"paid":    &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"due":     &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"weight":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+		},
+	},
+)
+
+var itemType = graphql.NewObject(
+	graphql.ObjectConfig{
+		Name: "ItemType",
+		Fields: graphql.Fields{
+			"id":          &graphql.Field{Type: graphql.Int},
+			"description": &graphql.Field{Type: graphql.String},
+			"amount":      &graphql.Field{Type: graphql.String},
+			"accounts":    &graphql.Field{Type: graphql.NewList(graphql.String)},
+		},
+	},
+)
+
+var inputItemType = graphql.NewInputObject(
+	graphql.InputObjectConfig{
+		Name: "InputItemType",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"description": &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"amount": &graphql.InputObjectFieldConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+			"accounts": &graphql.InputObjectFieldConfig{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.String)),
+			},
+		},
+	},
+)
+
+var mutations = graphql.Fields{
+	"setThing": &graphql.Field{
+		Type: resultType,
+		Args: graphql.FieldConfigArgument{
+			"id":   &graphql.ArgumentConfig{Type: graphql.String},
+			"date": &graphql.ArgumentConfig{Type: graphql.String},
+			"name": &graphql.ArgumentConfig{Type: graphql.String},
+			"asset": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+			"total_due": &graphql.ArgumentConfig{Type: graphql.String},
+			"parties": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.NewList(
+					graphql.NewNonNull(inputPartyType),
+				)),
+			},
+			"split_mode": &graphql.ArgumentConfig{Type: graphql.String},
+			"items": &graphql.ArgumentConfig{
+				Type: graphql.NewList(graphql.NewNonNull(inputItemType)),
+			},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			app := p.Context.Value("app").(*App)
+
+			userId, ok := p.Context.Value("userId").(string)
+			if !ok {
+				return nil, errors.New("no-logged-user")
+			}
+			_, err := app.ensureUser(userId)
+			if err != nil {
+				return nil, err
+			}
+
+			thingId, _ := p.Args["id"].(string)
+			date, _ := p.Args["date"].(string)
+			name, _ := p.Args["name"].(string)
+			total_due, _ := p.Args["total_due"].(string)
+			asset := p.Args["asset"].(string)
+			parties := p.Args["parties"].([]interface{})
+			split_mode, _ := p.Args["split_mode"].(string)
+			items, _ := p.Args["items"].([]interface{})
+
+			log.Info().
+				Str("id", thingId).
+				Str("date", date).
+				Str("name", name).
+				Str("asset", asset).
+				Str("total_due", total_due).
+				Str("split_mode", split_mode).
+				Int("nparties", len(parties)).
+				Int("nitems", len(items)).
+				Msg("creating thing")
+
+			// when editing, the thing keeps its original creator.
+			// all confirmations are reset, since parties are recreated.
+			createdBy := userId
+			if thingId != "" {
+				access, err := app.getThingAccess(thingId, userId)
+				if err != nil {
+					return nil, err
+				}
+				if err = access.canEdit(); err != nil {
+					return nil, err
+				}
+				createdBy = access.CreatedBy
+			}
+
+			var thing Thing
+			txn, err := app.pg.Beginx()
+			if err != nil {
+				return nil, err
+			}
+			defer txn.Rollback()
+			if thingId != "" {
+				err = deleteThing(txn, thingId)
+				if err != nil {
+					log.Warn().Err(err).Msg("failed to delete thing")
+					return nil, err
+				}
 			}
 			thingId = cuid.Slug()
 			thing, err = insertThing(
 				txn,
-				thingId, date, userId, name, asset, total_due,
-				parties)
+				thingId, date, createdBy, userId, name, asset, total_due, split_mode,
+				parties, items)
 			if err != nil {
 				log.Warn().Err(err).Msg("failed to insert thing")
 				return nil, err
@@ -408,9 +972,23 @@ var mutations = graphql.Fields{
 			"thingId": &graphql.ArgumentConfig{Type: graphql.String},
 		},
 		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-			thingId := p.Args["thingId"].(string)
+			app := p.Context.Value("app").(*App)
 
-			txn, err := pg.Beginx()
+			userId, ok := p.Context.Value("userId").(string)
+			if !ok {
+				return nil, errors.New("no-logged-user")
+			}
+
+			thingId, _ := p.Args["thingId"].(string)
+			access, err := app.getThingAccess(thingId, userId)
+			if err != nil {
+				return nil, err
+			}
+			if err = access.canDelete(); err != nil {
+				return nil, err
+			}
+
+			txn, err := app.pg.Beginx()
 			if err != nil {
 				return nil, err
 			}
@@ -438,12 +1016,26 @@ var mutations = graphql.Fields{
 			"thing_id": &graphql.ArgumentConfig{Type: graphql.String},
 		},
 		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-			// anyone can publish what should already have been published
-			// no auth. this was supposed to happen automatically on
-			// the last confirmation.
-			thingId := p.Args["thing_id"].(string)
+			app := p.Context.Value("app").(*App)
+
+			// this was supposed to happen automatically on the last
+			// confirmation, but any of the involved users can retry it.
+			userId, ok := p.Context.Value("userId").(string)
+			if !ok {
+				return nil, errors.New("no-logged-user")
+			}
+
+			thingId, _ := p.Args["thing_id"].(string)
+			access, err := app.getThingAccess(thingId, userId)
+			if err != nil {
+				return nil, err
+			}
+			if err = access.canPublish(); err != nil {
+				return nil, err
+			}
+
 			var thing Thing
-			err = pg.Get(&thing, `
+			err = app.pg.Get(&thing, `
 SELECT `+thing.columns()+` FROM things
 WHERE id = $1 LIMIT 1
         `, thingId)
@@ -452,7 +1044,7 @@ WHERE id = $1 LIMIT 1
 			}
 
 			if thing.Publishable {
-				_, err = thing.publish()
+				err = enqueuePublication(app.pg, thing.Id)
 			}
 
 			return thing.Transaction, err
@@ -465,11 +1057,13 @@ WHERE id = $1 LIMIT 1
 			"confirm":  &graphql.ArgumentConfig{Type: graphql.Boolean},
 		},
 		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			app := p.Context.Value("app").(*App)
+
 			userId, ok := p.Context.Value("userId").(string)
 			if !ok {
 				return nil, errors.New("no-logged-user")
 			}
-			_, err := ensureUser(userId)
+			_, err := app.ensureUser(userId)
 			if err != nil {
 				return nil, err
 			}
@@ -477,7 +1071,7 @@ WHERE id = $1 LIMIT 1
 			thingId := p.Args["thing_id"].(string)
 			confirm := p.Args["confirm"].(bool)
 
-			thing, published, err := confirmThing(thingId, userId, confirm)
+			thing, queued, err := app.confirmThing(thingId, userId, confirm)
 			if err != nil {
 				return nil, err
 			}
@@ -485,7 +1079,7 @@ WHERE id = $1 LIMIT 1
 			log.Info().
 				Str("thing", thingId).
 				Err(err).
-				Bool("published", published).
+				Bool("queued", queued).
 				Msg("thing confirmation")
 
 			return thing.Transaction, err
@@ -502,37 +1096,39 @@ WHERE id = $1 LIMIT 1
 			"amount":      &graphql.ArgumentConfig{Type: graphql.String},
 		},
 		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			app := p.Context.Value("app").(*App)
+
 			userId, ok := p.Context.Value("userId").(string)
 			if !ok {
 				return nil, errors.New("no-logged-user")
 			}
 
-			payer, err := getExistingUser(userId)
+			payer, err := app.getExistingUser(userId)
 			if err != nil {
 				return nil, err
 			}
-			receiver, err := getExistingUser(p.Args["dst_user"].(string))
+			receiver, err := app.getExistingUser(p.Args["dst_user"].(string))
 			if err != nil {
 				return nil, err
 			}
 
 			operations := []b.TransactionMutator{}
-			seeds := []string{s.SourceSeed}
+			seeds := []string{app.s.SourceSeed}
 
 			// the receiving user should be an existing stellar account.
-			_, err = h.LoadAccount(receiver.Address)
+			_, err = app.h.LoadAccount(receiver.Address)
 			if err != nil {
 				if herr, ok := err.(*horizon.Error); ok && herr.Response.StatusCode == 404 {
 					// if it is not, we must create it.
-					operations = append(
-						operations,
-						receiver.fundInitial(20),
-						b.SetOptions(
+					operations = append(operations, receiver.fundInitial(app, 20))
+					if receiver.custodial() {
+						_, domain := app.federationAddress(receiver.Id)
+						operations = append(operations, b.SetOptions(
 							b.SourceAccount{receiver.Address},
-							b.HomeDomain("debtmoney.xyz"),
-						),
-					)
-					seeds = append(seeds, receiver.Seed)
+							b.HomeDomain(domain),
+						))
+						seeds = append(seeds, receiver.Seed)
+					}
 				} else {
 					return nil, err
 				}
@@ -560,12 +1156,12 @@ WHERE id = $1 LIMIT 1
 			seeds = append(seeds, payer.Seed)
 
 			log.Info().Msg("publishing a path payment")
-			tx := createStellarTransaction()
+			tx := app.createStellarTransaction()
 
 			tx.Mutate(b.MemoText{"user-initiated"})
 			tx.Mutate(operations...)
 
-			hash, err := commitStellarTransaction(tx, seeds...)
+			hash, err := app.commitStellarTransaction(tx, seeds...)
 			if err != nil {
 				if herr, ok := err.(*horizon.Error); ok {
 					h, metaerr := herr.ResultCodes()
@@ -579,6 +1175,407 @@ WHERE id = $1 LIMIT 1
 				return nil, err
 			}
 
+			// it was applied anyway, so don't fail if this doesn't work
+			amount, _ := decimal.NewFromString(p.Args["amount"].(string))
+			app.recordPayment(Payment{
+				From:      payer.Id,
+				To:        receiver.Id,
+				SrcAsset:  p.Args["src_code"].(string),
+				SrcIssuer: p.Args["src_address"].(string),
+				DstAsset:  p.Args["dst_code"].(string),
+				DstIssuer: p.Args["dst_address"].(string),
+				Amount:    amount,
+				Hash:      hash,
+			})
+
+			return Result{hash}, nil
+		},
+	},
+	"setRecurringThing": &graphql.Field{
+		Type: resultType,
+		Args: graphql.FieldConfigArgument{
+			"id":   &graphql.ArgumentConfig{Type: graphql.String},
+			"name": &graphql.ArgumentConfig{Type: graphql.String},
+			"asset": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+			"total_due": &graphql.ArgumentConfig{Type: graphql.String},
+			"parties": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.NewList(
+					graphql.NewNonNull(inputPartyType),
+				)),
+			},
+			"split_mode": &graphql.ArgumentConfig{Type: graphql.String},
+			"items": &graphql.ArgumentConfig{
+				Type: graphql.NewList(graphql.NewNonNull(inputItemType)),
+			},
+			"schedule": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+			"starts": &graphql.ArgumentConfig{Type: graphql.String},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			app := p.Context.Value("app").(*App)
+
+			userId, ok := p.Context.Value("userId").(string)
+			if !ok {
+				return nil, errors.New("no-logged-user")
+			}
+
+			id, _ := p.Args["id"].(string)
+			name, _ := p.Args["name"].(string)
+			total_due, _ := p.Args["total_due"].(string)
+			starts, _ := p.Args["starts"].(string)
+			split_mode, _ := p.Args["split_mode"].(string)
+			items, _ := p.Args["items"].([]interface{})
+
+			rt, err := app.setRecurringThing(
+				id, userId, name,
+				p.Args["asset"].(string), total_due, split_mode,
+				p.Args["schedule"].(string), starts,
+				p.Args["parties"].([]interface{}), items,
+			)
+			if err != nil {
+				return nil, err
+			}
+
+			return Result{rt.Id}, nil
+		},
+	},
+	"deleteRecurringThing": &graphql.Field{
+		Type: resultType,
+		Args: graphql.FieldConfigArgument{
+			"id": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			app := p.Context.Value("app").(*App)
+
+			userId, ok := p.Context.Value("userId").(string)
+			if !ok {
+				return nil, errors.New("no-logged-user")
+			}
+
+			id := p.Args["id"].(string)
+			err := app.deleteRecurringThing(id, userId)
+			if err != nil {
+				return nil, err
+			}
+
+			return Result{id}, nil
+		},
+	},
+	"setRecurringAutoConfirm": &graphql.Field{
+		Type: resultType,
+		Args: graphql.FieldConfigArgument{
+			"id": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+			"autoconfirm": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.Boolean),
+			},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			app := p.Context.Value("app").(*App)
+
+			userId, ok := p.Context.Value("userId").(string)
+			if !ok {
+				return nil, errors.New("no-logged-user")
+			}
+
+			id := p.Args["id"].(string)
+			err := app.setRecurringAutoConfirm(id, userId, p.Args["autoconfirm"].(bool))
+			if err != nil {
+				return nil, err
+			}
+
+			return Result{id}, nil
+		},
+	},
+	"setAddress": &graphql.Field{
+		Type: userType,
+		Args: graphql.FieldConfigArgument{
+			"challenge": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			app := p.Context.Value("app").(*App)
+
+			userId, ok := p.Context.Value("userId").(string)
+			if !ok {
+				return nil, errors.New("no-logged-user")
+			}
+
+			// the challenge from addressChallenge, signed with the keys of
+			// the address, proves they own it.
+			address, err := sep10Auth{app.s, app.h, app.n}.verify(p.Args["challenge"].(string))
+			if err != nil {
+				return nil, err
+			}
+
+			return app.setExternalAddress(userId, address)
+		},
+	},
+	"signThing": &graphql.Field{
+		Type: resultType,
+		Args: graphql.FieldConfigArgument{
+			"thing_id": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+			"xdr": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			app := p.Context.Value("app").(*App)
+
+			// signatures are checked against the pending signers, so
+			// there's no need for more auth here.
+			hash, err := app.addSignatures(
+				p.Args["thing_id"].(string),
+				p.Args["xdr"].(string),
+			)
+			if err != nil {
+				return nil, err
+			}
+
+			return Result{hash}, nil
+		},
+	},
+	"recordSettlement": &graphql.Field{
+		Type: resultType,
+		Args: graphql.FieldConfigArgument{
+			"payer": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+			"payee": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+			"asset": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+			"amount": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+			"method": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+			"reference": &graphql.ArgumentConfig{Type: graphql.String},
+			"date":      &graphql.ArgumentConfig{Type: graphql.String},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			app := p.Context.Value("app").(*App)
+
+			userId, ok := p.Context.Value("userId").(string)
+			if !ok {
+				return nil, errors.New("no-logged-user")
+			}
+
+			reference, _ := p.Args["reference"].(string)
+			date, _ := p.Args["date"].(string)
+
+			settlement, err := app.recordSettlement(
+				userId,
+				p.Args["payer"].(string), p.Args["payee"].(string),
+				p.Args["asset"].(string), p.Args["amount"].(string),
+				p.Args["method"].(string), reference, date,
+			)
+			if err != nil {
+				return nil, err
+			}
+
+			return Result{settlement.Id}, nil
+		},
+	},
+	"confirmSettlement": &graphql.Field{
+		Type: resultType,
+		Args: graphql.FieldConfigArgument{
+			"id": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+			"confirm": &graphql.ArgumentConfig{Type: graphql.Boolean},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			app := p.Context.Value("app").(*App)
+
+			userId, ok := p.Context.Value("userId").(string)
+			if !ok {
+				return nil, errors.New("no-logged-user")
+			}
+
+			confirm := true
+			if c, ok := p.Args["confirm"].(bool); ok {
+				confirm = c
+			}
+
+			// the value is the hash of the transaction that burnt the
+			// IOUs, once both have confirmed.
+			settlement, err := app.confirmSettlement(
+				p.Args["id"].(string), userId, confirm)
+			if err != nil {
+				return nil, err
+			}
+
+			return Result{settlement.Transaction}, nil
+		},
+	},
+	"signSettlement": &graphql.Field{
+		Type: resultType,
+		Args: graphql.FieldConfigArgument{
+			"id": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+			"xdr": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			app := p.Context.Value("app").(*App)
+
+			// only the payee signature is taken, so there's no need for
+			// more auth here.
+			hash, err := app.addSettlementSignature(
+				p.Args["id"].(string),
+				p.Args["xdr"].(string),
+			)
+			if err != nil {
+				return nil, err
+			}
+
+			return Result{hash}, nil
+		},
+	},
+	"importSplitwise": &graphql.Field{
+		Type: graphql.NewList(importedThingType),
+		Args: graphql.FieldConfigArgument{
+			"csv": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+			"members": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.NewList(
+					graphql.NewNonNull(inputSplitwiseMemberType),
+				)),
+			},
+			"dry_run": &graphql.ArgumentConfig{Type: graphql.Boolean},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			app := p.Context.Value("app").(*App)
+
+			// the file contents are sent as a string, read by the client.
+			userId, ok := p.Context.Value("userId").(string)
+			if !ok {
+				return nil, errors.New("no-logged-user")
+			}
+			_, err := app.ensureUser(userId)
+			if err != nil {
+				return nil, err
+			}
+
+			members := make(map[string]string)
+			for _, im := range p.Args["members"].([]interface{}) {
+				m := im.(map[string]interface{})
+				members[m["name"].(string)] = m["account"].(string)
+			}
+			dryRun, _ := p.Args["dry_run"].(bool)
+
+			// the other members confirm their things themselves
+			return app.importSplitwise(userId,
+				strings.NewReader(p.Args["csv"].(string)), members, dryRun, false)
+		},
+	},
+	"proposeSettlementPlan": &graphql.Field{
+		Type: resultType,
+		Args: graphql.FieldConfigArgument{
+			"users": &graphql.ArgumentConfig{
+				Type: graphql.NewList(graphql.String),
+			},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			app := p.Context.Value("app").(*App)
+
+			// the plan is computed here instead of trusting the client and
+			// it's only published after all members confirm it.
+			userId, ok := p.Context.Value("userId").(string)
+			if !ok {
+				return nil, errors.New("no-logged-user")
+			}
+
+			users, _ := p.Args["users"].([]interface{})
+			ids, err := app.settlementGroup(userId, users)
+			if err != nil {
+				return nil, err
+			}
+
+			plan, err := app.proposeSettlementPlan(userId, ids)
+			if err != nil {
+				return nil, err
+			}
+
+			return Result{plan.Id}, nil
+		},
+	},
+	"confirmSettlementPlan": &graphql.Field{
+		Type: resultType,
+		Args: graphql.FieldConfigArgument{
+			"id": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+			"confirm": &graphql.ArgumentConfig{Type: graphql.Boolean},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			app := p.Context.Value("app").(*App)
+
+			userId, ok := p.Context.Value("userId").(string)
+			if !ok {
+				return nil, errors.New("no-logged-user")
+			}
+
+			confirm := true
+			if c, ok := p.Args["confirm"].(bool); ok {
+				confirm = c
+			}
+
+			// the value is the hash of the last transaction of the plan,
+			// once everybody has confirmed.
+			plan, err := app.confirmSettlementPlan(p.Args["id"].(string), userId, confirm)
+			if err != nil {
+				return nil, err
+			}
+
+			return Result{plan.Transaction}, nil
+		},
+	},
+	"publishSettlementPlan": &graphql.Field{
+		Type: resultType,
+		Args: graphql.FieldConfigArgument{
+			"id": &graphql.ArgumentConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			app := p.Context.Value("app").(*App)
+
+			// resumes the publication of a confirmed plan that failed.
+			userId, ok := p.Context.Value("userId").(string)
+			if !ok {
+				return nil, errors.New("no-logged-user")
+			}
+
+			plan, err := app.getSettlementPlan(p.Args["id"].(string))
+			if err != nil {
+				return nil, err
+			}
+			if !plan.isMember(userId) {
+				return nil, errNotAllowed
+			}
+
+			hash, err := plan.publish(app)
+			if err != nil {
+				return nil, err
+			}
+
 			return Result{hash}, nil
 		},
 	},
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/graphql-go/graphql"
+)
+
+// query runs a graphql query as `userId`, like the /_graphql handler does.
+func query(app *App, userId, request string) *graphql.Result {
+	ctx := context.WithValue(context.TODO(), "app", app)
+	if userId != "" {
+		ctx = context.WithValue(ctx, "userId", userId)
+	}
+	return graphql.Do(graphql.Params{
+		Schema:        app.schema,
+		RequestString: request,
+		Context:       ctx,
+	})
+}
+
+// sendTestPayment pays `to` with the USD issued by `issuer` through the
+// sendPayment mutation, as `from`.
+func sendTestPayment(t *testing.T, app *App, from, to, issuer, amount string) *graphql.Result {
+	t.Helper()
+
+	iss, err := app.getExistingUser(issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query(app, from, fmt.Sprintf(`mutation {
+  sendPayment(
+    dst_user: "%s", dst_code: "USD", dst_address: "%s",
+    src_code: "USD", src_address: "%s", amount: "%s"
+  ) { value }
+}`, to, iss.Address, iss.Address, amount))
+}
+
+func TestSendPayment(t *testing.T) {
+	app := newTestApp(t)
+
+	// alice ends up with 10 of bob's USD, bob with 6 of alice's.
+	publishTestThing(t, app, createTestThing(t, app, "dinner", "alice", "20",
+		map[string]interface{}{"account": "alice", "paid": "20"},
+		map[string]interface{}{"account": "bob", "paid": "0"},
+	))
+	publishTestThing(t, app, createTestThing(t, app, "lunch", "bob", "12",
+		map[string]interface{}{"account": "alice", "paid": "0"},
+		map[string]interface{}{"account": "bob", "paid": "12"},
+	))
+
+	send := func(amount string) *graphql.Result {
+		return sendTestPayment(t, app, "alice", "bob", "bob", amount)
+	}
+
+	// alice pays her debt back with bob's own IOUs.
+	r := send("6")
+	if len(r.Errors) > 0 {
+		t.Fatal(r.Errors)
+	}
+	if balance := balanceOf(t, app, "alice", "bob", "USD"); balance != "4.0000000" {
+		t.Errorf("alice holds %q of bob's USD, want 4.0000000", balance)
+	}
+
+	var recorded int
+	err := app.pg.Get(&recorded, `
+SELECT count(*) FROM payments
+WHERE from_user = 'alice' AND to_user = 'bob' AND amount = '6'
+    `)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorded != 1 {
+		t.Errorf("%d payments recorded, want 1", recorded)
+	}
+
+	// she doesn't have that many.
+	r = send("5")
+	if len(r.Errors) == 0 {
+		t.Fatal("sending more than alice holds should fail")
+	}
+	if !strings.Contains(r.Errors[0].Message, "op_underfunded") {
+		t.Errorf("got %q, want an op_underfunded error", r.Errors[0].Message)
+	}
+	if balance := balanceOf(t, app, "alice", "bob", "USD"); balance != "4.0000000" {
+		t.Errorf("alice holds %q of bob's USD after a failed payment, want 4.0000000", balance)
+	}
+
+	// only logged users can pay.
+	r = query(app, "", `mutation { sendPayment(dst_user: "bob") { value } }`)
+	if len(r.Errors) == 0 || r.Errors[0].Message != "no-logged-user" {
+		t.Errorf("anonymous payment: got %v, want no-logged-user", r.Errors)
+	}
+}
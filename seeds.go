@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// user seeds are stored using envelope encryption: each seed is encrypted
+// with its own random data key, and that data key is wrapped by a KeyManager.
+// the stored value looks like
+//
+//	sealed:<key id>:<base64 wrapped data key>:<base64 encrypted seed>
+//
+// values without that prefix are plaintext seeds from before encryption was
+// enabled, they keep working until `rekey-seeds` is run.
+const sealedPrefix = "sealed:"
+
+// KeyManager wraps and unwraps data keys. implementations may keep their
+// master keys locally or delegate to some external KMS.
+type KeyManager interface {
+	// CurrentKeyId is the id of the master key used to wrap new data keys.
+	CurrentKeyId() string
+	Wrap(dataKey []byte) (wrapped []byte, err error)
+	Unwrap(keyId string, wrapped []byte) (dataKey []byte, err error)
+}
+
+// FileKeyManager reads its master keys from a local file with one
+// `<id> <base64 of 32 random bytes>` per line. the first key is used to wrap
+// new data keys, the others are kept so older seeds can still be decrypted.
+// to rotate, add a new key at the top of the file and run `rekey-seeds`.
+type FileKeyManager struct {
+	current string
+	keys    map[string][]byte
+}
+
+func loadFileKeyManager(path string) (*FileKeyManager, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fkm := &FileKeyManager{keys: make(map[string][]byte)}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.Contains(fields[0], ":") {
+			return nil, errors.New("invalid line on keys file: '" + fields[0] + "'")
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != 32 {
+			return nil, errors.New("key '" + fields[0] + "' must have 32 bytes")
+		}
+
+		if fkm.current == "" {
+			fkm.current = fields[0]
+		}
+		fkm.keys[fields[0]] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if fkm.current == "" {
+		return nil, errors.New("no keys found on " + path)
+	}
+
+	return fkm, nil
+}
+
+func (fkm *FileKeyManager) CurrentKeyId() string { return fkm.current }
+
+func (fkm *FileKeyManager) Wrap(dataKey []byte) ([]byte, error) {
+	return aesSeal(fkm.keys[fkm.current], dataKey)
+}
+
+func (fkm *FileKeyManager) Unwrap(keyId string, wrapped []byte) ([]byte, error) {
+	key, ok := fkm.keys[keyId]
+	if !ok {
+		return nil, errors.New("unknown key '" + keyId + "'")
+	}
+	return aesOpen(key, wrapped)
+}
+
+// sealSeed encrypts a seed for storage. if no KeyManager is configured the
+// seed is returned as it is.
+func (app *App) sealSeed(seed string) (string, error) {
+	if app.km == nil {
+		return seed, nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+
+	wrapped, err := app.km.Wrap(dataKey)
+	if err != nil {
+		return "", err
+	}
+	encrypted, err := aesSeal(dataKey, []byte(seed))
+	if err != nil {
+		return "", err
+	}
+
+	return sealedPrefix + app.km.CurrentKeyId() +
+		":" + base64.StdEncoding.EncodeToString(wrapped) +
+		":" + base64.StdEncoding.EncodeToString(encrypted), nil
+}
+
+// openSeed decrypts a seed sealed by sealSeed. plaintext seeds are
+// returned as they are. this should only be called at signing time.
+func (app *App) openSeed(stored string) (string, error) {
+	if !strings.HasPrefix(stored, sealedPrefix) {
+		return stored, nil
+	}
+	if app.km == nil {
+		return "", errors.New("found an encrypted seed but no key manager is configured")
+	}
+
+	parts := strings.Split(stored[len(sealedPrefix):], ":")
+	if len(parts) != 3 {
+		return "", errors.New("malformed encrypted seed")
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	encrypted, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+
+	dataKey, err := app.km.Unwrap(parts[0], wrapped)
+	if err != nil {
+		return "", err
+	}
+	seed, err := aesOpen(dataKey, encrypted)
+	if err != nil {
+		return "", err
+	}
+
+	return string(seed), nil
+}
+
+// sealedWith returns the id of the key that wrapped a stored seed, or ""
+// for plaintext seeds.
+func sealedWith(stored string) string {
+	if !strings.HasPrefix(stored, sealedPrefix) {
+		return ""
+	}
+	return strings.SplitN(stored[len(sealedPrefix):], ":", 2)[0]
+}
+
+// rekeySeeds encrypts all plaintext seeds and re-encrypts the ones sealed
+// by old keys with the current key.
+func (app *App) rekeySeeds() error {
+	if app.km == nil {
+		return errors.New("SEED_KEYS_FILE must be set to rekey seeds")
+	}
+
+	var users []struct {
+		Id   string `db:"id"`
+		Seed string `db:"seed"`
+	}
+	err := app.pg.Select(&users, `SELECT id, seed FROM users WHERE seed IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+
+	rekeyed := 0
+	for _, user := range users {
+		if sealedWith(user.Seed) == app.km.CurrentKeyId() {
+			continue
+		}
+
+		seed, err := app.openSeed(user.Seed)
+		if err != nil {
+			log.Error().Err(err).Str("user", user.Id).Msg("failed to open seed")
+			return err
+		}
+		sealed, err := app.sealSeed(seed)
+		if err != nil {
+			log.Error().Err(err).Str("user", user.Id).Msg("failed to seal seed")
+			return err
+		}
+
+		// only replace if nobody else has touched it meanwhile
+		_, err = app.pg.Exec(`
+UPDATE users SET seed = $2 WHERE id = $1 AND seed = $3
+        `, user.Id, sealed, user.Seed)
+		if err != nil {
+			log.Error().Err(err).Str("user", user.Id).Msg("failed to save seed")
+			return err
+		}
+		rekeyed++
+	}
+
+	log.Info().
+		Int("rekeyed", rekeyed).
+		Int("total", len(users)).
+		Str("key", app.km.CurrentKeyId()).
+		Msg("seeds rekeyed.")
+	return nil
+}
+
+func aesSeal(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func aesOpen(key, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce := sealed[:gcm.NonceSize()]
+
+	return gcm.Open(nil, nonce, sealed[gcm.NonceSize():], nil)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/stellar/go/build"
+	"github.com/stellar/go/clients/horizon"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/network"
+	"github.com/stellar/go/strkey"
+	"github.com/stellar/go/xdr"
+)
+
+// sep10Auth logs in people who hold the keys of a stellar account (SEP-10).
+// GET /auth/sep10?account=G... returns a challenge: a transaction with
+// sequence 0, which can never be applied, signed by the source account, with
+// a single manage_data operation whose source is the client account. the
+// client signs it and POSTs it back as `transaction`, in a form or JSON.
+// the signatures must reach the medium threshold of the client account, as
+// its signers are now on horizon. accounts that don't exist yet can only be
+// signed by their master key.
+type sep10Auth struct {
+	s Settings
+	h Horizon
+	n build.Network
+}
+
+const sep10ChallengeTTL = 5 * time.Minute
+
+func (a sep10Auth) Start(w http.ResponseWriter, r *http.Request) {
+	account := r.URL.Query().Get("account")
+	_, err := strkey.Decode(strkey.VersionByteAccountID, account)
+	if err != nil {
+		http.Error(w, "invalid-address", 400)
+		return
+	}
+
+	blob, err := a.challenge(account)
+	if err != nil {
+		log.Error().Err(err).Str("account", account).Msg("failed to build sep10 challenge")
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"transaction":        blob,
+		"network_passphrase": a.n.Passphrase,
+	})
+}
+
+func (a sep10Auth) challenge(account string) (blob string, err error) {
+	var source, client xdr.AccountId
+	err = source.SetAddress(a.s.SourceAddress)
+	if err != nil {
+		return
+	}
+	err = client.SetAddress(account)
+	if err != nil {
+		return
+	}
+
+	// 48 random bytes, base64 encoded, as the spec asks
+	nonce := make([]byte, 48)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return
+	}
+	value := xdr.DataValue(base64.StdEncoding.EncodeToString(nonce))
+
+	body, err := xdr.NewOperationBody(xdr.OperationTypeManageData, xdr.ManageDataOp{
+		DataName:  xdr.String64(a.s.HomeDomain + " auth"),
+		DataValue: &value,
+	})
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	envelope := xdr.TransactionEnvelope{
+		Tx: xdr.Transaction{
+			SourceAccount: source,
+			Fee:           100,
+			SeqNum:        0,
+			TimeBounds: &xdr.TimeBounds{
+				MinTime: xdr.Uint64(now.Unix()),
+				MaxTime: xdr.Uint64(now.Add(sep10ChallengeTTL).Unix()),
+			},
+			Memo:       xdr.Memo{Type: xdr.MemoTypeMemoNone},
+			Operations: []xdr.Operation{{SourceAccount: &client, Body: body}},
+		},
+	}
+
+	hash, err := network.HashTransaction(&envelope.Tx, a.n.Passphrase)
+	if err != nil {
+		return
+	}
+	kp, err := keypair.Parse(a.s.SourceSeed)
+	if err != nil {
+		return
+	}
+	sig, err := kp.SignDecorated(hash[:])
+	if err != nil {
+		return
+	}
+	envelope.Signatures = []xdr.DecoratedSignature{sig}
+
+	var buf bytes.Buffer
+	_, err = xdr.Marshal(&buf, envelope)
+	if err != nil {
+		return
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func (a sep10Auth) Finish(w http.ResponseWriter, r *http.Request) (identity Identity, err error) {
+	blob := r.FormValue("transaction")
+	if blob == "" {
+		var body struct {
+			Transaction string `json:"transaction"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		blob = body.Transaction
+	}
+
+	account, err := a.verify(blob)
+	if err != nil {
+		return
+	}
+	return Identity{Address: account}, nil
+}
+
+// verify checks that `blob` is one of our challenges, still valid, signed by
+// us and by the signers of the client account, and returns that account.
+func (a sep10Auth) verify(blob string) (account string, err error) {
+	var envelope xdr.TransactionEnvelope
+	err = xdr.SafeUnmarshalBase64(blob, &envelope)
+	if err != nil {
+		return "", errors.New("invalid-xdr")
+	}
+	tx := envelope.Tx
+
+	// it must be one of our challenges, still valid
+	if tx.SourceAccount.Address() != a.s.SourceAddress || tx.SeqNum != 0 {
+		return "", errors.New("not a challenge")
+	}
+	now := xdr.Uint64(time.Now().Unix())
+	if tx.TimeBounds == nil || now < tx.TimeBounds.MinTime || now > tx.TimeBounds.MaxTime {
+		return "", errors.New("expired challenge")
+	}
+	if len(tx.Operations) != 1 ||
+		tx.Operations[0].Body.Type != xdr.OperationTypeManageData ||
+		tx.Operations[0].SourceAccount == nil {
+		return "", errors.New("not a challenge")
+	}
+	op := tx.Operations[0].Body.ManageDataOp
+	if op == nil || string(op.DataName) != a.s.HomeDomain+" auth" {
+		return "", errors.New("not a challenge")
+	}
+	account = tx.Operations[0].SourceAccount.Address()
+
+	// signed by us
+	hash, err := network.HashTransaction(&tx, a.n.Passphrase)
+	if err != nil {
+		return
+	}
+	source, err := keypair.Parse(a.s.SourceAddress)
+	if err != nil {
+		return
+	}
+	signed := false
+	for _, sig := range envelope.Signatures {
+		if source.Verify(hash[:], sig.Signature) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return "", errors.New("missing signature from " + a.s.SourceAddress)
+	}
+
+	// and by the client
+	signers, threshold, err := a.signers(account)
+	if err != nil {
+		return
+	}
+	var weight int32
+	used := make(map[int]bool)
+	for _, signer := range signers {
+		kp, err := keypair.Parse(signer.PublicKey)
+		if err != nil {
+			// not a key, like sha256 hashes
+			continue
+		}
+		for i, sig := range envelope.Signatures {
+			if !used[i] && kp.Verify(hash[:], sig.Signature) == nil {
+				used[i] = true
+				weight += signer.Weight
+				break
+			}
+		}
+	}
+	if weight == 0 || weight < threshold {
+		return "", errors.New("not enough signatures from " + account)
+	}
+
+	return account, nil
+}
+
+// signers returns the current signers of `account` and the weight they must
+// reach together.
+func (a sep10Auth) signers(account string) (signers []horizon.Signer, threshold int32, err error) {
+	ha, err := a.h.LoadAccount(account)
+	if herr, ok := err.(*horizon.Error); ok && herr.Response.StatusCode == 404 {
+		return []horizon.Signer{{PublicKey: account, Weight: 1}}, 0, nil
+	} else if err != nil {
+		log.Warn().Err(err).Str("account", account).Msg("failed to load sep10 account")
+		return
+	}
+	return ha.Signers, int32(ha.Thresholds.MedThreshold), nil
+}
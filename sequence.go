@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sync"
+
+	b "github.com/stellar/go/build"
+	"github.com/stellar/go/xdr"
+)
+
+// all our transactions have the source account as their source, so they all
+// take its sequence number and two of them built at the same time would get
+// the same one, failing one with tx_bad_seq. sequences serializes the signing
+// and submission of these transactions, with a mutex on this process and a
+// postgres advisory lock among instances. it also remembers the next sequence
+// number, so horizon is only asked for it when we don't know it or when
+// someone else took it.
+
+// an arbitrary key for pg_advisory_xact_lock.
+const sourceSequenceLock = 52118040
+
+const maxSubmitAttempts = 5
+
+type SequenceManager struct {
+	mu   sync.Mutex
+	next xdr.SequenceNumber // 0 if unknown
+}
+
+func (sm *SequenceManager) load(app *App) error {
+	if sm.next != 0 {
+		return nil
+	}
+
+	seq, err := app.h.SequenceForAccount(app.s.SourceAddress)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to load source account sequence")
+		return err
+	}
+	sm.next = seq + 1
+	return nil
+}
+
+// submit gives the transaction the next sequence number and a fee, signs it
+// with the given seeds and submits it. `sent`, if given, is called with the
+// signed envelope and its hash right before it is submitted. if the sequence
+// number turns out to be taken we start again with a fresh one, and if the
+// fee is too low we offer twice as much, up to MAX_BASE_FEE.
+func (sm *SequenceManager) submit(
+	app *App,
+	tx *b.TransactionBuilder,
+	seeds []string,
+	sent func(blob, hash string) error,
+) (hash string, fee int64, err error) {
+	// asking horizon for the fee takes a while, and everyone else waits for
+	// the lock meanwhile.
+	offer := app.baseFee()
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	txn, err := app.pg.Beginx()
+	if err != nil {
+		return
+	}
+	defer txn.Rollback()
+
+	_, err = txn.Exec(`SELECT pg_advisory_xact_lock($1)`, sourceSequenceLock)
+	if err != nil {
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = sm.load(app)
+		if err != nil {
+			return
+		}
+		tx.TX.SeqNum = sm.next
+		setStellarFee(tx, offer)
+
+		var blob string
+		blob, err = app.signStellarTransaction(tx, seeds...)
+		if err != nil {
+			return
+		}
+		hash, err = app.envelopeHash(blob)
+		if err != nil {
+			return
+		}
+		if sent != nil {
+			err = sent(blob, hash)
+			if err != nil {
+				return "", 0, err
+			}
+		}
+
+		_, fee, err = app.submitStellarTransaction(blob)
+		if err == nil {
+			sm.next++
+			return hash, fee, txn.Commit()
+		}
+
+		// we can't tell anymore whether the sequence number was used
+		sm.next = 0
+		if attempt == maxSubmitAttempts {
+			return "", 0, err
+		}
+
+		if badSequence(err) {
+			log.Info().Int("attempt", attempt).Msg("sequence number was taken, trying again")
+		} else if insufficientFee(err) && app.limitBaseFee(offer*2) > offer {
+			offer = app.limitBaseFee(offer * 2)
+			log.Info().Int("attempt", attempt).Int("fee", offer).
+				Msg("fee was too low, trying again with a higher one")
+		} else {
+			return "", 0, err
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	b "github.com/stellar/go/build"
+	"github.com/stellar/go/clients/horizon"
+	"github.com/stellar/go/xdr"
+)
+
+// countingHorizon counts the transactions refused for their sequence number.
+type countingHorizon struct {
+	Horizon
+
+	mu     sync.Mutex
+	badSeq int
+}
+
+func (c *countingHorizon) SubmitTransaction(blob string) (horizon.TransactionSuccess, error) {
+	success, err := c.Horizon.SubmitTransaction(blob)
+	if badSequence(err) {
+		c.mu.Lock()
+		c.badSeq++
+		c.mu.Unlock()
+	}
+	return success, err
+}
+
+// submitConcurrently submits `n` transactions of the source account at the
+// same time, spread over the given apps, and returns the sequence numbers
+// they were sent with, in the order they were sent.
+func submitConcurrently(t *testing.T, n int, apps ...*App) []xdr.SequenceNumber {
+	t.Helper()
+
+	var mu sync.Mutex
+	var sent []xdr.SequenceNumber
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(app *App) {
+			defer wg.Done()
+
+			tx := app.createStellarTransaction()
+			tx.Mutate(b.SetOptions(b.HomeDomain(app.s.HomeDomain)))
+			_, _, err := app.sequences.submit(app, tx, []string{app.s.SourceSeed},
+				func(blob, hash string) error {
+					mu.Lock()
+					sent = append(sent, tx.TX.SeqNum)
+					mu.Unlock()
+					return nil
+				})
+			if err != nil {
+				errs <- err
+			}
+		}(apps[i%len(apps)])
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("submit failed: %v (%s)", err, transactionCode(err))
+	}
+	return sent
+}
+
+func TestConcurrentSubmissions(t *testing.T) {
+	app := newTestApp(t)
+	counting := &countingHorizon{Horizon: app.h}
+	app.h = counting
+
+	start, err := app.h.SequenceForAccount(app.s.SourceAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 20
+	sent := submitConcurrently(t, n, app)
+
+	if counting.badSeq != 0 {
+		t.Errorf("got %d tx_bad_seq, want none", counting.badSeq)
+	}
+	if len(sent) != n {
+		t.Fatalf("sent %d transactions, want %d", len(sent), n)
+	}
+	// strictly increasing, with no gaps
+	for i, seq := range sent {
+		if seq != start+xdr.SequenceNumber(i+1) {
+			t.Errorf("transaction %d sent with sequence %d, want %d",
+				i, seq, start+xdr.SequenceNumber(i+1))
+		}
+	}
+
+	end, err := app.h.SequenceForAccount(app.s.SourceAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if end != start+n {
+		t.Errorf("source account sequence is %d, want %d", end, start+n)
+	}
+}
+
+// two instances don't share the sequence they remember, only the database
+// lock, so one of them may have to load it again but none fails.
+func TestConcurrentSubmissionsOnManyInstances(t *testing.T) {
+	app := newTestApp(t)
+	other, err := NewApp(app.s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.h = app.h
+
+	start, err := app.h.SequenceForAccount(app.s.SourceAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 20
+	submitConcurrently(t, n, app, other)
+
+	end, err := app.h.SequenceForAccount(app.s.SourceAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if end != start+n {
+		t.Errorf("source account sequence is %d, want %d", end, start+n)
+	}
+}
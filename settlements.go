@@ -0,0 +1,362 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lucsky/cuid"
+	"github.com/shopspring/decimal"
+	b "github.com/stellar/go/build"
+	"github.com/stellar/go/clients/horizon"
+)
+
+// most debts are paid back outside stellar, in cash or bank transfers. one of
+// the two users records the payment and the other confirms it, then the IOUs
+// it pays for are burnt: the payee sends them back to the payer, who issued
+// them.
+//
+// like the transactions of things (see transactions.go), the envelope that
+// burns them is stored with its hash before it is sent, so it is never built
+// twice. payees who hold their own keys must sign it first (see
+// signatures.go).
+
+var errSettlementNotFound = errors.New("settlement-not-found")
+
+var settlementMethods = map[string]bool{
+	"cash":          true,
+	"bank_transfer": true,
+	"pix":           true,
+	"other":         true,
+}
+
+type Settlement struct {
+	Id             string          `json:"id"              db:"id"`
+	CreatedAt      string          `json:"created_at"      db:"created_at"`
+	CreatedBy      string          `json:"created_by"      db:"created_by"`
+	Payer          string          `json:"payer"           db:"payer"`
+	Payee          string          `json:"payee"           db:"payee"`
+	Asset          string          `json:"asset"           db:"asset"`
+	Amount         decimal.Decimal `json:"amount"          db:"amount"`
+	Method         string          `json:"method"          db:"method"`
+	Reference      string          `json:"reference"       db:"reference"`
+	ActualDate     string          `json:"actual_date"     db:"actual_date"`
+	PayerConfirmed bool            `json:"payer_confirmed" db:"payer_confirmed"`
+	PayeeConfirmed bool            `json:"payee_confirmed" db:"payee_confirmed"`
+	Transaction    string          `json:"txn"             db:"txn"`
+
+	Envelope          string `json:"envelope"           db:"envelope"`
+	EnvelopeHash      string `json:"-"                  db:"envelope_hash"`
+	AwaitingSignature bool   `json:"awaiting_signature" db:"awaiting_signature"`
+}
+
+func (settlement Settlement) columns() string {
+	return `
+settlements.id,
+created_at,
+created_by,
+payer,
+payee,
+asset,
+amount,
+method,
+coalesce(reference, '') AS reference,
+actual_date,
+payer_confirmed,
+payee_confirmed,
+coalesce(txn, '') AS txn,
+coalesce(envelope, '') AS envelope,
+coalesce(envelope_hash, '') AS envelope_hash,
+awaiting_signature
+    `
+}
+
+func (app *App) getSettlement(id string) (settlement Settlement, err error) {
+	err = app.pg.Get(&settlement, `
+SELECT `+settlement.columns()+` FROM settlements
+WHERE id = $1
+    `, id)
+	if err == sql.ErrNoRows {
+		err = errSettlementNotFound
+	}
+	return
+}
+
+// recordSettlement stores a payment `payerId` made to `payeeId` outside
+// stellar. the user recording it, who must be one of them, confirms it right
+// away.
+func (app *App) recordSettlement(
+	userId, payerId, payeeId, asset, amount, method, reference, date string,
+) (settlement Settlement, err error) {
+	if userId != payerId && userId != payeeId {
+		return settlement, errNotAllowed
+	}
+	if payerId == payeeId {
+		return settlement, errors.New("invalid-payee")
+	}
+	if !settlementMethods[method] {
+		return settlement, errors.New("invalid-method")
+	}
+
+	value, err := decimal.NewFromString(amount)
+	if err != nil || !value.GreaterThan(decimal.Decimal{}) {
+		return settlement, errors.New("invalid-amount")
+	}
+	if !value.Equals(value.Round(app.assetPrecision(asset))) {
+		return settlement, errors.New("invalid-amount")
+	}
+
+	actualDate := time.Now().UTC()
+	if date != "" {
+		actualDate, err = time.Parse("2006-01-02", date)
+		if err != nil {
+			return settlement, errors.New("invalid-date")
+		}
+	}
+
+	payer, payee, err := app.settlementUsers(payerId, payeeId)
+	if err != nil {
+		return
+	}
+	held, err := app.heldIOUs(payer, payee, asset)
+	if err != nil {
+		return
+	}
+	if value.GreaterThan(held) {
+		return settlement, errors.New("settlement-exceeds-debt")
+	}
+
+	err = app.pg.Get(&settlement, `
+INSERT INTO settlements
+  (id, created_by, payer, payee, asset, amount, method, reference, actual_date,
+   payer_confirmed, payee_confirmed)
+VALUES ($1, $2, $3, $4, $5, $6, $7, nullable($8), $9, $2 = $3, $2 = $4)
+RETURNING `+settlement.columns(),
+		cuid.Slug(), userId, payer.Id, payee.Id, asset, value.String(),
+		method, reference, actualDate)
+	if err != nil {
+		log.Warn().Err(err).Str("payer", payerId).Str("payee", payeeId).
+			Msg("failed to record settlement")
+		return
+	}
+
+	log.Info().
+		Str("settlement", settlement.Id).
+		Str("payer", payer.Id).
+		Str("payee", payee.Id).
+		Str("amount", value.String()+" "+asset).
+		Str("method", method).
+		Msg("settlement recorded")
+	return
+}
+
+// confirmSettlement sets the confirmation of `userId`, the payer or the
+// payee, on a settlement. once both have confirmed the IOUs are burnt.
+// confirmations can't change anymore after that starts, confirming again
+// only resumes it.
+func (app *App) confirmSettlement(id, userId string, confirm bool) (settlement Settlement, err error) {
+	err = app.pg.Get(&settlement, `
+UPDATE settlements SET
+  payer_confirmed = CASE WHEN payer = $2 THEN $3 ELSE payer_confirmed END,
+  payee_confirmed = CASE WHEN payee = $2 THEN $3 ELSE payee_confirmed END
+WHERE id = $1 AND (payer = $2 OR payee = $2) AND txn IS NULL AND envelope IS NULL
+RETURNING `+settlement.columns(),
+		id, userId, confirm)
+	if err == sql.ErrNoRows {
+		settlement, err = app.getSettlement(id)
+		if err != nil {
+			return
+		}
+		if settlement.Payer != userId && settlement.Payee != userId {
+			return settlement, errNotAllowed
+		}
+		if settlement.Transaction != "" || !confirm {
+			return settlement, errAlreadyPublished
+		}
+		settlement.Transaction, err = app.burnSettlement(id)
+		return
+	} else if err != nil {
+		log.Warn().Err(err).Str("settlement", id).Msg("failed to confirm settlement")
+		return
+	}
+
+	if settlement.PayerConfirmed && settlement.PayeeConfirmed {
+		settlement.Transaction, err = app.burnSettlement(id)
+	}
+	return
+}
+
+// burnSettlement sends the IOUs paid by a confirmed settlement back to their
+// issuer. it can be called again if it fails. when the payee holds their own
+// keys it stops with a blank hash, waiting for their signature, and
+// addSettlementSignature continues from there.
+func (app *App) burnSettlement(id string) (hash string, err error) {
+	settlement, err := app.getSettlement(id)
+	if err != nil {
+		return
+	}
+	if !settlement.PayerConfirmed || !settlement.PayeeConfirmed {
+		return "", errSettlementNotFound
+	}
+	if settlement.Transaction != "" {
+		return settlement.Transaction, nil
+	}
+	if settlement.AwaitingSignature {
+		log.Info().Str("settlement", id).Msg("waiting for the payee signature")
+		return "", nil
+	}
+
+	if settlement.Envelope != "" {
+		// we don't know what happened to it
+		hash, _, err = app.settleEnvelope(settlement.EnvelopeHash, settlement.Envelope)
+		if err != nil {
+			return
+		}
+		if hash != "" {
+			return hash, app.recordSettlementTransaction(id, hash)
+		}
+
+		err = storeSettlementEnvelope(app.pg, id, settlement.EnvelopeHash, "", "", false)
+		if err != nil {
+			return
+		}
+	}
+
+	payer, payee, err := app.settlementUsers(settlement.Payer, settlement.Payee)
+	if err != nil {
+		return
+	}
+
+	// other things may have burnt these IOUs meanwhile
+	held, err := app.heldIOUs(payer, payee, settlement.Asset)
+	if err != nil {
+		return
+	}
+	if settlement.Amount.GreaterThan(held) {
+		return "", errors.New("settlement-exceeds-debt")
+	}
+
+	tx := app.createStellarTransaction()
+	tx.Mutate(b.MemoText{settlement.Id})
+	tx.Mutate(b.Payment(
+		b.SourceAccount{payee.Address},
+		b.Destination{payer.Address},
+		b.CreditAmount{
+			settlement.Asset,
+			payer.Address,
+			app.formatAmount(settlement.Amount, settlement.Asset),
+		},
+	))
+
+	seeds, external, err := app.signingKeys([]string{payee.Address})
+	if err != nil {
+		return
+	}
+
+	if len(external) > 0 {
+		var blob string
+		blob, err = app.pendingEnvelope(tx, seeds, "settlement:"+id)
+		if err != nil {
+			return
+		}
+		hash, err = app.envelopeHash(blob)
+		if err != nil {
+			return
+		}
+
+		log.Info().Str("settlement", id).Msg("waiting for the payee signature")
+		return "", storeSettlementEnvelope(app.pg, id, "", blob, hash, true)
+	}
+
+	// it is signed again when retried, replacing the envelope stored before
+	previous := ""
+	hash, _, err = app.sequences.submit(app, tx, seeds, func(blob, hash string) error {
+		// otherwise we wouldn't know later that it was sent
+		err := storeSettlementEnvelope(app.pg, id, previous, blob, hash, false)
+		if err == nil {
+			previous = hash
+		}
+		return err
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("settlement", id).Msg("failed to burn settled IOUs")
+		return
+	}
+
+	return hash, app.recordSettlementTransaction(id, hash)
+}
+
+// storeSettlementEnvelope replaces the envelope of a settlement whose stored
+// envelope hash is `previous`, blank if none. this fails if someone else
+// stored another envelope meanwhile, so only one of them is sent.
+func storeSettlementEnvelope(
+	db sqlx.Execer,
+	id, previous, blob, hash string,
+	awaitingSignature bool,
+) error {
+	res, err := db.Exec(`
+UPDATE settlements
+SET envelope = nullable($3), envelope_hash = nullable($4), awaiting_signature = $5
+WHERE id = $1 AND txn IS NULL AND coalesce(envelope_hash, '') = $2
+    `, id, previous, blob, hash, awaitingSignature)
+	if err != nil {
+		log.Error().Err(err).Str("settlement", id).Msg("failed to store envelope")
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("settlement-already-being-burnt")
+	}
+	return nil
+}
+
+func (app *App) recordSettlementTransaction(id, hash string) error {
+	_, err := app.pg.Exec(`
+UPDATE settlements SET txn = $2 WHERE id = $1 AND txn IS NULL
+    `, id, hash)
+	if err != nil {
+		// the envelope is stored, we'll find it was applied next time
+		log.Error().Err(err).Str("settlement", id).Str("tx", hash).
+			Msg("IOUs burnt but failed to store the transaction")
+	}
+	return err
+}
+
+func (app *App) settlementUsers(payerId, payeeId string) (payer User, payee User, err error) {
+	for _, id := range []string{payerId, payeeId} {
+		var user User
+		user, err = app.getExistingUser(id)
+		if err != nil && err != sql.ErrNoRows {
+			return
+		}
+		if user.Id == "" {
+			err = errors.New("user '" + id + "' doesn't exist")
+			return
+		}
+
+		if id == payerId {
+			payer = user
+		} else {
+			payee = user
+		}
+	}
+	return payer, payee, nil
+}
+
+// heldIOUs returns how much of the `asset` issued by `issuer` is held by
+// `holder` on stellar.
+func (app *App) heldIOUs(issuer, holder User, asset string) (decimal.Decimal, error) {
+	ha, err := app.h.LoadAccount(holder.Address)
+	if herr, ok := err.(*horizon.Error); ok && herr.Response.StatusCode == 404 {
+		return decimal.Decimal{}, nil
+	} else if err != nil {
+		return decimal.Decimal{}, err
+	}
+
+	for _, balance := range ha.Balances {
+		if balance.Asset.Issuer == issuer.Address && balance.Asset.Code == asset {
+			return decimal.NewFromString(balance.Balance)
+		}
+	}
+	return decimal.Decimal{}, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	b "github.com/stellar/go/build"
+)
+
+func TestBurnRetriesBadSequence(t *testing.T) {
+	app := newTestApp(t)
+
+	// alice holds 10 of bob's USD, bob pays 4 of it back in cash.
+	publishTestThing(t, app, createTestThing(t, app, "dinner", "alice", "20",
+		map[string]interface{}{"account": "alice", "paid": "20"},
+		map[string]interface{}{"account": "bob", "paid": "0"},
+	))
+	settlement, err := app.recordSettlement(
+		"bob", "bob", "alice", "USD", "4", "cash", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// take the next sequence number behind the sequence manager's back
+	seq, err := app.h.SequenceForAccount(app.s.SourceAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := app.createStellarTransaction()
+	tx.Mutate(b.SetOptions(b.HomeDomain(app.s.HomeDomain)))
+	tx.TX.SeqNum = seq + 1
+	setStellarFee(tx, app.baseFee())
+	blob, err := app.signStellarTransaction(tx, app.s.SourceSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = app.h.SubmitTransaction(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counting := &countingHorizon{Horizon: app.h}
+	app.h = counting
+
+	settlement, err = app.confirmSettlement(settlement.Id, "alice", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counting.badSeq != 1 {
+		t.Errorf("%d submissions refused for their sequence, want 1", counting.badSeq)
+	}
+	if settlement.Transaction == "" {
+		t.Fatal("settlement wasn't burnt")
+	}
+
+	stored, err := app.getSettlement(settlement.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Transaction != settlement.Transaction || stored.EnvelopeHash != settlement.Transaction {
+		t.Errorf("stored txn %q and envelope hash %q, want both %q",
+			stored.Transaction, stored.EnvelopeHash, settlement.Transaction)
+	}
+	if balance := balanceOf(t, app, "alice", "bob", "USD"); balance != "6.0000000" {
+		t.Errorf("alice holds %q of bob's USD after the settlement, want 6.0000000", balance)
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/lib/pq"
+	b "github.com/stellar/go/build"
+	"github.com/stellar/go/clients/horizon"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/network"
+	"github.com/stellar/go/xdr"
+)
+
+// non-custodial users hold their own keys, so when a thing involves them we
+// can't submit its transaction right away. instead we sign it with the keys
+// we have, store the envelope on things.envelope and wait for the others to
+// send their signatures, either pasting the signed XDR or through a SEP-7
+// wallet callback. things published in many transactions (see
+// transactions.go) go through this once for each one that needs it.
+//
+// signing can take days, so these transactions don't take the sequence
+// number of our source account, which would be used by something else
+// meanwhile. each one has a channel account of its own as its source,
+// created when it is first built and merged back into ours by the
+// transaction itself.
+// settlements whose payee holds their own keys wait for that single signature
+// on settlements.envelope instead.
+
+// how long envelopes waiting for signatures are valid. after that they are
+// refused and built again.
+const pendingEnvelopeTTL = 7 * 24 * time.Hour
+
+// pendingEnvelope signs with the given seeds a transaction that will wait
+// for the signatures of users who hold their own keys. `key` names it among
+// the others, like "thing:<id>:<position>", so it gets the same channel
+// account every time it is built.
+func (app *App) pendingEnvelope(tx *b.TransactionBuilder, seeds []string, key string) (blob string, err error) {
+	channel, err := app.channelAccount(key)
+	if err != nil {
+		return
+	}
+
+	seq, err := app.h.SequenceForAccount(channel.Address())
+	if herr, ok := err.(*horizon.Error); ok && herr.Response.StatusCode == 404 {
+		create := app.createStellarTransaction()
+		create.Mutate(b.CreateAccount(
+			b.Destination{channel.Address()},
+			b.NativeAmount{"20"},
+		))
+		_, err = app.commitStellarTransaction(create, app.s.SourceSeed)
+		if err != nil {
+			log.Warn().Err(err).Str("key", key).Msg("failed to create channel account")
+			return
+		}
+		seq, err = app.h.SequenceForAccount(channel.Address())
+	}
+	if err != nil {
+		return
+	}
+
+	tx.Mutate(b.AccountMerge(b.Destination{app.s.SourceAddress}))
+	if tx.Err != nil {
+		return "", tx.Err
+	}
+	err = tx.TX.SourceAccount.SetAddress(channel.Address())
+	if err != nil {
+		return
+	}
+	tx.TX.SeqNum = seq + 1
+	tx.TX.TimeBounds = &xdr.TimeBounds{
+		MaxTime: xdr.Uint64(time.Now().Add(pendingEnvelopeTTL).Unix()),
+	}
+	setStellarFee(tx, app.baseFee())
+
+	// our source account only signs if some operation is its
+	signers := []string{channel.Seed()}
+	for _, seed := range seeds {
+		if seed != app.s.SourceSeed {
+			signers = append(signers, seed)
+		}
+	}
+	for _, address := range operationSources(tx.TX) {
+		if address == app.s.SourceAddress {
+			signers = append(signers, app.s.SourceSeed)
+			break
+		}
+	}
+	return app.signStellarTransaction(tx, signers...)
+}
+
+// channelAccount derives from our source seed the keys of the channel
+// account of `key`.
+func (app *App) channelAccount(key string) (*keypair.Full, error) {
+	mac := hmac.New(sha256.New, []byte(app.s.SourceSeed))
+	mac.Write([]byte("channel:" + key))
+	var raw [32]byte
+	copy(raw[:], mac.Sum(nil))
+	return keypair.FromRawSeed(raw)
+}
+
+// requestSignatures stores the partially signed envelope of the planned
+// transaction of a thing at `position` and the addresses that must still
+// sign it.
+func (app *App) requestSignatures(thingId string, position int, blob string, addresses []string) error {
+	txn, err := app.pg.Beginx()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	_, err = txn.Exec(`
+UPDATE things SET envelope = $2, envelope_position = $3 WHERE id = $1
+    `, thingId, blob, position)
+	if err != nil {
+		log.Error().Err(err).Str("thing", thingId).Msg("failed to store envelope")
+		return err
+	}
+
+	_, err = txn.Exec(`
+DELETE FROM pending_signatures WHERE thing_id = $1
+    `, thingId)
+	if err != nil {
+		return err
+	}
+	for _, address := range addresses {
+		_, err = txn.Exec(`
+INSERT INTO pending_signatures (thing_id, address) VALUES ($1, $2)
+        `, thingId, address)
+		if err != nil {
+			log.Error().Err(err).Str("thing", thingId).Str("address", address).
+				Msg("failed to store pending signature")
+			return err
+		}
+	}
+
+	return txn.Commit()
+}
+
+// addSignatures takes a copy of the pending envelope of a thing signed by
+// some of the required signers and merges the valid signatures into the
+// stored envelope. once all the signatures are present it is queued to be
+// submitted and its hash is returned.
+func (app *App) addSignatures(thingId, signedBlob string) (hash string, err error) {
+	txn, err := app.pg.Beginx()
+	if err != nil {
+		return
+	}
+	defer txn.Rollback()
+
+	var stored struct {
+		Blob     string `db:"envelope"`
+		Position int    `db:"envelope_position"`
+	}
+	err = txn.Get(&stored, `
+SELECT
+  coalesce(envelope, '') AS envelope,
+  coalesce(envelope_position, 0) AS envelope_position
+FROM things
+WHERE id = $1 AND coalesce(txn, '') = ''
+FOR UPDATE
+    `, thingId)
+	blob := stored.Blob
+	if err == sql.ErrNoRows || (err == nil && blob == "") {
+		return "", errors.New("nothing-to-sign")
+	} else if err != nil {
+		return
+	}
+
+	var pending, signed xdr.TransactionEnvelope
+	err = xdr.SafeUnmarshalBase64(blob, &pending)
+	if err != nil {
+		log.Error().Err(err).Str("thing", thingId).Msg("stored envelope is invalid")
+		return
+	}
+	err = xdr.SafeUnmarshalBase64(signedBlob, &signed)
+	if err != nil {
+		return "", errors.New("invalid-xdr")
+	}
+
+	txhash, err := network.HashTransaction(&pending.Tx, app.n.Passphrase)
+	if err != nil {
+		return
+	}
+	signedhash, err := network.HashTransaction(&signed.Tx, app.n.Passphrase)
+	if err != nil || signedhash != txhash {
+		return "", errors.New("transaction-mismatch")
+	}
+
+	var missing []string
+	err = txn.Select(&missing, `
+SELECT address FROM pending_signatures
+WHERE thing_id = $1 AND NOT signed
+    `, thingId)
+	if err != nil {
+		return
+	}
+
+	added := 0
+	for _, address := range missing {
+		kp, err := keypair.Parse(address)
+		if err != nil {
+			log.Warn().Err(err).Str("address", address).Msg("invalid pending signer")
+			continue
+		}
+
+		for _, sig := range signed.Signatures {
+			if kp.Verify(txhash[:], sig.Signature) != nil {
+				continue
+			}
+
+			pending.Signatures = append(pending.Signatures, sig)
+			_, err = txn.Exec(`
+UPDATE pending_signatures SET signed = true
+WHERE thing_id = $1 AND address = $2
+            `, thingId, address)
+			if err != nil {
+				return "", err
+			}
+			added++
+			break
+		}
+	}
+	if added == 0 {
+		return "", errors.New("no-valid-signatures")
+	}
+
+	var buf bytes.Buffer
+	_, err = xdr.Marshal(&buf, pending)
+	if err != nil {
+		return
+	}
+	blob = base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	log.Info().
+		Str("thing", thingId).
+		Int("added", added).
+		Int("missing", len(missing)-added).
+		Msg("got external signatures")
+
+	if added < len(missing) {
+		_, err = txn.Exec(`
+UPDATE things SET envelope = $2 WHERE id = $1
+        `, thingId, blob)
+		if err != nil {
+			return
+		}
+		return "", txn.Commit()
+	}
+
+	// all signed. the envelope is handed to the publication worker, which
+	// submits it and goes on with the other transactions of the thing.
+	hash = hex.EncodeToString(txhash[:])
+
+	// things built before they could have many transactions have no plan
+	var body bytes.Buffer
+	_, err = xdr.Marshal(&body, pending.Tx)
+	if err != nil {
+		return
+	}
+	_, err = txn.Exec(`
+INSERT INTO thing_transactions (thing_id, position, tx, signers)
+SELECT $1, 0, $2, $3
+WHERE NOT EXISTS (SELECT 1 FROM thing_transactions WHERE thing_id = $1)
+    `, thingId, base64.StdEncoding.EncodeToString(body.Bytes()),
+		pq.StringArray(operationSources(pending.Tx)))
+	if err != nil {
+		return
+	}
+
+	err = storeEnvelope(txn, thingId, stored.Position, blob, hash)
+	if err != nil {
+		return
+	}
+
+	_, err = txn.Exec(`
+UPDATE things SET envelope = NULL, envelope_position = NULL WHERE id = $1
+    `, thingId)
+	if err != nil {
+		return
+	}
+	_, err = txn.Exec(`
+DELETE FROM pending_signatures WHERE thing_id = $1
+    `, thingId)
+	if err != nil {
+		return
+	}
+	err = enqueuePublication(txn, thingId)
+	if err != nil {
+		return
+	}
+
+	return hash, txn.Commit()
+}
+
+// addSettlementSignature takes a copy of the envelope that burns the IOUs of
+// a settlement signed by its payee, stores it and submits it.
+func (app *App) addSettlementSignature(id, signedBlob string) (hash string, err error) {
+	settlement, err := app.getSettlement(id)
+	if err != nil {
+		return
+	}
+	if !settlement.AwaitingSignature || settlement.Transaction != "" {
+		return "", errors.New("nothing-to-sign")
+	}
+	payee, err := app.getExistingUser(settlement.Payee)
+	if err != nil {
+		return
+	}
+
+	var pending, signed xdr.TransactionEnvelope
+	err = xdr.SafeUnmarshalBase64(settlement.Envelope, &pending)
+	if err != nil {
+		log.Error().Err(err).Str("settlement", id).Msg("stored envelope is invalid")
+		return
+	}
+	err = xdr.SafeUnmarshalBase64(signedBlob, &signed)
+	if err != nil {
+		return "", errors.New("invalid-xdr")
+	}
+
+	txhash, err := network.HashTransaction(&pending.Tx, app.n.Passphrase)
+	if err != nil {
+		return
+	}
+	signedhash, err := network.HashTransaction(&signed.Tx, app.n.Passphrase)
+	if err != nil || signedhash != txhash {
+		return "", errors.New("transaction-mismatch")
+	}
+
+	kp, err := keypair.Parse(payee.Address)
+	if err != nil {
+		return
+	}
+	added := false
+	for _, sig := range signed.Signatures {
+		if kp.Verify(txhash[:], sig.Signature) == nil {
+			pending.Signatures = append(pending.Signatures, sig)
+			added = true
+			break
+		}
+	}
+	if !added {
+		return "", errors.New("no-valid-signatures")
+	}
+
+	var buf bytes.Buffer
+	_, err = xdr.Marshal(&buf, pending)
+	if err != nil {
+		return
+	}
+
+	log.Info().Str("settlement", id).Msg("got the payee signature")
+	err = storeSettlementEnvelope(app.pg, id, settlement.EnvelopeHash,
+		base64.StdEncoding.EncodeToString(buf.Bytes()),
+		hex.EncodeToString(txhash[:]), false)
+	if err != nil {
+		return
+	}
+
+	// it is sent as an envelope we don't know the fate of
+	return app.burnSettlement(id)
+}
+
+// operationSources returns the accounts, other than the transaction source,
+// that are the source of some operation and so must sign it.
+func operationSources(tx xdr.Transaction) (addresses []string) {
+	seen := map[string]bool{tx.SourceAccount.Address(): true}
+	for _, op := range tx.Operations {
+		if op.SourceAccount == nil {
+			continue
+		}
+		address := op.SourceAccount.Address()
+		if !seen[address] {
+			seen[address] = true
+			addresses = append(addresses, address)
+		}
+	}
+	return
+}
+
+// pendingSigners returns the ids of the users that still have to sign the
+// transaction of a thing.
+func (app *App) pendingSigners(thingId string) (userIds []string, err error) {
+	userIds = []string{}
+	err = app.pg.Select(&userIds, `
+SELECT users.id FROM pending_signatures
+INNER JOIN users ON users.address = pending_signatures.address
+WHERE thing_id = $1 AND NOT signed
+    `, thingId)
+	return
+}
+
+// sep7URI returns a SEP-7 "tx" URI a wallet can use to sign the pending
+// envelope of a thing or a settlement (`kind`) and post it back to us.
+func (app *App) sep7URI(kind, id, blob string) string {
+	qs := url.Values{}
+	qs.Set("xdr", blob)
+	qs.Set("callback", "url:"+app.s.ServiceURL+"/sep7/callback?"+kind+"="+url.QueryEscape(id))
+	qs.Set("msg", "sign your part of "+id+" on debtmoney")
+	if app.n.Passphrase != b.PublicNetwork.Passphrase {
+		qs.Set("network_passphrase", app.n.Passphrase)
+	}
+	return "web+stellar:tx?" + qs.Encode()
+}
+
+// sep7Callback receives envelopes signed by SEP-7 wallets. no auth needed
+// since only valid signatures from pending signers are taken.
+func (app *App) sep7Callback(w http.ResponseWriter, r *http.Request) {
+	var hash string
+	var err error
+	thingId := r.URL.Query().Get("thing")
+	settlementId := r.URL.Query().Get("settlement")
+	if settlementId != "" {
+		hash, err = app.addSettlementSignature(settlementId, r.FormValue("xdr"))
+	} else {
+		hash, err = app.addSignatures(thingId, r.FormValue("xdr"))
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("thing", thingId).Str("settlement", settlementId).
+			Msg("sep7 callback failed")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"hash": "` + hash + `"}`))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	b "github.com/stellar/go/build"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/network"
+	"github.com/stellar/go/xdr"
+)
+
+// signTestEnvelope adds the signature of `kp` to an envelope, like a wallet.
+func signTestEnvelope(t *testing.T, app *App, blob string, kp *keypair.Full) string {
+	t.Helper()
+
+	var envelope xdr.TransactionEnvelope
+	err := xdr.SafeUnmarshalBase64(blob, &envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := network.HashTransaction(&envelope.Tx, app.n.Passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := kp.SignDecorated(hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope.Signatures = append(envelope.Signatures, sig)
+
+	var buf bytes.Buffer
+	_, err = xdr.Marshal(&buf, envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestPendingEnvelopeSurvivesOtherSubmissions(t *testing.T) {
+	app := newTestApp(t)
+
+	// alice holds her own keys
+	alice, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = app.ensureUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = app.setExternalAddress("alice", alice.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// so she must trust bob's IOUs herself
+	publishTestThing(t, app, createTestThing(t, app, "dinner", "alice", "20",
+		map[string]interface{}{"account": "alice", "paid": "20"},
+		map[string]interface{}{"account": "bob", "paid": "0"},
+	))
+	var envelope string
+	err = app.pg.Get(&envelope, `SELECT coalesce(envelope, '') FROM things WHERE id = 'dinner'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if envelope == "" {
+		t.Fatal("dinner isn't waiting for alice's signature")
+	}
+
+	// meanwhile we go on submitting other transactions
+	for i := 0; i < 3; i++ {
+		tx := app.createStellarTransaction()
+		tx.Mutate(b.SetOptions(b.HomeDomain(app.s.HomeDomain)))
+		_, err = app.commitStellarTransaction(tx, app.s.SourceSeed)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = app.addSignatures("dinner", signTestEnvelope(t, app, envelope, alice))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = app.processPublication()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var txn string
+	err = app.pg.Get(&txn, `SELECT coalesce(txn, '') FROM things WHERE id = 'dinner'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txn == "" {
+		t.Fatal("dinner wasn't published after alice signed")
+	}
+	if balance := balanceOf(t, app, "alice", "bob", "USD"); balance != "10.0000000" {
+		t.Errorf("alice holds %q of bob's USD, want 10.0000000", balance)
+	}
+
+	// and the channel account was merged back into ours
+	channel, err := app.channelAccount("thing:dinner:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.h.LoadAccount(channel.Address()); err == nil {
+		t.Error("the channel account still exists")
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"hash/crc32"
+	"sort"
+
+	"github.com/lib/pq"
+	"github.com/shopspring/decimal"
+)
+
+// how the total_due of a thing is split among its parties:
+//
+//   - "equal": parties with a due set owe it, the rest of the total is split
+//     equally among the others.
+//   - "shares": like "equal", but the rest is split proportionally to each
+//     party's weight (1 if not set).
+//   - "percentage": each party owes its weight percent of the total.
+//   - "itemized": each item is split equally among the parties it is assigned
+//     to and whatever is left of the total after all items (tax, tip) is split
+//     proportionally to what each party consumed.
+//
+// the consistency of all this is checked by the thing_totals trigger.
+
+type Item struct {
+	Id          int             `json:"id"          db:"id"`
+	ThingId     string          `json:"thing_id"    db:"thing_id"`
+	Description string          `json:"description" db:"description"`
+	Amount      decimal.Decimal `json:"amount"      db:"amount"`
+	Accounts    pq.StringArray  `json:"accounts"    db:"accounts"`
+}
+
+func (item Item) columns() string {
+	return `
+id, thing_id,
+coalesce(description, '') AS description,
+amount,
+accounts
+    `
+}
+
+func (thing *Thing) fillItems(app *App) (err error) {
+	if thing.Items != nil {
+		return nil
+	}
+
+	thing.Items = []Item{}
+	err = app.pg.Select(&thing.Items, `
+SELECT `+(Item{}).columns()+` FROM thing_items
+WHERE thing_id = $1
+ORDER BY id
+    `, thing.Id)
+	if err != nil {
+		log.Error().Str("thing", thing.Id).Err(err).Msg("on thing items query")
+	}
+	return
+}
+
+// computeDues sets the workingDue of each party according to the split mode.
+// parties must have been filled before.
+func (thing *Thing) computeDues(app *App) error {
+	one := decimal.New(1, 0)
+
+	if !thing.TotalDueSet {
+		// all dues are explicit
+		for i := range thing.Parties {
+			thing.Parties[i].workingDue = thing.Parties[i].Due
+		}
+		return nil
+	}
+
+	remaining := thing.TotalDue
+	explicit := make([]bool, len(thing.Parties))
+	weights := make([]decimal.Decimal, len(thing.Parties))
+
+	switch thing.SplitMode {
+	case "equal", "", "shares":
+		for i, party := range thing.Parties {
+			if party.DueSet {
+				explicit[i] = true
+				remaining = remaining.Sub(party.Due)
+			} else if thing.SplitMode == "shares" && party.WeightSet {
+				weights[i] = party.Weight
+			} else {
+				weights[i] = one
+			}
+		}
+	case "percentage":
+		for i, party := range thing.Parties {
+			weights[i] = party.Weight
+		}
+	case "itemized":
+		err := thing.fillItems(app)
+		if err != nil {
+			return err
+		}
+
+		index := make(map[string]int, len(thing.Parties))
+		for i, party := range thing.Parties {
+			index[party.AccountName] = i
+		}
+
+		// each party's weight is what it consumed, so the extra is
+		// distributed proportionally.
+		for _, item := range thing.Items {
+			if len(item.Accounts) == 0 {
+				return errors.New("item '" + item.Description + "' has no parties")
+			}
+			share := item.Amount.DivRound(decimal.New(int64(len(item.Accounts)), 0), 16)
+			for _, account := range item.Accounts {
+				i, ok := index[account]
+				if !ok {
+					return errors.New("item assigned to '" + account + "' who is not a party")
+				}
+				weights[i] = weights[i].Add(share)
+			}
+		}
+	default:
+		return errors.New("unknown split mode: '" + thing.SplitMode + "'")
+	}
+
+	amounts, err := allocate(remaining, weights, app.assetPrecision(thing.Asset),
+		rotation(thing.Id, len(thing.Parties)))
+	if err != nil {
+		return err
+	}
+
+	for i := range thing.Parties {
+		if explicit[i] {
+			thing.Parties[i].workingDue = thing.Parties[i].Due
+		} else {
+			thing.Parties[i].workingDue = amounts[i]
+		}
+	}
+
+	return nil
+}
+
+// allocate splits `total` proportionally to `weights` in units of
+// 10^-places, so that the sum of the parts is always exactly `total`.
+// everybody gets the floor of their exact share and the units left are
+// given one each to the largest remainders. ties are broken by position,
+// starting at `start`, so the same parties don't always absorb them.
+func allocate(
+	total decimal.Decimal,
+	weights []decimal.Decimal,
+	places int32,
+	start int,
+) ([]decimal.Decimal, error) {
+	zero := decimal.Decimal{}
+	amounts := make([]decimal.Decimal, len(weights))
+
+	if total.LessThan(zero) {
+		negative, err := allocate(total.Neg(), weights, places, start)
+		for i := range negative {
+			negative[i] = negative[i].Neg()
+		}
+		return negative, err
+	}
+
+	sum := zero
+	for _, w := range weights {
+		if w.LessThan(zero) {
+			return nil, errors.New("negative weight")
+		}
+		sum = sum.Add(w)
+	}
+	if sum.Equals(zero) {
+		if total.Equals(zero) {
+			return amounts, nil
+		}
+		return nil, errors.New("no one to split " + total.String() + " among")
+	}
+
+	unit := decimal.New(1, -places)
+	scale := decimal.New(1, places)
+	if scaled := total.Mul(scale); !scaled.Equals(scaled.Floor()) {
+		return nil, errors.New(total.String() + " has too many decimal places")
+	}
+
+	remainders := make([]decimal.Decimal, len(weights))
+	assigned := zero
+	for i, w := range weights {
+		exact := total.Mul(w).DivRound(sum, places+16)
+		amounts[i] = exact.Mul(scale).Floor().Div(scale)
+		remainders[i] = exact.Sub(amounts[i])
+		assigned = assigned.Add(amounts[i])
+	}
+
+	n := len(weights)
+	order := make([]int, n)
+	for i := range order {
+		order[i] = (i + start) % n
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return remainders[order[a]].GreaterThan(remainders[order[b]])
+	})
+
+	left := total.Sub(assigned)
+	for k := 0; left.GreaterThan(zero); k++ {
+		i := order[k%n]
+		if weights[i].Equals(zero) {
+			continue
+		}
+		amounts[i] = amounts[i].Add(unit)
+		left = left.Sub(unit)
+	}
+
+	return amounts, nil
+}
+
+// rotation picks, in a deterministic way, where the tie-breaking of
+// allocate starts for a given thing.
+func rotation(id string, n int) int {
+	if n == 0 {
+		return 0
+	}
+	return int(crc32.ChecksumIEEE([]byte(id)) % uint32(n))
+}
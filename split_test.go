@@ -0,0 +1,214 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"github.com/shopspring/decimal"
+)
+
+// allocation is a random input for allocate.
+type allocation struct {
+	Total   decimal.Decimal
+	Weights []decimal.Decimal
+	Places  int32
+	Start   int
+}
+
+func (allocation) Generate(r *rand.Rand, size int) reflect.Value {
+	a := allocation{Places: int32(r.Intn(8))}
+
+	n := 1 + r.Intn(12)
+	a.Weights = make([]decimal.Decimal, n)
+	for i := range a.Weights {
+		// some zeros, some fractional, at least one positive
+		switch r.Intn(4) {
+		case 0:
+			a.Weights[i] = decimal.Decimal{}
+		case 1:
+			a.Weights[i] = decimal.New(r.Int63n(100000), -int32(r.Intn(4)))
+		default:
+			a.Weights[i] = decimal.New(1+r.Int63n(10), 0)
+		}
+	}
+	a.Weights[r.Intn(n)] = decimal.New(1+r.Int63n(100), 0)
+
+	a.Total = decimal.New(r.Int63n(1000000000), -a.Places)
+	if r.Intn(10) == 0 {
+		a.Total = a.Total.Neg()
+	}
+	a.Start = r.Intn(n)
+	return reflect.ValueOf(a)
+}
+
+func TestAllocateSumsToTotal(t *testing.T) {
+	f := func(a allocation) bool {
+		amounts, err := allocate(a.Total, a.Weights, a.Places, a.Start)
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+
+		weights := decimal.Decimal{}
+		for _, w := range a.Weights {
+			weights = weights.Add(w)
+		}
+
+		sum := decimal.Decimal{}
+		unit := decimal.New(1, -a.Places)
+		for i, amount := range amounts {
+			sum = sum.Add(amount)
+
+			// nobody is off their exact share by more than a unit
+			if a.Weights[i].Equals(decimal.Decimal{}) && !amount.Equals(decimal.Decimal{}) {
+				return false
+			}
+			exact := a.Total.Mul(a.Weights[i]).DivRound(weights, a.Places+16)
+			if amount.Sub(exact).Abs().GreaterThan(unit) {
+				return false
+			}
+		}
+		return sum.Equals(a.Total)
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAllocateIsDeterministic(t *testing.T) {
+	f := func(a allocation) bool {
+		first, err := allocate(a.Total, a.Weights, a.Places, a.Start)
+		if err != nil {
+			return false
+		}
+		for k := 0; k < 3; k++ {
+			again, _ := allocate(a.Total, a.Weights, a.Places, a.Start)
+			for i := range first {
+				if !first[i].Equals(again[i]) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+}
+
+// with equal weights the units left go to the parties right from `start`.
+func TestAllocateRotatesRemainders(t *testing.T) {
+	f := func(n8, start8, left8 uint8, places8 uint8) bool {
+		n := 1 + int(n8%10)
+		start := int(start8) % n
+		left := int(left8) % n
+		places := int32(places8 % 8)
+
+		weights := make([]decimal.Decimal, n)
+		for i := range weights {
+			weights[i] = decimal.New(1, 0)
+		}
+		unit := decimal.New(1, -places)
+		total := decimal.New(int64(n)*7, 0).Add(unit.Mul(decimal.New(int64(left), 0)))
+
+		amounts, err := allocate(total, weights, places, start)
+		if err != nil {
+			return false
+		}
+
+		base := decimal.New(7, 0)
+		for i, amount := range amounts {
+			extra := (i-start+n)%n < left
+			if extra && !amount.Equals(base.Add(unit)) {
+				return false
+			}
+			if !extra && !amount.Equals(base) {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 1000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRotationIsStable(t *testing.T) {
+	f := func(id string, n8 uint8) bool {
+		n := int(n8%20) + 1
+		r := rotation(id, n)
+		return r >= 0 && r < n && r == rotation(id, n)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// the dues computed for a thing add up to its total_due, in any split mode
+// that doesn't need items, and don't change from one run to the next.
+func TestComputeDuesSumsToTotal(t *testing.T) {
+	app := &App{}
+	app.precisions.byCode = map[string]int32{"BTC": 7, "JPY": 0, "USD": 2}
+
+	f := func(a allocation, id string, asset8, mode8 uint8) bool {
+		asset := []string{"BTC", "JPY", "USD"}[asset8%3]
+		places := app.assetPrecision(asset)
+		mode := []string{"equal", "shares", "percentage"}[mode8%3]
+
+		thing := Thing{
+			Id:          id,
+			Asset:       asset,
+			TotalDue:    a.Total.Abs().Round(places),
+			TotalDueSet: true,
+			SplitMode:   mode,
+		}
+		for i, w := range a.Weights {
+			thing.Parties = append(thing.Parties, Party{
+				AccountName: string(rune('a' + i)),
+				Weight:      w,
+				WeightSet:   true,
+			})
+		}
+		if mode == "percentage" {
+			// percentages must add up to 100
+			sum := decimal.Decimal{}
+			for _, w := range a.Weights {
+				sum = sum.Add(w)
+			}
+			for i := range thing.Parties {
+				thing.Parties[i].Weight = a.Weights[i].Mul(decimal.New(100, 0)).DivRound(sum, 16)
+			}
+		}
+
+		err := thing.computeDues(app)
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		first := make([]decimal.Decimal, len(thing.Parties))
+		sum := decimal.Decimal{}
+		for i, party := range thing.Parties {
+			first[i] = party.workingDue
+			sum = sum.Add(party.workingDue)
+		}
+		if !sum.Equals(thing.TotalDue) {
+			return false
+		}
+
+		err = thing.computeDues(app)
+		if err != nil {
+			return false
+		}
+		for i, party := range thing.Parties {
+			if !party.workingDue.Equals(first[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 1000}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lucsky/cuid"
+	"github.com/shopspring/decimal"
+)
+
+// splitwise exports a group as a CSV with one row per expense or payment:
+//
+//   Date,Description,Category,Cost,Currency,Alice,Bob,Carol
+//   2017-03-01,Dinner,Dining out,90.00,USD,60.00,-30.00,-30.00
+//
+// member columns have how much each balance changed: positive for those who
+// paid more than their share, negative for those who paid less. payments
+// between members are rows like the others, with the "Payment" category, and
+// the export ends with a "Total balance" row that has no date.
+//
+// each row becomes a thing where the members with positive amounts paid them
+// and the ones with negative amounts owe them, which issues the same IOUs.
+// members are matched to account names by the `members` map, where the
+// importing user must be. the things are created confirmed by them only, the
+// others confirm them as usual. the import-splitwise command, run by whoever
+// runs this server, can instead confirm them for everybody, so they are
+// published right away when everybody in them has an account here.
+
+type ImportedThing struct {
+	Row     int             `json:"row"`
+	Id      string          `json:"id"` // blank on dry runs
+	Date    string          `json:"date"`
+	Name    string          `json:"name"`
+	Asset   string          `json:"asset"`
+	Parties []ImportedParty `json:"parties"`
+}
+
+type ImportedParty struct {
+	Account string          `json:"account"`
+	Paid    decimal.Decimal `json:"paid"`
+	Due     decimal.Decimal `json:"due"`
+}
+
+// importSplitwise creates a thing for each row of a splitwise export, or
+// only checks that they could be created if `dryRun`. either all rows are
+// imported or none. things are confirmed by `userId`, or by all their
+// parties if `confirmAll`.
+func (app *App) importSplitwise(
+	userId string,
+	r io.Reader,
+	members map[string]string,
+	dryRun bool,
+	confirmAll bool,
+) (imported []ImportedThing, err error) {
+	imported = []ImportedThing{}
+
+	isMember := false
+	for _, account := range members {
+		if strings.ToLower(account) == strings.ToLower(userId) {
+			isMember = true
+			break
+		}
+	}
+	if !isMember {
+		return imported, errors.New("you must be one of the splitwise members")
+	}
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return
+	}
+	if len(records) == 0 {
+		return imported, errors.New("empty splitwise export")
+	}
+
+	// members come after the currency
+	header := records[0]
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"date", "description", "currency"} {
+		if _, ok := columns[name]; !ok {
+			return imported, errors.New("splitwise export has no '" + name + "' column")
+		}
+	}
+	firstMember := columns["currency"] + 1
+
+	for i, record := range records[1:] {
+		row := i + 2
+		if len(record) < len(header) || strings.TrimSpace(record[columns["date"]]) == "" {
+			continue
+		}
+
+		date, err := time.Parse("2006-01-02", strings.TrimSpace(record[columns["date"]]))
+		if err != nil {
+			return imported, errors.New("invalid date on row " + strconv.Itoa(row))
+		}
+
+		thing := ImportedThing{
+			Row:   row,
+			Date:  date.Format("2006-01-02"),
+			Name:  strings.TrimSpace(record[columns["description"]]),
+			Asset: strings.TrimSpace(record[columns["currency"]]),
+		}
+
+		for col := firstMember; col < len(header); col++ {
+			value := strings.TrimSpace(record[col])
+			if value == "" {
+				continue
+			}
+			amount, err := decimal.NewFromString(value)
+			if err != nil {
+				return imported, errors.New("invalid amount on row " + strconv.Itoa(row))
+			}
+			if amount.Equals(decimal.Decimal{}) {
+				continue
+			}
+
+			name := strings.TrimSpace(header[col])
+			account, ok := members[name]
+			if !ok || account == "" {
+				return imported, errors.New("no account for splitwise member '" + name + "'")
+			}
+
+			party := ImportedParty{Account: account}
+			if amount.GreaterThan(decimal.Decimal{}) {
+				party.Paid = amount
+			} else {
+				party.Due = amount.Neg()
+			}
+			thing.Parties = append(thing.Parties, party)
+		}
+		if len(thing.Parties) == 0 {
+			continue
+		}
+
+		imported = append(imported, thing)
+	}
+
+	txn, err := app.pg.Beginx()
+	if err != nil {
+		return
+	}
+	defer txn.Rollback()
+
+	var queued int
+	for i, thing := range imported {
+		parties := make([]interface{}, len(thing.Parties))
+		for j, party := range thing.Parties {
+			p := map[string]interface{}{"account": party.Account}
+			if party.Paid.GreaterThan(decimal.Decimal{}) {
+				p["paid"] = party.Paid.String()
+				p["due"] = "0"
+			} else {
+				p["paid"] = "0"
+				p["due"] = party.Due.String()
+			}
+			parties[j] = p
+		}
+
+		id := cuid.Slug()
+		_, err = insertThing(txn,
+			id, thing.Date, userId, userId, thing.Name, thing.Asset, "", "equal",
+			parties, nil)
+		if err != nil {
+			return imported, errors.New(
+				"row " + strconv.Itoa(thing.Row) + ": " + err.Error())
+		}
+
+		_, err = txn.Exec(`
+UPDATE parties SET confirmed = true
+WHERE thing_id = $1 AND ($3 OR user_id = $2)
+        `, id, userId, confirmAll)
+		if err != nil {
+			return
+		}
+
+		if dryRun {
+			// check each thing now to tell which row is wrong
+			_, err = txn.Exec(`SET CONSTRAINTS ALL IMMEDIATE`)
+			if err != nil {
+				return imported, errors.New(
+					"row " + strconv.Itoa(thing.Row) + ": " + err.Error())
+			}
+			_, err = txn.Exec(`SET CONSTRAINTS ALL DEFERRED`)
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		imported[i].Id = id
+
+		var publishable bool
+		err = txn.Get(&publishable, `
+SELECT things.publishable FROM things
+WHERE id = $1
+        `, id)
+		if err != nil {
+			return
+		}
+		if publishable {
+			err = enqueuePublication(txn, id)
+			if err != nil {
+				return
+			}
+			queued++
+		}
+	}
+
+	if dryRun {
+		return imported, nil
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		log.Warn().Err(err).Str("user", userId).Msg("failed to import splitwise export")
+		return
+	}
+
+	log.Info().
+		Str("user", userId).
+		Int("things", len(imported)).
+		Int("queued", queued).
+		Msg("imported splitwise export")
+	return imported, nil
+}
+
+// importSplitwiseCommand handles
+// `import-splitwise -user <id> [-dry-run] [-member 'Name=account']... <file.csv>`.
+func (app *App) importSplitwiseCommand(args []string) error {
+	members := make(memberFlags)
+
+	flags := flag.NewFlagSet("import-splitwise", flag.ContinueOnError)
+	userId := flags.String("user", "", "debtmoney user the things will be created by")
+	dryRun := flags.Bool("dry-run", false, "only show what would be imported")
+	flags.Var(members, "member", "splitwise member and their account, as 'Name=account'")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *userId == "" || flags.NArg() != 1 {
+		return errors.New(
+			"usage: import-splitwise -user <id> [-dry-run] [-member 'Name=account']... <file.csv>")
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// whoever can run this can confirm for everybody
+	imported, err := app.importSplitwise(*userId, file, members, *dryRun, true)
+	if err != nil {
+		return err
+	}
+
+	for _, thing := range imported {
+		for _, party := range thing.Parties {
+			log.Info().
+				Int("row", thing.Row).
+				Str("thing", thing.Id).
+				Str("date", thing.Date).
+				Str("name", thing.Name).
+				Str("account", party.Account).
+				Str("paid", party.Paid.String()+" "+thing.Asset).
+				Str("due", party.Due.String()+" "+thing.Asset).
+				Msg("splitwise row")
+		}
+	}
+	log.Info().Int("things", len(imported)).Bool("dry-run", *dryRun).
+		Msg("splitwise import done.")
+	return nil
+}
+
+// memberFlags collects repeated -member 'Name=account' flags.
+type memberFlags map[string]string
+
+func (m memberFlags) String() string { return "" }
+
+func (m memberFlags) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return errors.New("members must be given as 'Name=account'")
+	}
+	m[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	return nil
+}
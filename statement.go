@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/shopspring/decimal"
+)
+
+// balances between two users come from four places: the IOUs things issue,
+// path payments made with sendPayment, settlements paid outside stellar and
+// settlement plans that net them with other users (see netting.go).
+// amounts here are always seen from the logged user: positive when it
+// increases what the other owes them, negative when it increases what they
+// owe the other.
+
+// Counterparty is the net position of a user with another, per asset.
+type Counterparty struct {
+	User     string       `json:"user"`
+	Balances []NetBalance `json:"balances"`
+}
+
+type NetBalance struct {
+	Asset  string          `json:"asset"`
+	Amount decimal.Decimal `json:"amount"`
+}
+
+// counterparties reads from stellar the IOUs `user` holds and the ones
+// issued by them held by the users they share things with or whose IOUs they
+// hold, and nets both directions.
+func (app *App) counterparties(user User) (counterparties []Counterparty, err error) {
+	counterparties = []Counterparty{}
+
+	var issuers []string
+	for _, balance := range user.ha.Balances {
+		if balance.Asset.Type != "native" {
+			issuers = append(issuers, balance.Asset.Issuer)
+		}
+	}
+
+	var ids []string
+	err = app.pg.Select(&ids, `
+SELECT $1
+UNION
+SELECT friend FROM friends WHERE main = $1
+UNION
+SELECT id FROM users WHERE address = ANY($2)
+    `, user.Id, pq.StringArray(issuers))
+	if err != nil {
+		log.Warn().Err(err).Str("user", user.Id).Msg("failed to load counterparties")
+		return
+	}
+
+	users, err := app.loadGroup(ids)
+	if err != nil {
+		return
+	}
+
+	nets := make(map[string]map[string]decimal.Decimal)
+	for _, debt := range currentDebts(users) {
+		var other string
+		amount := debt.Amount
+		if debt.To == user.Id {
+			other = debt.From
+		} else if debt.From == user.Id {
+			other = debt.To
+			amount = amount.Neg()
+		} else {
+			continue
+		}
+
+		if _, ok := nets[other]; !ok {
+			nets[other] = make(map[string]decimal.Decimal)
+		}
+		nets[other][debt.Asset] = nets[other][debt.Asset].Add(amount)
+	}
+
+	others := make([]string, 0, len(nets))
+	for other := range nets {
+		others = append(others, other)
+	}
+	sort.Strings(others)
+
+	for _, other := range others {
+		counterparty := Counterparty{User: other, Balances: []NetBalance{}}
+		for asset, amount := range nets[other] {
+			if amount.Equals(decimal.Decimal{}) {
+				continue
+			}
+			counterparty.Balances = append(counterparty.Balances,
+				NetBalance{asset, amount})
+		}
+		if len(counterparty.Balances) == 0 {
+			continue
+		}
+
+		sort.Slice(counterparty.Balances, func(i, j int) bool {
+			return counterparty.Balances[i].Asset < counterparty.Balances[j].Asset
+		})
+		counterparties = append(counterparties, counterparty)
+	}
+
+	return
+}
+
+// StatementEntry is something that moved the balance between two users.
+// `Balance` is the running total of its asset after it.
+type StatementEntry struct {
+	Date        time.Time       `json:"date"`
+	Kind        string          `json:"kind"` // "thing", "payment", "settlement" or "netting"
+	Id          string          `json:"id"`
+	Description string          `json:"description"`
+	Asset       string          `json:"asset"`
+	Amount      decimal.Decimal `json:"amount"`
+	Balance     decimal.Decimal `json:"balance"`
+	Transaction string          `json:"txn"`
+}
+
+// statement lists, oldest first, everything that moved the balance between
+// `userId` and `withId` from `from` to `to` (both "2006-01-02", inclusive,
+// blank for no limit). running totals count what came before `from` too.
+func (app *App) statement(userId, withId, from, to string) (entries []StatementEntry, err error) {
+	entries = []StatementEntry{}
+
+	var since, until time.Time
+	if from != "" {
+		since, err = time.Parse("2006-01-02", from)
+		if err != nil {
+			return entries, errors.New("invalid-date")
+		}
+	}
+	if to != "" {
+		until, err = time.Parse("2006-01-02", to)
+		if err != nil {
+			return entries, errors.New("invalid-date")
+		}
+		until = until.AddDate(0, 0, 1)
+	}
+
+	var all []StatementEntry
+
+	// published things both took part in
+	var things []Thing
+	err = app.pg.Select(&things, `
+SELECT `+(Thing{}).columns()+` FROM things
+WHERE coalesce(txn, '') != ''
+  AND EXISTS (SELECT 1 FROM parties WHERE thing_id = things.id AND user_id = $1)
+  AND EXISTS (SELECT 1 FROM parties WHERE thing_id = things.id AND user_id = $2)
+    `, userId, withId)
+	if err != nil {
+		log.Warn().Err(err).Str("user", userId).Str("with", withId).
+			Msg("failed to load things for statement")
+		return
+	}
+	for _, thing := range things {
+		err = thing.fillParties(app)
+		if err != nil {
+			return
+		}
+		var debts []Transfer
+		debts, err = thing.debts(app)
+		if err != nil {
+			return
+		}
+
+		amount := decimal.Decimal{}
+		for _, debt := range debts {
+			if debt.From == withId && debt.To == userId {
+				amount = amount.Add(debt.Amount)
+			} else if debt.From == userId && debt.To == withId {
+				amount = amount.Sub(debt.Amount)
+			}
+		}
+		if amount.Equals(decimal.Decimal{}) {
+			continue
+		}
+
+		date, _ := time.Parse(time.RFC3339, thing.ActualDate)
+		all = append(all, StatementEntry{
+			Date:        date,
+			Kind:        "thing",
+			Id:          thing.Id,
+			Description: thing.Name,
+			Asset:       thing.Asset,
+			Amount:      amount,
+			Transaction: thing.Transaction,
+		})
+	}
+
+	// paying someone makes us owe them more, with our IOUs, or them owe us
+	// less, with theirs. either way it lowers what we can claim from them.
+	// paying with a third party's IOUs doesn't touch what we owe each other.
+	var payments []Payment
+	err = app.pg.Select(&payments, `
+SELECT `+(Payment{}).columns()+` FROM payments
+WHERE ((from_user = $1 AND to_user = $2) OR (from_user = $2 AND to_user = $1))
+  AND dst_issuer IN (SELECT address FROM users WHERE id IN ($1, $2))
+    `, userId, withId)
+	if err != nil {
+		log.Warn().Err(err).Str("user", userId).Str("with", withId).
+			Msg("failed to load payments for statement")
+		return
+	}
+	for _, payment := range payments {
+		amount := payment.Amount
+		if payment.From == userId {
+			amount = amount.Neg()
+		}
+
+		date, _ := time.Parse(time.RFC3339, payment.CreatedAt)
+		all = append(all, StatementEntry{
+			Date:        date,
+			Kind:        "payment",
+			Id:          payment.Id,
+			Description: "payment",
+			Asset:       payment.DstAsset,
+			Amount:      amount,
+			Transaction: payment.Hash,
+		})
+	}
+
+	// and so do settlements, once their IOUs are burnt
+	var settlements []Settlement
+	err = app.pg.Select(&settlements, `
+SELECT `+(Settlement{}).columns()+` FROM settlements
+WHERE coalesce(txn, '') != ''
+  AND ((payer = $1 AND payee = $2) OR (payer = $2 AND payee = $1))
+    `, userId, withId)
+	if err != nil {
+		log.Warn().Err(err).Str("user", userId).Str("with", withId).
+			Msg("failed to load settlements for statement")
+		return
+	}
+	for _, settlement := range settlements {
+		amount := settlement.Amount
+		if settlement.Payer == withId {
+			amount = amount.Neg()
+		}
+
+		description := settlement.Method
+		if settlement.Reference != "" {
+			description += " " + settlement.Reference
+		}
+
+		date, _ := time.Parse(time.RFC3339, settlement.ActualDate)
+		all = append(all, StatementEntry{
+			Date:        date,
+			Kind:        "settlement",
+			Id:          settlement.Id,
+			Description: description,
+			Asset:       settlement.Asset,
+			Amount:      amount,
+			Transaction: settlement.Transaction,
+		})
+	}
+
+	// settlement plans replace our IOUs with others, one entry for each
+	// plan and asset.
+	netted, err := app.nettedTransfers(userId)
+	if err != nil {
+		return
+	}
+	nettings := make(map[[2]string]int)
+	for _, transfer := range netted {
+		amount := transfer.owed()
+		if transfer.From == userId && transfer.To == withId {
+			amount = amount.Neg()
+		} else if transfer.From != withId || transfer.To != userId {
+			continue
+		}
+
+		key := [2]string{transfer.PlanId, transfer.Asset}
+		i, ok := nettings[key]
+		if !ok {
+			date, _ := time.Parse(time.RFC3339, transfer.CreatedAt)
+			nettings[key] = len(all)
+			all = append(all, StatementEntry{
+				Date:        date,
+				Kind:        "netting",
+				Id:          transfer.PlanId,
+				Description: "settlement plan",
+				Asset:       transfer.Asset,
+				Transaction: transfer.Transaction,
+			})
+			i = len(all) - 1
+		}
+		all[i].Amount = all[i].Amount.Add(amount)
+	}
+
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Date.Before(all[j].Date)
+	})
+
+	totals := make(map[string]decimal.Decimal)
+	for _, entry := range all {
+		if entry.Kind == "netting" && entry.Amount.Equals(decimal.Decimal{}) {
+			continue
+		}
+		totals[entry.Asset] = totals[entry.Asset].Add(entry.Amount)
+		entry.Balance = totals[entry.Asset]
+
+		if !since.IsZero() && entry.Date.Before(since) {
+			continue
+		}
+		if !until.IsZero() && !entry.Date.Before(until) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+// netWith is what `other` owes `userId` in USD according to the IOUs on
+// the fake ledger.
+func netWith(t *testing.T, app *App, userId, other string) decimal.Decimal {
+	t.Helper()
+
+	users, err := app.loadGroup([]string{userId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counterparties, err := app.counterparties(users[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, counterparty := range counterparties {
+		if counterparty.User != other {
+			continue
+		}
+		for _, balance := range counterparty.Balances {
+			if balance.Asset == "USD" {
+				return balance.Amount
+			}
+		}
+	}
+	return decimal.Decimal{}
+}
+
+func TestStatementMatchesCounterparties(t *testing.T) {
+	app := newTestApp(t)
+
+	// bob owes alice 10, then alice owes bob 6.
+	publishTestThing(t, app, createTestThing(t, app, "dinner", "alice", "20",
+		map[string]interface{}{"account": "alice", "paid": "20"},
+		map[string]interface{}{"account": "bob", "paid": "0"},
+	))
+	publishTestThing(t, app, createTestThing(t, app, "lunch", "bob", "12",
+		map[string]interface{}{"account": "alice", "paid": "0"},
+		map[string]interface{}{"account": "bob", "paid": "12"},
+	))
+
+	// alice pays with bob's IOUs, bob with his own.
+	for _, payment := range []struct{ from, to, issuer, amount string }{
+		{"alice", "bob", "bob", "6"},
+		{"bob", "alice", "bob", "1"},
+	} {
+		r := sendTestPayment(t, app, payment.from, payment.to, payment.issuer, payment.amount)
+		if len(r.Errors) > 0 {
+			t.Fatal(r.Errors)
+		}
+	}
+
+	for _, pair := range [][2]string{{"alice", "bob"}, {"bob", "alice"}} {
+		entries, err := app.statement(pair[0], pair[1], "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 4 {
+			t.Fatalf("%s's statement with %s has %d entries, want 4",
+				pair[0], pair[1], len(entries))
+		}
+
+		balance := entries[len(entries)-1].Balance
+		net := netWith(t, app, pair[0], pair[1])
+		if !balance.Equals(net) {
+			t.Errorf("%s's statement with %s ends at %s, counterparties say %s",
+				pair[0], pair[1], balance, net)
+		}
+	}
+
+	if net := netWith(t, app, "alice", "bob"); !net.Equals(decimal.New(-1, 0)) {
+		t.Errorf("bob owes alice %s, want -1", net)
+	}
+}
@@ -1,45 +1,149 @@
 package main
 
 import (
-	"encoding/json"
+	"encoding/hex"
 	"errors"
 	"net/http"
-	"net/url"
-	"strconv"
+	"sort"
 	"strings"
 
+	"github.com/shopspring/decimal"
 	b "github.com/stellar/go/build"
 	"github.com/stellar/go/clients/horizon"
+	"github.com/stellar/go/network"
 	"github.com/stellar/go/xdr"
 )
 
-func createStellarTransaction() *b.TransactionBuilder {
+// passphrase used by the stellar/quickstart docker image when
+// running with --standalone.
+const standalonePassphrase = "Standalone Network ; February 2017"
+
+// passphrase of the in-memory network, see fakehorizon.go.
+const fakePassphrase = "Fake Network ; debtmoney"
+
+// stellarNetwork returns the horizon client and network for the given name,
+// which must be one of "test", "public", "standalone" or "fake".
+// horizonURL and passphrase override the defaults if not blank. the fake
+// network starts with the `source` account funded.
+func stellarNetwork(
+	name, horizonURL, passphrase, source string,
+) (client Horizon, network b.Network, err error) {
+	switch name {
+	case "test", "":
+		client = horizonClient{horizon.DefaultTestNetClient}
+		network = b.TestNetwork
+	case "public":
+		client = horizonClient{horizon.DefaultPublicNetClient}
+		network = b.PublicNetwork
+	case "standalone":
+		client = horizonClient{&horizon.Client{
+			URL:  "http://localhost:8000",
+			HTTP: http.DefaultClient,
+		}}
+		network = b.Network{standalonePassphrase}
+	case "fake":
+		network = b.Network{fakePassphrase}
+		if passphrase != "" {
+			network = b.Network{passphrase}
+		}
+		client = NewFakeHorizon(network.Passphrase, source)
+		return
+	default:
+		err = errors.New("unknown stellar network: '" + name + "'")
+		return
+	}
+
+	if horizonURL != "" {
+		client = horizonClient{&horizon.Client{
+			URL:  strings.TrimRight(horizonURL, "/"),
+			HTTP: http.DefaultClient,
+		}}
+	}
+	if passphrase != "" {
+		network = b.Network{passphrase}
+	}
+
+	return
+}
+
+// the sequence number is only set when submitting, see sequence.go.
+func (app *App) createStellarTransaction() *b.TransactionBuilder {
 	return b.Transaction(
-		n,
-		b.SourceAccount{s.SourceAddress},
-		b.AutoSequence{h},
+		app.n,
+		b.SourceAccount{app.s.SourceAddress},
+		b.Sequence{0},
 	)
 }
 
-func commitStellarTransaction(
+// rebuildStellarTransaction puts the memo and the operations of a stored
+// transaction body on a new transaction.
+func (app *App) rebuildStellarTransaction(body string) (*b.TransactionBuilder, error) {
+	var stored xdr.Transaction
+	err := xdr.SafeUnmarshalBase64(body, &stored)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := app.createStellarTransaction()
+	tx.TX.Memo = stored.Memo
+	tx.TX.Operations = stored.Operations
+	return tx, tx.Err
+}
+
+func (app *App) commitStellarTransaction(
 	tx *b.TransactionBuilder,
 	signers ...string,
 ) (hash string, err error) {
-	tx.TX.Fee = xdr.Uint32(100 * len(tx.TX.Operations))
+	hash, _, err = app.sequences.submit(app, tx, signers, nil)
+	return
+}
+
+// setStellarFee sets the fee of a transaction to `baseFee` stroops for each
+// of its operations.
+func setStellarFee(tx *b.TransactionBuilder, baseFee int) {
+	tx.TX.Fee = xdr.Uint32(baseFee * len(tx.TX.Operations))
+}
 
+// signStellarTransaction signs the transaction with the given (possibly
+// encrypted) seeds and returns the envelope blob, ready to be submitted or to
+// receive more signatures.
+func (app *App) signStellarTransaction(
+	tx *b.TransactionBuilder,
+	signers ...string,
+) (blob string, err error) {
 	if tx.Err != nil {
 		log.Warn().Err(err).Msg("failed to build transaction")
 		return "", tx.Err
 	}
 
-	txe := tx.Sign(signers...)
-	blob, err := txe.Base64()
+	// seeds are only decrypted here, right before signing
+	seeds := make([]string, len(signers))
+	for i, signer := range signers {
+		if signer == "" {
+			return "", errors.New("missing key for a non-custodial account")
+		}
+
+		seeds[i], err = app.openSeed(signer)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to decrypt seed")
+			return "", err
+		}
+	}
+
+	txe := tx.Sign(seeds...)
+	blob, err = txe.Base64()
 	if err != nil {
 		log.Warn().Err(err).Msg("failed to sign transaction")
 		return "", err
 	}
 
-	success, err := h.SubmitTransaction(blob)
+	return blob, nil
+}
+
+// submitStellarTransaction submits a signed envelope and returns its hash and
+// the fee charged for it, in stroops.
+func (app *App) submitStellarTransaction(blob string) (hash string, fee int64, err error) {
+	success, err := app.h.SubmitTransaction(blob)
 	if err != nil {
 		var herrmsg string
 		if herr, ok := err.(*horizon.Error); ok {
@@ -49,58 +153,247 @@ func commitStellarTransaction(
 			Err(err).Str("herr", herrmsg).
 			Str("xdr", blob).
 			Msg("failed to execute transaction")
-		return "", err
+		return "", 0, err
 	}
 
-	return success.Hash, nil
+	var result xdr.TransactionResult
+	err = xdr.SafeUnmarshalBase64(success.Result, &result)
+	if err != nil {
+		// it was applied anyway
+		log.Warn().Err(err).Str("tx", success.Hash).Msg("invalid transaction result")
+		return success.Hash, 0, nil
+	}
+	fee = int64(result.FeeCharged)
+
+	log.Info().
+		Str("tx", success.Hash).
+		Str("fee", stroopsToXLM(fee)).
+		Msg("transaction applied")
+	return success.Hash, fee, nil
 }
 
-func formatHorizonError(herr *horizon.Error) string {
-	c, err := herr.ResultCodes()
-	if c == nil {
-		return err.Error()
+// stellar doesn't take transactions with more operations than this.
+const maxOperations = 100
+
+// transactions that wait for signatures get one more operation and one
+// more signature, see pendingEnvelope.
+const maxBatchOperations = maxOperations - 1
+
+// nor with more signatures than this. besides the signers of its operations
+// each batch is signed by our source account and maybe a channel account.
+const (
+	maxSignatures      = 20
+	maxBatchSignatures = maxSignatures - 2
+)
+
+// the order in which operations must be applied when they are spread over
+// many transactions: accounts must exist before they can trust an issuer,
+// and must trust it before receiving its IOUs, which are then offered.
+const (
+	setupStep = iota
+	trustStep
+	paymentStep
+	offerStep
+)
+
+// Operation is a transaction mutator, the step it belongs to and the user
+// whose key must sign it, which is blank for operations of the source account.
+type Operation struct {
+	Step    int
+	Signer  User
+	Mutator b.TransactionMutator
+}
+
+// batchOperations sorts the operations by step and splits them in groups
+// that fit in a transaction, both by their number and by the keys that must
+// sign them. applying the groups in order guarantees every operation comes
+// after the ones it depends on.
+func batchOperations(operations []Operation) (batches [][]Operation) {
+	sort.SliceStable(operations, func(i, j int) bool {
+		return operations[i].Step < operations[j].Step
+	})
+
+	var batch []Operation
+	signers := make(map[string]bool)
+	for _, op := range operations {
+		newSigner := op.Signer.Address != "" && !signers[op.Signer.Address]
+		if len(batch) == maxBatchOperations ||
+			(newSigner && len(signers) == maxBatchSignatures) {
+			batches = append(batches, batch)
+			batch = nil
+			signers = make(map[string]bool)
+		}
+
+		batch = append(batch, op)
+		if op.Signer.Address != "" {
+			signers[op.Signer.Address] = true
+		}
 	}
-	return /* herr.Problem.Detail + ". " + */ c.TransactionCode + ": [ " + strings.Join(c.OperationCodes, ", ") + " ]"
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return
 }
 
-func findPaths(
-	from_address string,
-	to_address string,
-	to_asset Asset,
-) (data HorizonPathResponse, err error) {
-	qs := url.Values{}
+// batchSigners returns the users, other than the source account, whose keys
+// must sign a batch of operations.
+func batchSigners(batch []Operation) (signers []User) {
+	seen := make(map[string]bool)
+	for _, op := range batch {
+		if op.Signer.Address == "" || seen[op.Signer.Address] {
+			continue
+		}
+		seen[op.Signer.Address] = true
+		signers = append(signers, op.Signer)
+	}
+	return
+}
 
-	qs.Set("source_account", from_address)
-	qs.Set("destination_account", to_address)
-	qs.Set("destination_asset_type", "credit_alphanum4")
-	qs.Set("destination_asset_code", to_asset.Code)
-	qs.Set("destination_asset_issuer", to_asset.IssuerAddress)
-	qs.Set("destination_amount", "1")
+// issueOperations returns the operations needed for `from` to issue `value`
+// of its IOU `asset` to `to`: a trustline, the payment and an offer that
+// allows the IOUs to be rippled. it also returns how many lumens `to` will
+// need for reserves.
+func (app *App) issueOperations(
+	from, to User,
+	asset string,
+	value decimal.Decimal,
+) (operations []Operation, funds int, err error) {
+	// create or expand the trustline needed
+	fund, trustness, didtrust, err := to.trust(app, from, asset, app.formatAmount(value, asset))
+	if err != nil {
+		log.Warn().
+			Str("from", from.Id).
+			Str("to", to.Id).
+			Str("value", app.formatAmount(value, asset)).
+			Err(err).Msg("failed to create trustline mutator")
+		return
+	}
 
-	var resp *http.Response
-	resp, err = http.Get(h.URL + "/paths?" + qs.Encode())
+	if didtrust {
+		operations = append(operations, Operation{
+			Step:    trustStep,
+			Signer:  to,
+			Mutator: trustness,
+		})
+	}
+	if fund {
+		funds += 10
+	}
+
+	// do the payment
+	operations = append(operations, Operation{
+		Step:   paymentStep,
+		Signer: from,
+		Mutator: b.Payment(
+			b.SourceAccount{from.Address},
+			b.Destination{to.Address},
+			b.CreditAmount{asset, from.Address, app.formatAmount(value, asset)},
+		),
+	})
+
+	// create an offer
+	fund, offerness, err := to.offer(app,
+		from, asset, to, asset, "1", app.formatAmount(value, asset))
 	if err != nil {
+		log.Warn().
+			Str("offerer", from.Id).
+			Str("asset-issuer", to.Id).
+			Str("value", app.formatAmount(value, asset)).
+			Err(err).Msg("failed to create offer mutator")
 		return
 	}
-	if resp.StatusCode >= 300 {
-		err = errors.New("Horizon returned status " + strconv.Itoa(resp.StatusCode))
+	if fund {
+		funds += 10
+	}
+	if _, nothing := offerness.(b.Defaults); !nothing {
+		operations = append(operations, Operation{
+			Step:    offerStep,
+			Signer:  to,
+			Mutator: offerness,
+		})
 	}
 
-	err = json.NewDecoder(resp.Body).Decode(&data)
 	return
 }
 
-type HorizonPathResponse struct {
-	Embedded struct {
-		Records []struct {
-			SrcAssetCode   string `json:"source_asset_code"`
-			SrcAssetIssuer string `json:"source_asset_issuer"`
-			Intermediaries []struct {
-				Code   string `json:"asset_code"`
-				Issuer string `json:"asset_issuer"`
-			} `json:"path"`
-			DstAssetCode   string `json:"destination_asset_code"`
-			DstAssetIssuer string `json:"destination_asset_issuer"`
-		} `json:"records"`
-	} `json:"_embedded"`
+// setupOperations creates on stellar the accounts that don't exist yet and
+// funds the existing ones with the lumens specified in `tofund`.
+func (app *App) setupOperations(users []User, tofund map[string]int) []Operation {
+	var accountsetups []Operation
+
+	for _, user := range users {
+		neededfunds := tofund[user.Id]
+
+		if user.ha.ID == "" {
+			// doesn't exist on stellar, will create
+			accountsetups = append(accountsetups, Operation{
+				Step:    setupStep,
+				Mutator: user.fundInitial(app, neededfunds+20),
+			})
+
+			// we can't touch the options of accounts we don't control
+			if user.custodial() {
+				_, domain := app.federationAddress(user.Id)
+				accountsetups = append(accountsetups, Operation{
+					Step:   setupStep,
+					Signer: user,
+					Mutator: b.SetOptions(
+						b.SourceAccount{user.Address},
+						b.HomeDomain(domain),
+					),
+				})
+			}
+		} else if neededfunds > 0 {
+			accountsetups = append(accountsetups, Operation{
+				Step:    setupStep,
+				Mutator: user.fund(app, neededfunds),
+			})
+		}
+	}
+
+	return accountsetups
+}
+
+// envelopeHash returns the hash horizon will give to a transaction envelope.
+func (app *App) envelopeHash(blob string) (string, error) {
+	var envelope xdr.TransactionEnvelope
+	err := xdr.SafeUnmarshalBase64(blob, &envelope)
+	if err != nil {
+		return "", err
+	}
+
+	hash, err := network.HashTransaction(&envelope.Tx, app.n.Passphrase)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// badSequence tells if horizon refused a transaction because its sequence
+// number was already used.
+func badSequence(err error) bool {
+	return transactionCode(err) == "tx_bad_seq"
+}
+
+// insufficientFee tells if horizon refused a transaction because the fee it
+// offered was too low for the current network load.
+func insufficientFee(err error) bool {
+	return transactionCode(err) == "tx_insufficient_fee"
+}
+
+func transactionCode(err error) string {
+	if herr, ok := err.(*horizon.Error); ok {
+		if c, _ := herr.ResultCodes(); c != nil {
+			return c.TransactionCode
+		}
+	}
+	return ""
+}
+
+func formatHorizonError(herr *horizon.Error) string {
+	c, err := herr.ResultCodes()
+	if c == nil {
+		return err.Error()
+	}
+	return /* herr.Problem.Detail + ". " + */ c.TransactionCode + ": [ " + strings.Join(c.OperationCodes, ", ") + " ]"
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestBatchOperations(t *testing.T) {
+	op := func(step int, signer string) Operation {
+		return Operation{Step: step, Signer: User{Address: signer}}
+	}
+
+	for _, test := range []struct {
+		name       string
+		operations []Operation
+		sizes      []int
+	}{
+		{"empty", nil, nil},
+		{"one", []Operation{op(paymentStep, "")}, []int{1}},
+		{
+			"too many operations",
+			func() (ops []Operation) {
+				for i := 0; i < 2*maxBatchOperations+1; i++ {
+					ops = append(ops, op(paymentStep, "alice"))
+				}
+				return
+			}(),
+			[]int{maxBatchOperations, maxBatchOperations, 1},
+		},
+		{
+			"too many signers",
+			func() (ops []Operation) {
+				for i := 0; i < maxBatchSignatures+5; i++ {
+					signer := "user" + strconv.Itoa(i)
+					ops = append(ops, op(trustStep, signer), op(paymentStep, signer))
+				}
+				return
+			}(),
+			[]int{2 * maxBatchSignatures, 10},
+		},
+		{
+			"source operations don't need more signers",
+			func() (ops []Operation) {
+				for i := 0; i < maxBatchSignatures; i++ {
+					ops = append(ops, op(paymentStep, "user"+strconv.Itoa(i)))
+				}
+				return append(ops, op(setupStep, ""), op(offerStep, ""))
+			}(),
+			[]int{maxBatchSignatures + 2},
+		},
+	} {
+		batches := batchOperations(test.operations)
+		if len(batches) != len(test.sizes) {
+			t.Errorf("%s: %d batches, want %d", test.name, len(batches), len(test.sizes))
+			continue
+		}
+
+		lastStep := -1
+		for i, batch := range batches {
+			if len(batch) != test.sizes[i] {
+				t.Errorf("%s: batch %d has %d operations, want %d",
+					test.name, i, len(batch), test.sizes[i])
+			}
+			if n := len(batchSigners(batch)) + 2; n > maxSignatures {
+				t.Errorf("%s: batch %d needs %d signatures", test.name, i, n)
+			}
+			for _, op := range batch {
+				if op.Step < lastStep {
+					t.Errorf("%s: batch %d is out of order", test.name, i)
+				}
+				lastStep = op.Step
+			}
+		}
+	}
+}
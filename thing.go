@@ -1,14 +1,15 @@
 package main
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 	"strings"
 	"sync"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/shopspring/decimal"
-	b "github.com/stellar/go/build"
 )
 
 type Thing struct {
@@ -21,9 +22,12 @@ type Thing struct {
 	TotalDue    decimal.Decimal `json:"total_due"     db:"total_due"`
 	TotalDueSet bool            `json:"total_due_set" db:"total_due_set"`
 	Transaction string          `json:"txn"           db:"txn"`
+	Envelope    string          `json:"envelope"      db:"envelope"`
 	Publishable bool            `json:"publishable"   db:"publishable"`
+	SplitMode   string          `json:"split_mode"    db:"split_mode"`
 
 	Parties []Party `json:"parties"`
+	Items   []Item  `json:"items"`
 
 	Peers map[string]User `json:"-"`
 }
@@ -39,22 +43,25 @@ coalesce(total_due, '0') AS total_due,
 total_due IS NOT NULL AS total_due_set,
 asset,
 coalesce(txn, '') AS txn,
-things.publishable
+coalesce(envelope, '') AS envelope,
+things.publishable,
+split_mode
     `
 }
 
-func (thing *Thing) fillParties() (err error) {
+func (thing *Thing) fillParties(app *App) (err error) {
 	if thing.Parties != nil && len(thing.Parties) > 0 {
 		return nil
 	}
 
 	thing.Parties = []Party{}
-	err = pg.Select(
+	err = app.pg.Select(
 		&thing.Parties, `
 SELECT `+(Party{}).columns()+`, `+(User{}).columns()+`
 FROM parties
 LEFT JOIN users ON users.id = parties.user_id
-WHERE thing_id = $1;
+WHERE thing_id = $1
+ORDER BY account_name;
         `, thing.Id)
 	if err != nil {
 		log.Error().Str("thing", thing.Id).Err(err).
@@ -69,7 +76,7 @@ WHERE thing_id = $1;
 		wg.Add(1)
 		go func(index int, addr string) {
 			defer wg.Done()
-			ha, _ := h.LoadAccount(addr)
+			ha, _ := app.h.LoadAccount(addr)
 			thing.Parties[index].User.ha = ha
 		}(i, x.User.Address)
 	}
@@ -85,6 +92,8 @@ type Party struct {
 	Paid        decimal.Decimal `json:"paid"         db:"paid"`
 	Due         decimal.Decimal `json:"due"          db:"due"`
 	DueSet      bool            `json:"due_set"      db:"due_set"`
+	Weight      decimal.Decimal `json:"weight"       db:"weight"`
+	WeightSet   bool            `json:"weight_set"   db:"weight_set"`
 	Note        string          `json:"note"         db:"note"`
 	AddedBy     string          `json:"added_by"     db:"added_by"`
 	Confirmed   bool            `json:"confirmed"    db:"confirmed"`
@@ -99,33 +108,121 @@ func (p Party) columns() string {
 thing_id, account_name, added_by, confirmed,
 coalesce(due, '0') AS due,
 due IS NOT NULL AS due_set,
+coalesce(weight, '0') AS weight,
+weight IS NOT NULL AS weight_set,
 coalesce(paid, '0') AS paid,
 coalesce(user_id, '') AS user_id,
 coalesce(note, '') AS note
     `
 }
 
+// errors returned to the client when an operation on a thing is denied.
+var (
+	errThingNotFound    = errors.New("thing-not-found")
+	errNotAllowed       = errors.New("not-allowed")
+	errAlreadyPublished = errors.New("already-published")
+)
+
+// ThingAccess describes the relation between a user and a thing.
+type ThingAccess struct {
+	CreatedBy  string `db:"created_by"`
+	Txn        string `db:"txn"`
+	Publishing bool   `db:"publishing"`
+	IsParty    bool   `db:"is_party"`
+
+	userId string
+}
+
+func (app *App) getThingAccess(id, userId string) (access ThingAccess, err error) {
+	err = app.pg.Get(&access, `
+SELECT
+  created_by,
+  coalesce(txn, '') AS txn,
+  things.envelope IS NOT NULL OR EXISTS (
+    SELECT 1 FROM thing_transactions WHERE thing_id = things.id
+  ) OR EXISTS (
+    SELECT 1 FROM publications
+    WHERE thing_id = things.id AND status IN ('pending', 'submitted')
+  ) AS publishing,
+  EXISTS (
+    SELECT 1 FROM parties WHERE thing_id = things.id AND user_id = $2
+  ) AS is_party
+FROM things
+WHERE id = $1
+    `, id, userId)
+	if err == sql.ErrNoRows {
+		return access, errThingNotFound
+	} else if err != nil {
+		log.Warn().Err(err).Str("thing", id).Msg("failed to load thing access")
+		return
+	}
+
+	access.userId = userId
+	return
+}
+
+func (access ThingAccess) isCreator() bool {
+	return access.userId != "" && access.userId == access.CreatedBy
+}
+
+// only the creator and the parties can edit a thing, and only before it
+// starts being published.
+func (access ThingAccess) canEdit() error {
+	if !access.isCreator() && !access.IsParty {
+		return errNotAllowed
+	}
+	if access.Txn != "" || access.Publishing {
+		return errAlreadyPublished
+	}
+	return nil
+}
+
+// only the creator can delete a thing, and only before it starts being
+// published.
+func (access ThingAccess) canDelete() error {
+	if !access.isCreator() {
+		return errNotAllowed
+	}
+	if access.Txn != "" || access.Publishing {
+		return errAlreadyPublished
+	}
+	return nil
+}
+
+// the creator and the parties can trigger the publication of a thing.
+func (access ThingAccess) canPublish() error {
+	if !access.isCreator() && !access.IsParty {
+		return errNotAllowed
+	}
+	return nil
+}
+
 func insertThing(
 	txn *sqlx.Tx,
-	id, date, user_id, name, asset, total_due string,
+	id, date, created_by, added_by, name, asset, total_due, split_mode string,
 	parties []interface{},
+	items []interface{},
 ) (Thing, error) {
 	log.Info().Str("thing", id).Msg("inserting thing in transaction")
 	var thing Thing
 	var err error
 
+	if split_mode == "" {
+		split_mode = "equal"
+	}
+
 	err = txn.Get(&thing, `
-INSERT INTO things (id, actual_date, name, asset, total_due, created_by)
-VALUES ($1, $2, $3, $4, nullable($5), $6)
+INSERT INTO things (id, actual_date, name, asset, total_due, created_by, split_mode)
+VALUES ($1, $2, $3, $4, nullable($5), $6, $7)
 RETURNING `+thing.columns(),
-		id, date, name, asset, total_due, user_id)
+		id, date, name, asset, total_due, created_by, split_mode)
 	if err != nil {
 		log.Warn().Err(err).Msg("when inserting a new thing")
 		return thing, err
 	}
 
 	partiesSQL := make([]string, len(parties))
-	partiesValues := make([]interface{}, len(parties)*6)
+	partiesValues := make([]interface{}, len(parties)*7)
 	for i, iparty := range parties {
 		party := iparty.(map[string]interface{})
 		partiesSQL[i] = fmt.Sprintf(`
@@ -135,19 +232,21 @@ RETURNING `+thing.columns(),
   $%d,
   nullable($%d),
   nullable($%d),
+  nullable($%d),
   $%d
 )
-        `, i*6+1, i*6+2, i*6+3, i*6+4, i*6+5, i*6+6)
-		partiesValues[(i*6)+0] = party["account"]
-		partiesValues[(i*6)+1] = party["account"]
-		partiesValues[(i*6)+2] = id
-		partiesValues[(i*6)+3] = party["due"]
-		partiesValues[(i*6)+4] = party["paid"]
-		partiesValues[(i*6)+5] = user_id
+        `, i*7+1, i*7+2, i*7+3, i*7+4, i*7+5, i*7+6, i*7+7)
+		partiesValues[(i*7)+0] = party["account"]
+		partiesValues[(i*7)+1] = party["account"]
+		partiesValues[(i*7)+2] = id
+		partiesValues[(i*7)+3] = party["due"]
+		partiesValues[(i*7)+4] = party["paid"]
+		partiesValues[(i*7)+5] = party["weight"]
+		partiesValues[(i*7)+6] = added_by
 	}
 
 	err = txn.Select(&thing.Parties, `
-INSERT INTO parties (user_id, account_name, thing_id, due, paid, added_by)
+INSERT INTO parties (user_id, account_name, thing_id, due, paid, weight, added_by)
 VALUES `+strings.Join(partiesSQL, ",")+`
 RETURNING `+(Party{}).columns(),
 		partiesValues...)
@@ -155,6 +254,31 @@ RETURNING `+(Party{}).columns(),
 		log.Warn().Err(err).Msg("when inserting all parties for a thing")
 		return thing, err
 	}
+
+	thing.Items = make([]Item, 0, len(items))
+	for _, iitem := range items {
+		item := iitem.(map[string]interface{})
+
+		var accounts []string
+		iaccounts, _ := item["accounts"].([]interface{})
+		for _, iaccount := range iaccounts {
+			account, _ := iaccount.(string)
+			accounts = append(accounts, account)
+		}
+
+		var inserted Item
+		err = txn.Get(&inserted, `
+INSERT INTO thing_items (thing_id, description, amount, accounts)
+VALUES ($1, $2, $3, $4)
+RETURNING `+inserted.columns(),
+			id, item["description"], item["amount"], pq.StringArray(accounts))
+		if err != nil {
+			log.Warn().Err(err).Msg("when inserting items for a thing")
+			return thing, err
+		}
+		thing.Items = append(thing.Items, inserted)
+	}
+
 	return thing, err
 }
 
@@ -164,6 +288,9 @@ func deleteThing(txn *sqlx.Tx, id string) error {
 	var hash string
 	err := txn.Get(&hash, `
 WITH dp AS ( DELETE FROM parties WHERE thing_id = $1 )
+   , di AS ( DELETE FROM thing_items WHERE thing_id = $1 )
+   , ds AS ( DELETE FROM pending_signatures WHERE thing_id = $1 )
+   , dq AS ( DELETE FROM publications WHERE thing_id = $1 AND status != 'confirmed' )
    , dt AS ( DELETE FROM things WHERE id = $1 )
 SELECT txn FROM things WHERE id = $1
     `, id)
@@ -171,42 +298,71 @@ SELECT txn FROM things WHERE id = $1
 		return err
 	}
 	if hash != "" {
-		return errors.New("transaction already published, can't delete")
+		return errAlreadyPublished
 	}
 
 	return nil
 }
 
-func confirmThing(id, userId string, confirm bool) (thing Thing, published bool, err error) {
+func (app *App) confirmThing(id, userId string, confirm bool) (thing Thing, queued bool, err error) {
 	log.Info().
 		Str("thing", id).
 		Str("user", userId).
 		Bool("confirm", confirm).
 		Msg("updating record with confirmation")
 
-	err = pg.Get(&thing, `
+	// confirmations can't change anymore once the publication is queued or
+	// some of its transactions were planned or sent.
+	err = app.pg.Get(&thing, `
 WITH upd AS (
   UPDATE parties
   SET confirmed = $3
   WHERE thing_id = $1 AND user_id = $2
+    AND NOT EXISTS (
+      SELECT 1 FROM things
+      WHERE id = $1 AND (coalesce(txn, '') != '' OR envelope IS NOT NULL)
+    )
+    AND NOT EXISTS (SELECT 1 FROM thing_transactions WHERE thing_id = $1)
+    AND NOT EXISTS (
+      SELECT 1 FROM publications
+      WHERE thing_id = $1 AND status IN ('pending', 'submitted')
+    )
   RETURNING thing_id
 )
 SELECT `+thing.columns()+`, things.publishable FROM things
 WHERE id = (SELECT thing_id FROM upd)
     `, id, userId, confirm)
-	if err != nil {
+	if err == sql.ErrNoRows {
+		var publishing bool
+		err = app.pg.Get(&publishing, `
+SELECT EXISTS (
+  SELECT 1 FROM things
+  WHERE id = $1 AND (coalesce(txn, '') != '' OR envelope IS NOT NULL)
+) OR EXISTS (
+  SELECT 1 FROM thing_transactions WHERE thing_id = $1
+) OR EXISTS (
+  SELECT 1 FROM publications
+  WHERE thing_id = $1 AND status IN ('pending', 'submitted')
+)
+        `, id)
+		if err == nil && publishing {
+			return thing, false, errAlreadyPublished
+		}
+		return thing, false, errors.New("couldn't confirm.")
+	} else if err != nil {
 		log.Error().Err(err).Msg("error appending confirmation")
 		return thing, false, errors.New("couldn't confirm.")
 	}
 
 	if thing.Publishable {
-		published, err = thing.publish()
+		err = enqueuePublication(app.pg, thing.Id)
+		queued = err == nil
 	}
 
 	return
 }
 
-func (thing Thing) publish() (published bool, err error) {
+func (thing Thing) publish(app *App) (published bool, err error) {
 	log.Info().Str("thing", thing.Id).Msg("publishing")
 
 	if thing.Transaction != "" {
@@ -215,11 +371,74 @@ func (thing Thing) publish() (published bool, err error) {
 		return
 	}
 
-	err = thing.fillParties()
+	if thing.Envelope != "" {
+		log.Info().Msg("already built, waiting for signatures")
+		return
+	}
+
+	// a previous attempt may have been interrupted midway
+	planned, err := thing.plannedTransactions(app)
 	if err != nil {
 		return
 	}
+	if len(planned) > 0 {
+		return thing.submitTransactions(app)
+	}
 
+	err = thing.fillParties(app)
+	if err != nil {
+		return
+	}
+
+	debts, err := thing.debts(app)
+	if err != nil {
+		return
+	}
+
+	// we must keep track of the total funding each account will have to receive
+	byId := make(map[string]User, len(thing.Parties))
+	tofund := make(map[string]int)
+	for _, party := range thing.Parties {
+		byId[party.User.Id] = party.User
+		tofund[party.User.Id] = 0
+	}
+
+	// let's also store all the transaction operations
+	var operations []Operation
+
+	// for each debt, we will issue the IOUs
+	for _, debt := range debts {
+		var ops []Operation
+		var funds int
+		ops, funds, err = app.issueOperations(
+			byId[debt.From], byId[debt.To], thing.Asset, debt.Amount)
+		if err != nil {
+			return
+		}
+
+		operations = append(operations, ops...)
+		tofund[debt.To] += funds
+	}
+
+	// now we'll determine if the accounts need to be created
+	users := make([]User, len(thing.Parties))
+	for i, party := range thing.Parties {
+		users[i] = party.User
+	}
+	operations = append(operations, app.setupOperations(users, tofund)...)
+
+	err = thing.planTransactions(app, batchOperations(operations), debts)
+	if err != nil {
+		return
+	}
+
+	return thing.submitTransactions(app)
+}
+
+// debts returns the IOUs a thing creates: how much each party that paid less
+// than their due must issue to each party that paid more. parties must have
+// been filled before.
+func (thing *Thing) debts(app *App) (debts []Transfer, err error) {
 	// determining who must receive and who must issue IOUs
 	// -- we trust the total owed equals the total overpaid
 
@@ -228,33 +447,13 @@ func (thing Thing) publish() (published bool, err error) {
 	totalLent := decimal.Decimal{}     // not the total amount paid, just the difference
 	totalBorrowed := decimal.Decimal{} // not the total amount due, ...
 
-	var splittedDue decimal.Decimal
-	remainingDue := decimal.Decimal{}
-	if thing.TotalDueSet {
-		dueUnsetCount := int64(0)
-		totalSet := decimal.Decimal{}
-		for _, x := range thing.Parties {
-			if x.DueSet {
-				totalSet = totalSet.Add(x.Due)
-			} else {
-				dueUnsetCount += 1
-			}
-		}
-		remainingDue = thing.TotalDue.Sub(totalSet)
-		splittedDue = remainingDue.DivRound(decimal.New(dueUnsetCount, 0), 2)
+	err = thing.computeDues(app)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to compute dues")
+		return
 	}
 
-	for i, x := range thing.Parties {
-		x.workingDue = x.Due
-		if !x.DueSet {
-			if i == len(thing.Parties)-1 {
-				x.workingDue = remainingDue
-			} else {
-				x.workingDue = splittedDue
-				remainingDue = remainingDue.Sub(splittedDue)
-			}
-		}
-
+	for _, x := range thing.Parties {
 		if x.workingDue.GreaterThan(x.Paid) {
 			issuers = append(issuers, x)
 			totalBorrowed = totalBorrowed.Add(x.workingDue.Sub(x.Paid))
@@ -279,161 +478,41 @@ func (thing Thing) publish() (published bool, err error) {
 	}
 
 	// now whom will receive from whom?
-	total := totalLent
 
 	// -- determine the share each must receive
-	// -- and make a list of all "payment pairs" we must issue
-	type pair struct {
-		value decimal.Decimal
-		from  User
-		to    User
+	// -- and make a list of all the IOUs we must issue
+
+	// each issuer splits its debt proportionally to what is still owed to
+	// each receiver, so the last issuer takes exactly what is left and both
+	// the issued and the received totals reconcile to the last unit of the asset.
+	owed := make([]decimal.Decimal, len(receivers))
+	for i, rec := range receivers {
+		owed[i] = rec.Paid.Sub(rec.workingDue)
 	}
-	var pairs []pair
+	start := rotation(thing.Id, len(receivers))
 
 	for _, iss := range issuers {
-		totalAssigned := decimal.Decimal{}
-
-		for i, rec := range receivers {
-			var value decimal.Decimal
-			if i != len(receivers)-1 {
-				value = iss.workingDue.Sub(iss.Paid).
-					Mul(rec.Paid.Sub(rec.workingDue)).
-					DivRound(total, 2)
-				totalAssigned = totalAssigned.Add(value)
-			} else {
-				// last one will take the remnant
-				value = total.Sub(totalAssigned)
-			}
-
-			pairs = append(pairs, pair{value, iss.User, rec.User})
-		}
-	}
-
-	// we must keep track of the total funding each account will have to receive
-	tofund := make(map[string]int)
-	for _, party := range thing.Parties {
-		tofund[party.User.Id] = 0
-	}
-
-	// let's also store all the transaction operations
-	var operations []b.TransactionMutator
-
-	// keep track of all private keys that will have to be used for signing
-	keys := make(map[string]string)
-
-	// for each payment pair, we will
-	for _, pair := range pairs {
-		// create or expand the trustline needed
-		var fund bool
-		var trustness b.TransactionMutator
-		var didtrust bool
-		fund, trustness, didtrust, err = pair.to.trust(
-			pair.from,
-			thing.Asset,
-			pair.value.StringFixed(2),
-		)
-		if err != nil {
-			log.Warn().
-				Str("from", pair.from.Id).
-				Str("to", pair.to.Id).
-				Str("value", pair.value.StringFixed(2)).
-				Err(err).Msg("failed to create trustline mutator")
-			return
-		}
-
-		// the transaction must always be signed by the issuing party
-		keys[pair.from.Id] = pair.from.Seed
-		if didtrust {
-			// in the cases which no trustline was created,
-			// we can't sign the transaction as the receiving party
-			keys[pair.to.Id] = pair.to.Seed
-		}
-
-		operations = append(operations, trustness)
-		if fund {
-			tofund[pair.to.Id] += 10
-		}
-
-		// do the payment
-		paymentness := b.Payment(
-			b.SourceAccount{pair.from.Address},
-			b.Destination{pair.to.Address},
-			b.CreditAmount{thing.Asset, pair.from.Address, pair.value.StringFixed(2)},
-		)
-		operations = append(operations, paymentness)
-
-		// create an offer
-		var offerness b.TransactionMutator
-		fund, offerness, err = pair.to.offer(
-			pair.from, thing.Asset, pair.to, thing.Asset, "1", pair.value.StringFixed(2))
+		var values []decimal.Decimal
+		values, err = allocate(iss.workingDue.Sub(iss.Paid), owed,
+			app.assetPrecision(thing.Asset), start)
 		if err != nil {
-			log.Warn().
-				Str("offerer", pair.from.Id).
-				Str("asset-issuer", pair.to.Id).
-				Str("value", pair.value.StringFixed(2)).
-				Err(err).Msg("failed to create offer mutator")
+			log.Warn().Err(err).Str("issuer", iss.User.Id).
+				Msg("failed to split debt among receivers")
 			return
 		}
-		if fund {
-			tofund[pair.to.Id] += 10
-		}
-		operations = append(operations, offerness)
-	}
-
-	// now we'll determine if the accounts need to be created
-	var accountsetups []b.TransactionMutator
 
-	for _, party := range thing.Parties {
-		neededfunds := tofund[party.User.Id]
-
-		if party.User.ha.ID == "" {
-			// doesn't exist on stellar, will create
-			accountness := party.User.fundInitial(neededfunds + 20)
-			accountsetups = append(accountsetups, accountness)
-			homedomainess := b.SetOptions(
-				b.SourceAccount{party.User.Address},
-				b.HomeDomain("debtmoney.xyz"),
-			)
-			accountsetups = append(accountsetups, homedomainess)
-		} else if neededfunds > 0 {
-			accountness := party.User.fund(neededfunds)
-			accountsetups = append(accountsetups, accountness)
-		}
-	}
-
-	log.Info().Msg("publishing a single transaction")
-	tx := createStellarTransaction()
-
-	tx.Mutate(b.MemoText{thing.Id})
-	tx.Mutate(accountsetups...)
-	tx.Mutate(operations...)
-
-	seeds := make([]string, len(keys)+1)
-	i := 0
-	for _, key := range keys {
-		seeds[i] = key
-		i++
-	}
-	seeds[i] = s.SourceSeed
-
-	hash, err := commitStellarTransaction(tx, seeds...)
-	if err != nil {
-		return false, err
-	}
-
-	published = true
-
-	// now commit the postgres transaction
-	if err == nil {
-		_, err := pg.Exec(`
-UPDATE things SET txn = $1 WHERE id = $2
-		    `, hash, thing.Id)
+		for i, rec := range receivers {
+			owed[i] = owed[i].Sub(values[i])
+			if values[i].Equals(decimal.Decimal{}) {
+				continue
+			}
 
-		if err != nil {
-			log.Error().
-				Err(err).
-				Str("tx", hash).
-				Msg("failed to append hash to postgres after stellar transaction ")
+			debts = append(debts, Transfer{
+				From:   iss.User.Id,
+				To:     rec.User.Id,
+				Asset:  thing.Asset,
+				Amount: values[i],
+			})
 		}
 	}
 
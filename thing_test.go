@@ -0,0 +1,206 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestThingAccess(t *testing.T) {
+	creator := ThingAccess{CreatedBy: "alice", userId: "alice"}
+	party := ThingAccess{CreatedBy: "alice", IsParty: true, userId: "bob"}
+	stranger := ThingAccess{CreatedBy: "alice", userId: "carol"}
+	anonymous := ThingAccess{CreatedBy: "alice"}
+
+	published := func(access ThingAccess) ThingAccess {
+		access.Txn = "f00"
+		return access
+	}
+	publishing := func(access ThingAccess) ThingAccess {
+		access.Publishing = true
+		return access
+	}
+
+	for _, test := range []struct {
+		name    string
+		access  ThingAccess
+		edit    error
+		delete  error
+		publish error
+	}{
+		{"creator", creator, nil, nil, nil},
+		{"party", party, nil, errNotAllowed, nil},
+		{"stranger", stranger, errNotAllowed, errNotAllowed, errNotAllowed},
+		{"anonymous", anonymous, errNotAllowed, errNotAllowed, errNotAllowed},
+		{"creator, published", published(creator), errAlreadyPublished, errAlreadyPublished, nil},
+		{"party, published", published(party), errAlreadyPublished, errNotAllowed, nil},
+		{"stranger, published", published(stranger), errNotAllowed, errNotAllowed, errNotAllowed},
+		{"creator, publishing", publishing(creator), errAlreadyPublished, errAlreadyPublished, nil},
+		{"party, publishing", publishing(party), errAlreadyPublished, errNotAllowed, nil},
+	} {
+		if err := test.access.canEdit(); err != test.edit {
+			t.Errorf("%s: canEdit() = %v, want %v", test.name, err, test.edit)
+		}
+		if err := test.access.canDelete(); err != test.delete {
+			t.Errorf("%s: canDelete() = %v, want %v", test.name, err, test.delete)
+		}
+		if err := test.access.canPublish(); err != test.publish {
+			t.Errorf("%s: canPublish() = %v, want %v", test.name, err, test.publish)
+		}
+	}
+}
+
+func TestGetThingAccess(t *testing.T) {
+	app := newTestApp(t)
+
+	createTestThing(t, app, "dinner", "alice", "30",
+		map[string]interface{}{"account": "alice", "paid": "30"},
+		map[string]interface{}{"account": "bob", "paid": "0"},
+	)
+
+	for _, test := range []struct {
+		thing   string
+		user    string
+		edit    error
+		delete  error
+		publish error
+	}{
+		{"dinner", "alice", nil, nil, nil},
+		{"dinner", "bob", nil, errNotAllowed, nil},
+		{"dinner", "carol", errNotAllowed, errNotAllowed, errNotAllowed},
+		{"dinner", "", errNotAllowed, errNotAllowed, errNotAllowed},
+	} {
+		access, err := app.getThingAccess(test.thing, test.user)
+		if err != nil {
+			t.Fatalf("%s: %v", test.user, err)
+		}
+		if err := access.canEdit(); err != test.edit {
+			t.Errorf("%q: canEdit() = %v, want %v", test.user, err, test.edit)
+		}
+		if err := access.canDelete(); err != test.delete {
+			t.Errorf("%q: canDelete() = %v, want %v", test.user, err, test.delete)
+		}
+		if err := access.canPublish(); err != test.publish {
+			t.Errorf("%q: canPublish() = %v, want %v", test.user, err, test.publish)
+		}
+	}
+
+	_, err := app.pg.Exec(`UPDATE things SET txn = 'f00' WHERE id = 'dinner'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	access, err := app.getThingAccess("dinner", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := access.canEdit(); err != errAlreadyPublished {
+		t.Errorf("canEdit() after publishing = %v, want %v", err, errAlreadyPublished)
+	}
+
+	_, err = app.getThingAccess("nothing", "alice")
+	if err != errThingNotFound {
+		t.Errorf("getThingAccess() of a missing thing = %v, want %v", err, errThingNotFound)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	app := newTestApp(t)
+
+	dinner := createTestThing(t, app, "dinner", "alice", "30",
+		map[string]interface{}{"account": "alice", "paid": "30"},
+		map[string]interface{}{"account": "bob", "paid": "0"},
+		map[string]interface{}{"account": "carol", "paid": "0"},
+	)
+	publishTestThing(t, app, dinner)
+
+	var txn string
+	err := app.pg.Get(&txn, `SELECT coalesce(txn, '') FROM things WHERE id = 'dinner'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txn == "" {
+		t.Fatal("dinner has no transaction after publishing")
+	}
+
+	for _, test := range []struct {
+		holder, issuer, balance string
+	}{
+		{"alice", "bob", "10.0000000"},
+		{"alice", "carol", "10.0000000"},
+		{"bob", "alice", ""},
+		{"bob", "carol", ""},
+	} {
+		if balance := balanceOf(t, app, test.holder, test.issuer, "USD"); balance != test.balance {
+			t.Errorf("%s holds %q of %s's USD, want %q",
+				test.holder, balance, test.issuer, test.balance)
+		}
+	}
+
+	// now that the accounts exist and trust each other
+	lunch := createTestThing(t, app, "lunch", "bob", "12",
+		map[string]interface{}{"account": "alice", "paid": "0"},
+		map[string]interface{}{"account": "bob", "paid": "12"},
+	)
+	publishTestThing(t, app, lunch)
+
+	if balance := balanceOf(t, app, "bob", "alice", "USD"); balance != "6.0000000" {
+		t.Errorf("bob holds %q of alice's USD after lunch, want 6.0000000", balance)
+	}
+	if balance := balanceOf(t, app, "alice", "bob", "USD"); balance != "10.0000000" {
+		t.Errorf("alice holds %q of bob's USD after lunch, want 10.0000000", balance)
+	}
+}
+
+func TestDeleteThingAfterFailedPublication(t *testing.T) {
+	app := newTestApp(t)
+
+	createTestThing(t, app, "dinner", "alice", "30",
+		map[string]interface{}{"account": "alice", "paid": "30"},
+		map[string]interface{}{"account": "bob", "paid": "0"},
+	)
+
+	// while it is queued it can't change
+	err := enqueuePublication(app.pg, "dinner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	access, err := app.getThingAccess("dinner", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := access.canDelete(); err != errAlreadyPublished {
+		t.Errorf("canDelete() while queued = %v, want %v", err, errAlreadyPublished)
+	}
+
+	// but once the publisher gave up it can
+	_, err = app.pg.Exec(`
+UPDATE publications SET status = 'failed', attempts = $2 WHERE thing_id = $1
+    `, "dinner", maxPublicationAttempts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	access, err = app.getThingAccess("dinner", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := access.canDelete(); err != nil {
+		t.Fatalf("canDelete() after a failed publication = %v", err)
+	}
+
+	txn, err := app.pg.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Rollback()
+	err = deleteThing(txn, "dinner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = txn.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = app.getThingAccess("dinner", "alice")
+	if err != errThingNotFound {
+		t.Errorf("getThingAccess() after deleting = %v, want %v", err, errThingNotFound)
+	}
+}
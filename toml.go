@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// stellar.toml (SEP-1) tells wallets where our federation server is and
+// describes the IOUs issued by our users, so they are displayed properly.
+// when many domains are served each one lists only the users of its
+// namespace, see federation.go.
+
+// TomlCurrency is an IOU asset issued by one of our users.
+type TomlCurrency struct {
+	UserId  string `db:"user_id"`
+	Issuer  string `db:"address"`
+	Code    string `db:"asset"`
+	Address string `db:"-"` // federation address of the issuer
+}
+
+func (app *App) stellarToml(w http.ResponseWriter, r *http.Request) {
+	domain := strings.ToLower(r.Host)
+	if host, _, err := net.SplitHostPort(domain); err == nil {
+		domain = host
+	}
+	if _, ok := app.federationDomains()[domain]; !ok {
+		domain = strings.ToLower(app.s.HomeDomain)
+	}
+
+	currencies, err := app.tomlCurrencies(domain)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/toml")
+	w.Write(app.renderToml(currencies))
+}
+
+// tomlCurrencies lists the assets issued by the custodial users of `domain`
+// on things and settlement plans, see recordIssuedAssets. we only control
+// the home domain of custodial accounts, so the others can't point to this
+// file.
+func (app *App) tomlCurrencies(domain string) (currencies []TomlCurrency, err error) {
+	var issued []TomlCurrency
+	err = app.pg.Select(&issued, `
+SELECT user_id, address, asset
+FROM issued_assets
+INNER JOIN users ON users.id = user_id
+WHERE coalesce(seed, '') != ''
+    `)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to load issued assets for stellar.toml")
+		return
+	}
+
+	for _, currency := range issued {
+		name, d := app.federationAddress(currency.UserId)
+		if strings.ToLower(d) != domain {
+			continue
+		}
+		currency.Address = name + "*" + d
+		currencies = append(currencies, currency)
+	}
+
+	sort.Slice(currencies, func(i, j int) bool {
+		if currencies[i].UserId != currencies[j].UserId {
+			return currencies[i].UserId < currencies[j].UserId
+		}
+		return currencies[i].Code < currencies[j].Code
+	})
+	return
+}
+
+// recordIssuedAssets remembers the IOUs the debtors of a thing issue, so
+// they are listed on stellar.toml. it's called when the transactions of the
+// thing are planned, since after that only failures can stop it from being
+// published.
+func (thing Thing) recordIssuedAssets(db sqlx.Execer, debts []Transfer) error {
+	for _, debt := range debts {
+		_, err := db.Exec(`
+INSERT INTO issued_assets (user_id, asset) VALUES ($1, $2)
+ON CONFLICT DO NOTHING
+        `, debt.From, debt.Asset)
+		if err != nil {
+			log.Error().Err(err).Str("thing", thing.Id).Str("user", debt.From).
+				Msg("failed to record issued asset")
+			return err
+		}
+	}
+
+	_, err := db.Exec(`
+UPDATE things SET assets_recorded = true WHERE id = $1
+    `, thing.Id)
+	return err
+}
+
+// recordPastIssuedAssets records the IOUs of the things that were planned
+// before issued_assets existed. once they are all recorded it does nothing.
+func (app *App) recordPastIssuedAssets() {
+	var things []Thing
+	err := app.pg.Select(&things, `
+SELECT `+(Thing{}).columns()+` FROM things
+WHERE NOT assets_recorded AND (
+  coalesce(txn, '') != '' OR envelope IS NOT NULL OR EXISTS (
+    SELECT 1 FROM thing_transactions WHERE thing_id = things.id
+  )
+)
+    `)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to load things to record their issued assets")
+		return
+	}
+
+	for _, thing := range things {
+		err = thing.fillParties(app)
+		if err != nil {
+			return
+		}
+		var debts []Transfer
+		debts, err = thing.debts(app)
+		if err != nil {
+			return
+		}
+
+		err = thing.recordIssuedAssets(app.pg, debts)
+		if err != nil {
+			return
+		}
+	}
+
+	if len(things) > 0 {
+		log.Info().Int("things", len(things)).Msg("recorded assets issued in the past")
+	}
+}
+
+func (app *App) renderToml(currencies []TomlCurrency) []byte {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "FEDERATION_SERVER=%s\n", strconv.Quote(app.s.ServiceURL+"/federation"))
+	fmt.Fprintf(&buf, "NETWORK_PASSPHRASE=%s\n", strconv.Quote(app.n.Passphrase))
+	if _, ok := app.authenticators["sep10"]; ok {
+		fmt.Fprintf(&buf, "WEB_AUTH_ENDPOINT=%s\n", strconv.Quote(app.s.ServiceURL+"/auth/sep10"))
+		fmt.Fprintf(&buf, "SIGNING_KEY=%s\n", strconv.Quote(app.s.SourceAddress))
+	}
+
+	accounts := []string{strconv.Quote(app.s.SourceAddress)}
+	seen := map[string]bool{app.s.SourceAddress: true}
+	for _, currency := range currencies {
+		if !seen[currency.Issuer] {
+			seen[currency.Issuer] = true
+			accounts = append(accounts, strconv.Quote(currency.Issuer))
+		}
+	}
+	fmt.Fprintf(&buf, "ACCOUNTS=[\n  %s\n]\n", strings.Join(accounts, ",\n  "))
+
+	buf.WriteString("\n[DOCUMENTATION]\n")
+	for _, field := range [][2]string{
+		{"ORG_NAME", app.s.OrgName},
+		{"ORG_URL", app.s.OrgURL},
+		{"ORG_DESCRIPTION", app.s.OrgDescription},
+		{"ORG_LOGO", app.s.OrgLogo},
+		{"ORG_OFFICIAL_EMAIL", app.s.OrgOfficialEmail},
+	} {
+		if field[1] != "" {
+			fmt.Fprintf(&buf, "%s=%s\n", field[0], strconv.Quote(field[1]))
+		}
+	}
+
+	for _, currency := range currencies {
+		buf.WriteString("\n[[CURRENCIES]]\n")
+		fmt.Fprintf(&buf, "code=%s\n", strconv.Quote(currency.Code))
+		fmt.Fprintf(&buf, "issuer=%s\n", strconv.Quote(currency.Issuer))
+		fmt.Fprintf(&buf, "display_decimals=%d\n", app.assetPrecision(currency.Code))
+		fmt.Fprintf(&buf, "name=%s\n", strconv.Quote(currency.Code+" owed by "+currency.Address))
+		fmt.Fprintf(&buf, "desc=%s\n", strconv.Quote(
+			"IOUs issued by "+currency.Address+" for the "+currency.Code+
+				" they owe to their friends. they are worth only as much as "+
+				currency.Address+" is trusted to pay them back."))
+		buf.WriteString("is_asset_anchored=false\n")
+	}
+
+	return buf.Bytes()
+}
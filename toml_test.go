@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTomlCurrencies(t *testing.T) {
+	app := newTestApp(t)
+
+	bob, err := app.ensureUser("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishTestThing(t, app, createTestThing(t, app, "dinner", "alice", "20",
+		map[string]interface{}{"account": "alice", "paid": "20"},
+		map[string]interface{}{"account": "bob", "paid": "0"},
+	))
+
+	check := func(when string) {
+		currencies, err := app.tomlCurrencies(app.s.HomeDomain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// alice paid everything, so only bob issued IOUs
+		if len(currencies) != 1 {
+			t.Fatalf("%s: got %d currencies, want 1: %v", when, len(currencies), currencies)
+		}
+		want := TomlCurrency{
+			UserId:  "bob",
+			Issuer:  bob.Address,
+			Code:    "USD",
+			Address: "bob*" + app.s.HomeDomain,
+		}
+		if currencies[0] != want {
+			t.Errorf("%s: got %+v, want %+v", when, currencies[0], want)
+		}
+	}
+	check("after publishing")
+
+	// as if dinner had been published before issued_assets existed
+	_, err = app.pg.Exec(`
+DELETE FROM issued_assets;
+UPDATE things SET assets_recorded = false;
+    `)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.recordPastIssuedAssets()
+	check("after recording past assets")
+
+	var pending int
+	err = app.pg.Get(&pending, `SELECT count(*) FROM things WHERE NOT assets_recorded`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending != 0 {
+		t.Errorf("%d things still not recorded", pending)
+	}
+}
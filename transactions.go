@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/shopspring/decimal"
+	b "github.com/stellar/go/build"
+	"github.com/stellar/go/xdr"
+)
+
+// the operations of a thing may not fit in a single stellar transaction, so
+// they are planned all at once in as many transactions as needed and stored
+// on thing_transactions. these are then submitted in order, each getting a
+// sequence number and signatures only right before it is sent. if one of
+// them fails the next publish attempt resumes from it, so the operations
+// already applied are never built again.
+//
+// before an envelope is sent it is stored along with its hash. if we don't
+// hear back, the next attempt asks horizon about that hash and sends the same
+// envelope again instead of building a new one, so a transaction can never
+// be applied twice.
+
+type ThingTransaction struct {
+	ThingId      string         `db:"thing_id"`
+	Position     int            `db:"position"`
+	Tx           string         `db:"tx"`
+	Signers      pq.StringArray `db:"signers"`
+	Hash         string         `db:"hash"`
+	Envelope     string         `db:"envelope"`
+	EnvelopeHash string         `db:"envelope_hash"`
+}
+
+func (thing Thing) plannedTransactions(app *App) (txs []ThingTransaction, err error) {
+	err = app.pg.Select(&txs, `
+SELECT
+  thing_id, position, tx, signers,
+  coalesce(hash, '') AS hash,
+  coalesce(envelope, '') AS envelope,
+  coalesce(envelope_hash, '') AS envelope_hash
+FROM thing_transactions
+WHERE thing_id = $1
+ORDER BY position
+    `, thing.Id)
+	if err != nil {
+		log.Error().Str("thing", thing.Id).Err(err).Msg("on thing transactions query")
+	}
+	return
+}
+
+// planTransactions stores one transaction for each batch of operations,
+// along with the IOUs the `debts` issue.
+func (thing Thing) planTransactions(
+	app *App,
+	batches [][]Operation,
+	debts []Transfer,
+) error {
+	txn, err := app.pg.Beginx()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	// someone else may be publishing this same thing
+	var planned int
+	err = txn.Get(&planned, `
+SELECT count(*) FROM thing_transactions
+WHERE thing_id = (SELECT id FROM things WHERE id = $1 FOR UPDATE)
+    `, thing.Id)
+	if err != nil {
+		return err
+	}
+	if planned > 0 {
+		return nil
+	}
+
+	for i, batch := range batches {
+		tx := app.createStellarTransaction()
+		tx.Mutate(b.MemoText{thing.Id})
+		for _, op := range batch {
+			tx.Mutate(op.Mutator)
+		}
+		if tx.Err != nil {
+			log.Warn().Err(tx.Err).Msg("failed to build transaction")
+			return tx.Err
+		}
+
+		var buf bytes.Buffer
+		_, err = xdr.Marshal(&buf, tx.TX)
+		if err != nil {
+			return err
+		}
+
+		var signers pq.StringArray
+		for _, signer := range batchSigners(batch) {
+			signers = append(signers, signer.Address)
+		}
+
+		_, err = txn.Exec(`
+INSERT INTO thing_transactions (thing_id, position, tx, signers)
+VALUES ($1, $2, $3, $4)
+        `, thing.Id, i, base64.StdEncoding.EncodeToString(buf.Bytes()), signers)
+		if err != nil {
+			log.Error().Err(err).Str("thing", thing.Id).Int("position", i).
+				Msg("failed to store planned transaction")
+			return err
+		}
+	}
+
+	err = thing.recordIssuedAssets(txn, debts)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Str("thing", thing.Id).Int("transactions", len(batches)).
+		Msg("planned transactions")
+	return txn.Commit()
+}
+
+// submitTransactions submits, in order, the planned transactions of a thing
+// that weren't applied yet. it stops at the first one that needs signatures
+// from users who hold their own keys, addSignatures continues from there.
+func (thing Thing) submitTransactions(app *App) (published bool, err error) {
+	planned, err := thing.plannedTransactions(app)
+	if err != nil {
+		return
+	}
+
+	for _, ttx := range planned {
+		if ttx.Hash != "" {
+			continue
+		}
+
+		var hash string
+		var fee int64
+		if ttx.Envelope != "" {
+			hash, fee, err = app.settleEnvelope(ttx.EnvelopeHash, ttx.Envelope)
+			if err != nil {
+				return
+			}
+			if hash == "" {
+				err = storeEnvelope(app.pg, thing.Id, ttx.Position, "", "")
+				if err != nil {
+					return
+				}
+			}
+		}
+
+		if hash == "" {
+			// never sent or its sequence number was used by something else,
+			// so we must build it again.
+			var tx *b.TransactionBuilder
+			tx, err = app.rebuildStellarTransaction(ttx.Tx)
+			if err != nil {
+				log.Error().Err(err).Str("thing", thing.Id).Int("position", ttx.Position).
+					Msg("stored transaction is invalid")
+				return
+			}
+
+			var seeds, external []string
+			seeds, external, err = app.signingKeys(ttx.Signers)
+			if err != nil {
+				return
+			}
+
+			if len(external) > 0 {
+				var blob string
+				blob, err = app.pendingEnvelope(tx, seeds,
+					"thing:"+thing.Id+":"+strconv.Itoa(ttx.Position))
+				if err != nil {
+					return
+				}
+
+				log.Info().Int("signers", len(external)).Int("position", ttx.Position).
+					Msg("waiting for external signatures")
+				err = app.requestSignatures(thing.Id, ttx.Position, blob, external)
+				return
+			}
+
+			position := ttx.Position
+			hash, fee, err = app.sequences.submit(app, tx, seeds, func(blob, hash string) error {
+				// otherwise we wouldn't know later that it was sent
+				return storeEnvelope(app.pg, thing.Id, position, blob, hash)
+			})
+			if err != nil {
+				log.Warn().Err(err).Str("thing", thing.Id).Int("position", ttx.Position).
+					Int("transactions", len(planned)).
+					Msg("publication interrupted, will resume from here")
+				return
+			}
+		}
+
+		published, err = recordTransaction(app.pg, thing.Id, ttx.Position, hash, fee)
+		if err != nil {
+			return
+		}
+	}
+
+	if published {
+		total, _ := thing.feeCharged(app)
+		log.Info().
+			Str("thing", thing.Id).
+			Int("transactions", len(planned)).
+			Str("fee", total.String()).
+			Msg("published")
+	}
+
+	return
+}
+
+// feeCharged returns how much the transactions of a thing cost, in lumens.
+func (thing Thing) feeCharged(app *App) (decimal.Decimal, error) {
+	var stroops int64
+	err := app.pg.Get(&stroops, `
+SELECT coalesce(sum(fee_charged), 0) FROM thing_transactions
+WHERE thing_id = $1
+    `, thing.Id)
+	return decimal.New(stroops, -7), err
+}
+
+func storeEnvelope(db sqlx.Execer, thingId string, position int, blob, hash string) error {
+	_, err := db.Exec(`
+UPDATE thing_transactions SET envelope = nullable($3), envelope_hash = nullable($4)
+WHERE thing_id = $1 AND position = $2
+    `, thingId, position, blob, hash)
+	if err != nil {
+		log.Error().Err(err).Str("thing", thingId).Int("position", position).
+			Msg("failed to store envelope")
+	}
+	return err
+}
+
+// settleEnvelope finds out what happened to an envelope that was sent before.
+// if it was applied its hash and fee are returned. if not, it is sent again,
+// which is safe since the same envelope can't be applied twice. a blank hash
+// means it was refused for good (its sequence number was used by something
+// else, its fee is too low now, ...), so it will never be applied and must be
+// built again.
+func (app *App) settleEnvelope(hash, blob string) (string, int64, error) {
+	applied, fee, err := app.h.TransactionApplied(hash)
+	if err != nil {
+		return "", 0, err
+	}
+	if applied {
+		log.Info().Str("tx", hash).Msg("transaction was already applied")
+		return hash, fee, nil
+	}
+
+	_, fee, err = app.submitStellarTransaction(blob)
+	if err == nil {
+		return hash, fee, nil
+	}
+	code := transactionCode(err)
+	if code == "" {
+		// we didn't get an answer, it may still be applied
+		return "", 0, err
+	}
+
+	// it may have been applied right before we sent it again
+	applied, fee, err = app.h.TransactionApplied(hash)
+	if err != nil {
+		return "", 0, err
+	}
+	if applied {
+		return hash, fee, nil
+	}
+	log.Info().Str("tx", hash).Str("code", code).
+		Msg("stored envelope was refused, will build it again")
+	return "", 0, nil
+}
+
+// signingKeys returns the seeds we hold for the given addresses, along with
+// our source account seed, and the addresses whose keys we don't have.
+func (app *App) signingKeys(addresses []string) (seeds []string, external []string, err error) {
+	var users []User
+	err = app.pg.Select(&users, `
+SELECT `+(User{}).columns()+` FROM users
+WHERE address = ANY($1)
+    `, pq.StringArray(addresses))
+	if err != nil {
+		return
+	}
+
+	seeds = []string{app.s.SourceSeed}
+	known := make(map[string]bool, len(users))
+	for _, user := range users {
+		known[user.Address] = true
+		if user.custodial() {
+			seeds = append(seeds, user.Seed)
+		} else {
+			external = append(external, user.Address)
+		}
+	}
+	for _, address := range addresses {
+		if !known[address] {
+			// nobody can sign for this one anymore, fail when signing
+			seeds = append(seeds, "")
+		}
+	}
+	return
+}
+
+// recordTransaction stores the hash and the fee of the planned transaction
+// of a thing at `position`. once all are applied the thing is published and
+// its txn is set to the hash of the last one.
+func recordTransaction(
+	db sqlx.Execer,
+	thingId string,
+	position int,
+	hash string,
+	fee int64,
+) (published bool, err error) {
+	_, err = db.Exec(`
+UPDATE thing_transactions SET hash = $3, fee_charged = $4
+WHERE thing_id = $1 AND position = $2 AND hash IS NULL
+    `, thingId, position, hash, fee)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("tx", hash).
+			Msg("failed to append hash to postgres after stellar transaction ")
+		return
+	}
+
+	res, err := db.Exec(`
+UPDATE things SET txn = $2
+WHERE id = $1 AND NOT EXISTS (
+  SELECT 1 FROM thing_transactions
+  WHERE thing_id = $1 AND hash IS NULL
+)
+    `, thingId, hash)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("tx", hash).
+			Msg("failed to append hash to postgres after stellar transaction ")
+		return
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
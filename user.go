@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"errors"
 	"strconv"
 
@@ -8,12 +9,13 @@ import (
 	b "github.com/stellar/go/build"
 	"github.com/stellar/go/clients/horizon"
 	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/strkey"
 )
 
 type User struct {
 	Id           string `json:"id"            db:"id"`
 	Address      string `json:"address"       db:"address"`
-	Seed         string `json:"-"             db:"seed"`
+	Seed         string `json:"-"             db:"seed"` // encrypted, see seeds.go
 	DefaultAsset string `json:"default_asset" db:"default_asset"`
 
 	ha horizon.Account `json:"-"`
@@ -28,6 +30,12 @@ coalesce(users.default_asset, 'USD') AS default_asset
     `
 }
 
+// custodial users have their keys stored here, the others sign their
+// transactions themselves (see signatures.go).
+func (u User) custodial() bool {
+	return u.Seed != ""
+}
+
 type Path struct {
 	Src  Asset   `json:"src_asset"`
 	Dst  Asset   `json:"dst_asset"`
@@ -46,7 +54,7 @@ type Asset struct {
 	IssuerId      string `json:"issuer_id"`
 }
 
-func ensureUser(id string) (user User, err error) {
+func (app *App) ensureUser(id string) (user User, err error) {
 	if id == "" {
 		err = errors.New("blank user id")
 		return
@@ -59,7 +67,13 @@ func ensureUser(id string) (user User, err error) {
 		return
 	}
 
-	err = pg.Get(&user, `
+	seed, err := app.sealSeed(pair.Seed())
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to encrypt seed")
+		return
+	}
+
+	err = app.pg.Get(&user, `
 WITH ins AS (
   INSERT INTO users (id, address, seed)
   VALUES (lower($1), $2, $3)
@@ -67,7 +81,7 @@ WITH ins AS (
 )
 
 SELECT `+user.columns()+` FROM users WHERE id = $1
-    `, id, pair.Address(), pair.Seed())
+    `, id, pair.Address(), seed)
 	if err != nil {
 		log.Warn().Err(err).Str("id", id).Msg("failed to create user on db")
 		return
@@ -76,29 +90,98 @@ SELECT `+user.columns()+` FROM users WHERE id = $1
 	return
 }
 
-func getExistingUser(id string) (user User, err error) {
-	err = pg.Get(&user, "SELECT "+user.columns()+" FROM users WHERE id = $1", id)
+func (app *App) getExistingUser(id string) (user User, err error) {
+	err = app.pg.Get(&user, "SELECT "+user.columns()+" FROM users WHERE id = $1", id)
 	if err != nil && err.Error() != "sql: no rows in result set" {
 		log.Warn().Err(err).Str("id", id).Msg("failed to load user on db")
 	}
 	return
 }
 
-func (user User) fundInitial(amount int) b.TransactionMutator {
+// setExternalAddress makes a user non-custodial: from now on their IOUs
+// are issued from an account whose keys they hold, and they must sign
+// their part of each transaction (see signatures.go). callers must check
+// they own `address` before.
+// this is only possible while their current address, ours or theirs, hasn't
+// been used yet, otherwise the IOUs issued from it would be orphaned.
+func (app *App) setExternalAddress(id, address string) (user User, err error) {
+	_, err = strkey.Decode(strkey.VersionByteAccountID, address)
+	if err != nil {
+		return user, errors.New("invalid-address")
+	}
+
+	user, err = app.getExistingUser(id)
+	if err != nil {
+		return
+	}
+	if user.Address == address {
+		return user, nil
+	}
+
+	var used bool
+	err = app.pg.Get(&used, `
+SELECT EXISTS (
+  SELECT 1 FROM parties
+  INNER JOIN things ON things.id = parties.thing_id
+  WHERE parties.user_id = $1 AND (
+    coalesce(things.txn, '') != ''
+    OR things.envelope IS NOT NULL
+    OR EXISTS (SELECT 1 FROM thing_transactions WHERE thing_id = things.id)
+  )
+) OR EXISTS (
+  SELECT 1 FROM settlements
+  WHERE (payer = $1 OR payee = $1) AND txn IS NOT NULL
+) OR EXISTS (
+  SELECT 1 FROM settlement_plan_transfers WHERE from_user = $1 OR to_user = $1
+)
+    `, id)
+	if err != nil {
+		log.Warn().Err(err).Str("id", id).Msg("failed to check if address was used")
+		return
+	}
+	if used {
+		return user, errors.New("account-already-used")
+	}
+
+	if user.custodial() {
+		_, err = app.h.LoadAccount(user.Address)
+		if err == nil {
+			return user, errors.New("account-already-used")
+		} else if herr, ok := err.(*horizon.Error); !ok || herr.Response.StatusCode != 404 {
+			return
+		}
+	}
+
+	err = app.pg.Get(&user, `
+UPDATE users SET address = $2, seed = NULL
+WHERE id = $1
+  AND NOT EXISTS (SELECT 1 FROM users WHERE address = $2 AND id != $1)
+RETURNING `+user.columns(), id, address)
+	if err == sql.ErrNoRows {
+		return user, errors.New("address-already-registered")
+	} else if err != nil {
+		log.Warn().Err(err).Str("id", id).Msg("failed to set external address")
+		return
+	}
+
+	return
+}
+
+func (user User) fundInitial(app *App, amount int) b.TransactionMutator {
 	return b.CreateAccount(
-		b.SourceAccount{s.SourceAddress},
+		b.SourceAccount{app.s.SourceAddress},
 		b.Destination{user.Address},
 		b.NativeAmount{strconv.Itoa(amount)},
 	)
 }
 
-func (user User) fund(amount int) b.TransactionMutator {
+func (user User) fund(app *App, amount int) b.TransactionMutator {
 	if amount <= 0 {
 		return b.Defaults{}
 	}
 
 	return b.Payment(
-		b.SourceAccount{s.SourceAddress},
+		b.SourceAccount{app.s.SourceAddress},
 		b.Destination{user.Address},
 		b.NativeAmount{strconv.Itoa(amount)},
 	)
@@ -106,6 +189,7 @@ func (user User) fund(amount int) b.TransactionMutator {
 
 // create a new a trustline or add to an existing trustline so it fits `add`
 func (rec User) trust(
+	app *App,
 	iss User,
 	asset string,
 	add string,
@@ -165,7 +249,7 @@ func (rec User) trust(
 		b.Trust(
 			asset,
 			iss.Address,
-			b.Limit(newTrust.StringFixed(2)),
+			b.Limit(app.formatAmount(newTrust, asset)),
 			b.SourceAccount{rec.Address},
 		),
 		true,
@@ -174,6 +258,7 @@ func (rec User) trust(
 
 // create a new offer or add `add` to an existing offer
 func (user User) offer(
+	app *App,
 	offerIss User, offerAsset string,
 	requestIss User, requestAsset string,
 	price, add string,
@@ -189,7 +274,7 @@ func (user User) offer(
 	newOfferAmount := add_
 
 	// load existing offers
-	resp, err := h.LoadAccountOffers(user.Address)
+	resp, err := app.h.LoadAccountOffers(user.Address)
 	if err != nil {
 		if herr, ok := err.(*horizon.Error); ok {
 			log.Warn().
@@ -250,7 +335,7 @@ func (user User) offer(
 				},
 				Price: b.Price(price),
 			},
-			b.Amount(newOfferAmount.StringFixed(2)),
+			b.Amount(app.formatAmount(newOfferAmount, offerAsset)),
 			existingOffer, // if zero will create a new offer, no problem.
 		),
 		nil